@@ -0,0 +1,389 @@
+// Package asm translates between bytecode and a textual assembly format.
+//
+// A program lists its constant pool followed by the main function:
+//
+//	const 0 int 1
+//	const 1 function "inc" params 1 locals 1 {
+//		OpGetLocal 0
+//		OpConstant 0
+//		OpAdd
+//		OpReturnValue
+//	}
+//	main {
+//		OpClosure 1 0
+//		OpConstant 0
+//		OpCall 1
+//		OpJumpNotTruthy done
+//		OpNull
+//		OpPop
+//	done:
+//	}
+//
+// Constant values are written as int, float, string, bool, null,
+// array [v, ...], hash {k: v, ...} or function. Booleans and null are the
+// VM's own True, False and Null, which it tells apart by identity. Instructions may be preceded
+// by their offset, which is ignored. Jump operands are labels, defined by
+// "name:" before the instruction they refer to, or plain offsets, and so are
+// the start, end and catch targets of the "handler" lines describing the
+// exception handlers of a function. Operands that do not fit their normal
+// width are encoded with OpWide. Comments start with //.
+//
+// Assemble(Disassemble(b)) reproduces b except for its source maps and
+// variable names, which are only printed as comments.
+package asm
+
+import (
+	"fmt"
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/vm"
+	"math"
+	"strconv"
+	"strings"
+	"text/scanner"
+)
+
+// Assemble parses a program in the assembly format
+func Assemble(src string) (bytecode *compiler.Bytecode, err error) {
+	a := &assembler{}
+	a.s.Init(strings.NewReader(src))
+	a.s.Mode = scanner.ScanIdents | scanner.ScanInts | scanner.ScanFloats |
+		scanner.ScanStrings | scanner.ScanRawStrings | scanner.ScanComments | scanner.SkipComments
+	a.s.Whitespace = 1<<'\t' | 1<<'\r' | 1<<' '
+	a.s.Error = func(s *scanner.Scanner, msg string) { a.fail(s.Position, "%s", msg) }
+
+	// errors abort parsing by panicking with an asmError
+	defer func() {
+		if r := recover(); r != nil {
+			aerr, ok := r.(asmError)
+			if !ok {
+				panic(r)
+			}
+			bytecode, err = nil, aerr.err
+		}
+	}()
+
+	a.next()
+	bytecode = &compiler.Bytecode{}
+	for {
+		a.skipNewlines()
+		if a.tok == scanner.EOF {
+			a.fail(a.pos, "missing main function")
+		}
+		keyword := a.expectIdent()
+		switch keyword {
+		case "const":
+			pos := a.pos
+			index := a.expectInt()
+			if index != len(bytecode.Constants) {
+				a.fail(pos, "constant %d defined out of order, want %d", index, len(bytecode.Constants))
+			}
+			bytecode.Constants = append(bytecode.Constants, a.parseValue())
+			a.expectEndOfLine()
+		case "main":
+			bytecode.Instructions, bytecode.Handlers = a.parseBody()
+			a.expectEndOfLine()
+			a.skipNewlines()
+			if a.tok != scanner.EOF {
+				a.fail(a.pos, "unexpected %s after main function", a.s.TokenText())
+			}
+			return bytecode, nil
+		default:
+			a.fail(a.pos, "expected const or main, got %s", keyword)
+		}
+	}
+}
+
+type asmError struct {
+	err error
+}
+
+type assembler struct {
+	s   scanner.Scanner
+	tok rune
+	pos scanner.Position // position of tok
+}
+
+func (a *assembler) fail(pos scanner.Position, format string, args ...interface{}) {
+	panic(asmError{fmt.Errorf("%d:%d: %s", pos.Line, pos.Column, fmt.Sprintf(format, args...))})
+}
+
+func (a *assembler) next() {
+	a.tok = a.s.Scan()
+	a.pos = a.s.Position
+	if !a.pos.IsValid() {
+		a.pos = a.s.Pos() // at the end of the input
+	}
+}
+
+func (a *assembler) describe() string {
+	switch a.tok {
+	case scanner.EOF:
+		return "end of input"
+	case '\n':
+		return "end of line"
+	}
+	return strconv.Quote(a.s.TokenText())
+}
+
+func (a *assembler) expect(tok rune) {
+	if a.tok != tok {
+		a.fail(a.pos, "expected %s, got %s", scanner.TokenString(tok), a.describe())
+	}
+	a.next()
+}
+
+func (a *assembler) expectIdent() string {
+	if a.tok != scanner.Ident {
+		a.fail(a.pos, "expected identifier, got %s", a.describe())
+	}
+	text := a.s.TokenText()
+	a.next()
+	return text
+}
+
+func (a *assembler) expectKeyword(keyword string) {
+	pos := a.pos
+	if ident := a.expectIdent(); ident != keyword {
+		a.fail(pos, "expected %s, got %s", keyword, ident)
+	}
+}
+
+func (a *assembler) expectInt() int {
+	if a.tok != scanner.Int {
+		a.fail(a.pos, "expected integer, got %s", a.describe())
+	}
+	v, err := strconv.ParseInt(a.s.TokenText(), 10, 64)
+	if err != nil || v > math.MaxInt32 {
+		a.fail(a.pos, "integer %s out of range", a.s.TokenText())
+	}
+	a.next()
+	return int(v)
+}
+
+func (a *assembler) expectEndOfLine() {
+	if a.tok != '\n' && a.tok != scanner.EOF {
+		a.fail(a.pos, "expected end of line, got %s", a.describe())
+	}
+	a.next()
+}
+
+func (a *assembler) skipNewlines() {
+	for a.tok == '\n' {
+		a.next()
+	}
+}
+
+// sign reads an optional sign in front of a number
+func (a *assembler) sign() string {
+	if a.tok == '-' || a.tok == '+' {
+		sign := string(a.tok)
+		a.next()
+		return sign
+	}
+	return ""
+}
+
+func (a *assembler) parseValue() object.Object {
+	pos := a.pos
+	switch kind := a.expectIdent(); kind {
+	case "int":
+		text := a.sign()
+		if a.tok != scanner.Int {
+			a.fail(a.pos, "expected integer, got %s", a.describe())
+		}
+		text += a.s.TokenText()
+		v, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			a.fail(a.pos, "invalid integer %s", text)
+		}
+		a.next()
+		return &object.Integer{Value: v}
+	case "float":
+		text := a.sign()
+		if a.tok != scanner.Int && a.tok != scanner.Float && a.tok != scanner.Ident {
+			a.fail(a.pos, "expected float, got %s", a.describe())
+		}
+		text += a.s.TokenText()
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			a.fail(a.pos, "invalid float %s", text)
+		}
+		a.next()
+		return &object.Float{Value: v}
+	case "string":
+		if a.tok != scanner.String && a.tok != scanner.RawString {
+			a.fail(a.pos, "expected string, got %s", a.describe())
+		}
+		v, err := strconv.Unquote(a.s.TokenText())
+		if err != nil {
+			a.fail(a.pos, "invalid string %s", a.s.TokenText())
+		}
+		a.next()
+		return &object.String{Value: v}
+	case "bool":
+		switch v := a.expectIdent(); v {
+		case "true":
+			return vm.True
+		case "false":
+			return vm.False
+		default:
+			a.fail(pos, "invalid bool %s", v)
+		}
+	case "null":
+		return vm.Null
+	case "array":
+		a.expect('[')
+		elements := []object.Object{}
+		for a.tok != ']' {
+			if len(elements) > 0 {
+				a.expect(',')
+			}
+			elements = append(elements, a.parseValue())
+		}
+		a.next()
+		return &object.Array{Elements: elements}
+	case "hash":
+		a.expect('{')
+		pairs := map[object.HashKey]object.HashPair{}
+		for a.tok != '}' {
+			if len(pairs) > 0 {
+				a.expect(',')
+			}
+			keyPos := a.pos
+			key := a.parseValue()
+			a.expect(':')
+			hashKey, ok := key.(object.Hashable)
+			if !ok {
+				a.fail(keyPos, "unusable as hash key: %s", key.Type())
+			}
+			pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: a.parseValue()}
+		}
+		a.next()
+		return &object.Hash{Pairs: pairs}
+	case "function":
+		fn := &object.CompiledFunction{}
+		if a.tok != scanner.String {
+			a.fail(a.pos, "expected function name, got %s", a.describe())
+		}
+		fn.Name, _ = strconv.Unquote(a.s.TokenText())
+		a.next()
+		a.expectKeyword("params")
+		fn.NumParameters = a.expectInt()
+		a.expectKeyword("locals")
+		fn.NumLocals = a.expectInt()
+		fn.Instructions, fn.Handlers = a.parseBody()
+		return fn
+	default:
+		a.fail(pos, "unknown constant kind %s", kind)
+	}
+	return nil
+}
+
+// target is a jump target or handler offset, given as a label or an offset
+type target struct {
+	label  string
+	offset int
+	pos    scanner.Position
+}
+
+func (a *assembler) parseTarget() target {
+	t := target{pos: a.pos}
+	if a.tok == scanner.Int {
+		t.offset = a.expectInt()
+	} else {
+		t.label = a.expectIdent()
+	}
+	return t
+}
+
+// parseBody parses the instructions and handlers of a function between braces
+func (a *assembler) parseBody() (code.Instructions, []code.ExceptionHandler) {
+	a.expect('{')
+	ins := code.Instructions{}
+	labels := map[string]int{}
+	type jump struct {
+		offset int
+		op     code.Opcode
+		target target
+	}
+	var jumps []jump
+	var handlers [][3]target
+
+	for {
+		a.skipNewlines()
+		if a.tok == '}' {
+			a.next()
+			break
+		}
+		if a.tok == scanner.Int {
+			a.next() // offset of the instruction as printed by Disassemble
+		}
+		pos := a.pos
+		name := a.expectIdent()
+		if a.tok == ':' {
+			if _, ok := labels[name]; ok {
+				a.fail(pos, "label %s defined twice", name)
+			}
+			labels[name] = len(ins)
+			a.next()
+			continue
+		}
+		if name == "handler" {
+			handlers = append(handlers, [3]target{a.parseTarget(), a.parseTarget(), a.parseTarget()})
+			a.expectEndOfLine()
+			continue
+		}
+
+		op, ok := opcodes[name]
+		if !ok {
+			a.fail(pos, "unknown opcode %s", name)
+		}
+		if op == code.OpWide {
+			a.fail(pos, "OpWide is implied by operands that do not fit their width")
+		}
+		def, _ := code.Lookup(byte(op))
+		operands := make([]int, 0, len(def.OperandWidths))
+		for i := range def.OperandWidths {
+			if i == 0 && code.IsJump(op) {
+				jumps = append(jumps, jump{len(ins), op, a.parseTarget()})
+				operands = append(operands, 0)
+				continue
+			}
+			if a.tok != scanner.Int {
+				a.fail(a.pos, "%s expects %d operands, got %s", name, len(def.OperandWidths), a.describe())
+			}
+			operands = append(operands, a.expectInt())
+		}
+		encoded, err := code.Encode(op, operands...)
+		if err != nil {
+			a.fail(pos, "%s", err)
+		}
+		ins = append(ins, encoded...)
+		a.expectEndOfLine()
+	}
+
+	resolve := func(t target) int {
+		if t.label == "" {
+			return t.offset
+		}
+		offset, ok := labels[t.label]
+		if !ok {
+			a.fail(t.pos, "undefined label %s", t.label)
+		}
+		return offset
+	}
+	for _, j := range jumps {
+		encoded, err := code.Encode(j.op, resolve(j.target))
+		if err != nil {
+			a.fail(j.target.pos, "%s", err)
+		}
+		copy(ins[j.offset:], encoded)
+	}
+	var table []code.ExceptionHandler
+	for _, h := range handlers {
+		table = append(table, code.ExceptionHandler{Start: resolve(h[0]), End: resolve(h[1]), Catch: resolve(h[2])})
+	}
+	return ins, table
+}
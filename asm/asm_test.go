@@ -0,0 +1,320 @@
+package asm
+
+import (
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/lexer"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/parser"
+	"lyz-lang-2nd/vm"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+	t.Helper()
+	program := parser.New(lexer.New(input)).ParseProgram()
+	comp := compiler.New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	return comp.Bytecode()
+}
+
+func TestRoundTrip(t *testing.T) {
+	inputs := []string{
+		"1 + 2 * 3",
+		`let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib(10)`,
+		`let counter = fn() { let n = 0; fn() { n = n + 1; n } }; counter()()`,
+		`let r = ""; try { throw "x\ny"; } catch (e) { r = e; } finally { r = r + "!"; } r`,
+		`for (x in [1, 2.5, -0.5]) { if (x > 2) { break; } else { continue; } }`,
+		`let h = {"a": 1, 2: [true, false]}; h["a"] && h[2] || "${h} and ${1e100}"`,
+		`while (false) { } ~1 ** 2 % 3 << 4`,
+	}
+
+	for _, input := range inputs {
+		bytecode := compile(t, input)
+		// source maps and variable names are not part of the assembly format
+		bytecode.SourceMap = nil
+		for _, c := range bytecode.Constants {
+			if fn, ok := c.(*object.CompiledFunction); ok {
+				fn.SourceMap = nil
+				fn.LocalNames = nil
+				fn.FreeNames = nil
+			}
+		}
+
+		text, err := Disassemble(bytecode)
+		if err != nil {
+			t.Fatalf("%q: disassembler error: %s", input, err)
+		}
+		assembled, err := Assemble(text)
+		if err != nil {
+			t.Fatalf("%q: assembler error: %s\n%s", input, err, text)
+		}
+		if !reflect.DeepEqual(bytecode, assembled) {
+			t.Errorf("%q: bytecode changed by round trip.\n%s", input, text)
+		}
+
+		again, err := Disassemble(assembled)
+		if err != nil {
+			t.Fatalf("%q: disassembler error: %s", input, err)
+		}
+		if again != text {
+			t.Errorf("%q: disassembly changed by round trip.\nwant=%s\n got=%s", input, text, again)
+		}
+	}
+}
+
+func TestDisassembleAnnotations(t *testing.T) {
+	input := `let total = 0;
+let add = fn(x) {
+  total = total + x + len("ab");
+  fn() { x }
+};
+add(1)`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	symbolTable := compiler.NewSymbolTable()
+	for i, b := range object.Builtins {
+		symbolTable.DefineBuiltin(i, b.Name)
+	}
+	comp := compiler.NewWithState(symbolTable, []object.Object{})
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	expected := `const 0 int 0
+const 1 string "ab"
+const 2 function "" params 0 locals 0 {
+	// 4| fn() { x }
+	   0 OpGetFree 0              // x
+	   2 OpReturnValue
+}
+const 3 function "add" params 1 locals 1 {
+	// 3| total = total + x + len("ab");
+	   0 OpGetGlobal 0            // total
+	   3 OpGetLocal 0             // x
+	   5 OpAdd
+	   6 OpGetBuiltin 0           // len
+	   8 OpConstant 1             // "ab"
+	  11 OpCall 1
+	  13 OpAdd
+	  14 OpSetGlobal 0            // total
+	// 4| fn() { x }
+	  17 OpCaptureLocal 0         // x
+	  19 OpClosure 2 1            // function <anonymous>
+	  23 OpReturnValue
+}
+const 4 int 1
+main {
+	// 1| let total = 0;
+	   0 OpConstant 0             // 0
+	   3 OpSetGlobal 0            // total
+	// 2| let add = fn(x) {
+	   6 OpClosure 3 0            // function add
+	  10 OpSetGlobal 1            // add
+	// 6| add(1)
+	  13 OpGetGlobal 1            // add
+	  16 OpConstant 4             // 1
+	  19 OpCall 1
+	  21 OpPop
+}
+`
+	text, err := DisassembleWith(comp.Bytecode(), Options{Symbols: symbolTable, Source: input})
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	if text != expected {
+		t.Errorf("wrong disassembly.\nwant=%s\n got=%s", expected, text)
+	}
+	if _, err := Assemble(text); err != nil {
+		t.Errorf("assembler error: %s", err)
+	}
+}
+
+func TestDisassembleJumpSources(t *testing.T) {
+	text, err := Disassemble(compile(t, "if (true) { 1 } else { 2 }; false || true; try { 3 } catch (e) { e }"))
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	for _, want := range []string{"L0010: // from 1\n", "L0013: // from 7\n", "L0019: // from 15\n", "L0041: // from 28, 38\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("disassembly does not contain %q.\n%s", want, text)
+		}
+	}
+}
+
+func TestDisassembleBuiltinNames(t *testing.T) {
+	builtins := object.NewBuiltinRegistry()
+	builtins.Register("query", func(args ...object.Object) object.Object { return nil })
+	program := parser.New(lexer.New("query(len)")).ParseProgram()
+	comp := compiler.NewWithOptions(compiler.Options{Builtins: builtins})
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	text, err := DisassembleWith(comp.Bytecode(), Options{Builtins: builtins})
+	if err != nil {
+		t.Fatalf("disassembler error: %s", err)
+	}
+	for _, want := range []string{"OpGetBuiltin 6           // query\n", "OpGetBuiltin 0           // len\n"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("disassembly does not contain %q.\n%s", want, text)
+		}
+	}
+}
+
+func TestAssemble(t *testing.T) {
+	src := `
+// sums its arguments in a loop
+const 0 int 0
+const 1 int -9223372036854775808
+const 2 float -Inf
+const 3 string "a\tb"
+const 4 bool true
+const 5 null
+const 6 array [int 1, array [], hash {string "k": float 1.5}]
+const 7 function "count" params 1 locals 2 {
+	handler start end catch
+	OpConstant 0
+	OpSetLocal 1
+loop:
+	OpGetLocal 0
+	OpGetLocal 1
+	OpGreaterThan
+	OpJumpNotTruthy done
+start:
+	OpGetLocal 1
+	OpConstant 8
+	OpAdd
+	OpSetLocal 1
+end:
+	OpJump loop
+catch:
+	OpReturnValue
+done:
+	OpGetLocal 1 // the result
+	OpReturnValue
+}
+const 8 int 1
+main {
+	OpClosure 7 0
+	OpConstant 8
+	OpConstant 8
+	OpAdd
+	OpCall 1
+	OpPop
+}
+`
+	bytecode, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("assembler error: %s", err)
+	}
+	if err := vm.Verify(bytecode); err != nil {
+		t.Fatalf("verifier error: %s", err)
+	}
+	machine := vm.New(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	result, ok := machine.LastPoppedStackElem().(*object.Integer)
+	if !ok || result.Value != 2 {
+		t.Errorf("wrong result. got=%s", machine.LastPoppedStackElem().Inspect())
+	}
+
+	fn := bytecode.Constants[7].(*object.CompiledFunction)
+	expectedHandlers := []code.ExceptionHandler{{Start: 13, End: 21, Catch: 24}}
+	if !reflect.DeepEqual(fn.Handlers, expectedHandlers) {
+		t.Errorf("wrong handlers. want=%v, got=%v", expectedHandlers, fn.Handlers)
+	}
+	expected := []string{"0", "-9223372036854775808", "-Inf", "a\tb", "true", "null", `[1, [], {k: 1.5}]`}
+	for i, want := range expected {
+		if got := bytecode.Constants[i].Inspect(); got != want {
+			t.Errorf("constant %d: want=%q, got=%q", i, want, got)
+		}
+	}
+}
+
+func TestAssembleBooleans(t *testing.T) {
+	src := `
+const 0 bool false
+const 1 null
+const 2 int 1
+const 3 int 2
+main {
+	OpConstant 0
+	OpJumpNotTruthy other
+	OpConstant 2
+	OpJump done
+other:
+	OpConstant 1
+	OpNull
+	OpEqual
+	OpJumpNotTruthy wrong
+	OpConstant 3
+	OpJump done
+wrong:
+	OpConstant 2
+done:
+	OpPop
+}
+`
+	bytecode, err := Assemble(src)
+	if err != nil {
+		t.Fatalf("assembler error: %s", err)
+	}
+	if bytecode.Constants[0] != vm.False || bytecode.Constants[1] != vm.Null {
+		t.Fatalf("constants are not the VM's singletons: %#v", bytecode.Constants[:2])
+	}
+	if err := vm.Verify(bytecode); err != nil {
+		t.Fatalf("verifier error: %s", err)
+	}
+	machine := vm.New(bytecode)
+	if err := machine.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if got := machine.LastPoppedStackElem().Inspect(); got != "2" {
+		t.Errorf("wrong result. want=2, got=%s", got)
+	}
+}
+
+func TestAssembleWideOperands(t *testing.T) {
+	bytecode, err := Assemble("main {\n\tOpGetGlobal 70000\n\tOpPop\n}")
+	if err != nil {
+		t.Fatalf("assembler error: %s", err)
+	}
+	expected := append(code.Make(code.OpGetGlobal, 70000), code.Make(code.OpPop)...)
+	if !reflect.DeepEqual([]byte(bytecode.Instructions), expected) {
+		t.Errorf("wrong instructions.\nwant=%s\n got=%s", code.Instructions(expected), bytecode.Instructions)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", "1:1: missing main function"},
+		{"const 1 int 1\nmain {\n}", "1:7: constant 1 defined out of order, want 0"},
+		{"const 0 integer 1\nmain {\n}", "1:9: unknown constant kind integer"},
+		{"main {\n\tOpFoo\n}", "2:2: unknown opcode OpFoo"},
+		{"main {\n\tOpConstant\n}", "2:12: OpConstant expects 1 operands, got end of line"},
+		{"main {\n\tOpJump nowhere\n}", "2:9: undefined label nowhere"},
+		{"main {\nx:\nx:\n}", "3:1: label x defined twice"},
+		{"main {\n\tOpJump 70000\n}", "2:9: operand 0 of OpJump out of range: 70000"},
+		{"main {\n\tOpWide\n}", "2:2: OpWide is implied by operands that do not fit their width"},
+		{"main {\n\tOpPop 1\n}", "2:8: expected end of line, got \"1\""},
+		{"main {\n}\nconst 0 int 1", "3:1: unexpected const after main function"},
+		{`const 0 string "abc`, "1:16: literal not terminated"},
+	}
+
+	for _, tt := range tests {
+		_, err := Assemble(tt.input)
+		if err == nil {
+			t.Fatalf("%q: expected assembler error", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, err.Error())
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package asm
+
+import (
+	"bytes"
+	"fmt"
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Options select the annotations added by DisassembleWith
+type Options struct {
+	// Symbols is the symbol table the bytecode was compiled with, used to
+	// name global variables
+	Symbols *compiler.SymbolTable
+
+	// Source is the program text, whose lines are interleaved with the
+	// instructions they were compiled to
+	Source string
+
+	// Builtins are the builtins the bytecode was compiled with, used to
+	// name them, object.DefaultBuiltins if nil
+	Builtins *object.BuiltinRegistry
+}
+
+// Disassemble prints bytecode in the format read by Assemble, see
+// DisassembleWith
+func Disassemble(bytecode *compiler.Bytecode) (string, error) {
+	return DisassembleWith(bytecode, Options{})
+}
+
+// DisassembleWith prints bytecode in the format read by Assemble. The main
+// function and every function in the constant pool are printed with their
+// instructions prefixed by their offset and their jump targets replaced by
+// labels named after the offset they point to. Comments show the values of
+// constants, the names of variables and builtins, the jumps leading to each
+// label and, if opts has the source, the source lines.
+func DisassembleWith(bytecode *compiler.Bytecode, opts Options) (string, error) {
+	d := &disassembler{constants: bytecode.Constants, builtins: opts.Builtins}
+	if d.builtins == nil {
+		d.builtins = object.DefaultBuiltins()
+	}
+	if opts.Symbols != nil {
+		d.globals = opts.Symbols.DefinedNames()
+	}
+	if opts.Source != "" {
+		d.lines = strings.Split(opts.Source, "\n")
+	}
+
+	for i, c := range bytecode.Constants {
+		fmt.Fprintf(&d.out, "const %d ", i)
+		if err := d.writeValue(c); err != nil {
+			return "", fmt.Errorf("constant %d: %s", i, err)
+		}
+		d.out.WriteString("\n")
+	}
+	d.out.WriteString("main {\n")
+	main := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+		Handlers:     bytecode.Handlers,
+	}
+	if err := d.writeBody(main); err != nil {
+		return "", fmt.Errorf("main: %s", err)
+	}
+	d.out.WriteString("}\n")
+	return d.out.String(), nil
+}
+
+type disassembler struct {
+	out       bytes.Buffer
+	constants []object.Object
+	globals   []string // names of the globals by index
+	builtins  *object.BuiltinRegistry
+	lines     []string // source lines
+}
+
+func (d *disassembler) writeValue(obj object.Object) error {
+	out := &d.out
+	switch obj := obj.(type) {
+	case *object.Integer:
+		fmt.Fprintf(out, "int %d", obj.Value)
+	case *object.Float:
+		fmt.Fprintf(out, "float %s", strconv.FormatFloat(obj.Value, 'g', -1, 64))
+	case *object.String:
+		fmt.Fprintf(out, "string %s", strconv.Quote(obj.Value))
+	case *object.Boolean:
+		fmt.Fprintf(out, "bool %t", obj.Value)
+	case *object.Null:
+		out.WriteString("null")
+	case *object.Array:
+		out.WriteString("array [")
+		for i, el := range obj.Elements {
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			if err := d.writeValue(el); err != nil {
+				return err
+			}
+		}
+		out.WriteString("]")
+	case *object.Hash:
+		// sort the pairs so that equal hashes print the same
+		keys := make([]object.HashKey, 0, len(obj.Pairs))
+		for k := range obj.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Type != keys[j].Type {
+				return keys[i].Type < keys[j].Type
+			}
+			return keys[i].Value < keys[j].Value
+		})
+		out.WriteString("hash {")
+		for i, k := range keys {
+			pair := obj.Pairs[k]
+			if i > 0 {
+				out.WriteString(", ")
+			}
+			if err := d.writeValue(pair.Key); err != nil {
+				return err
+			}
+			out.WriteString(": ")
+			if err := d.writeValue(pair.Value); err != nil {
+				return err
+			}
+		}
+		out.WriteString("}")
+	case *object.CompiledFunction:
+		fmt.Fprintf(out, "function %s params %d locals %d {\n", strconv.Quote(obj.Name), obj.NumParameters, obj.NumLocals)
+		if err := d.writeBody(obj); err != nil {
+			return err
+		}
+		out.WriteString("}")
+	default:
+		return fmt.Errorf("cannot disassemble %s constant", obj.Type())
+	}
+	return nil
+}
+
+// label names the jump target at offset
+func label(offset int) string {
+	return fmt.Sprintf("L%04d", offset)
+}
+
+func (d *disassembler) writeBody(fn *object.CompiledFunction) error {
+	decoded, err := code.Decode(fn.Instructions)
+	if err != nil {
+		return err
+	}
+
+	// jumps maps each label to the offsets of the jumps to it
+	jumps := map[int][]int{}
+	for _, h := range fn.Handlers {
+		jumps[h.Start] = jumps[h.Start]
+		jumps[h.End] = jumps[h.End]
+		jumps[h.Catch] = jumps[h.Catch]
+	}
+	for _, ins := range decoded {
+		if code.IsJump(ins.Op) {
+			jumps[ins.Operands[0]] = append(jumps[ins.Operands[0]], ins.Offset)
+		}
+	}
+
+	for _, h := range fn.Handlers {
+		fmt.Fprintf(&d.out, "\thandler %s %s %s\n", label(h.Start), label(h.End), label(h.Catch))
+	}
+	sm := fn.SourceMap
+	line := 0
+	for _, ins := range decoded {
+		if sources, ok := jumps[ins.Offset]; ok {
+			d.writeLabel(ins.Offset, sources)
+			delete(jumps, ins.Offset)
+		}
+		for len(sm) > 0 && sm[0].Offset <= ins.Offset {
+			if pos := sm[0].Pos; pos.Line != line && pos.Line <= len(d.lines) {
+				line = pos.Line
+				fmt.Fprintf(&d.out, "\t// %d| %s\n", line, strings.TrimSpace(d.lines[line-1]))
+			}
+			sm = sm[1:]
+		}
+
+		text := ins.Def.Name
+		for i, o := range ins.Operands {
+			if i == 0 && code.IsJump(ins.Op) {
+				text += " " + label(o)
+			} else {
+				text += fmt.Sprintf(" %d", o)
+			}
+		}
+		if comment := d.comment(fn, ins); comment != "" {
+			fmt.Fprintf(&d.out, "\t%4d %-24s // %s\n", ins.Offset, text, comment)
+		} else {
+			fmt.Fprintf(&d.out, "\t%4d %s\n", ins.Offset, text)
+		}
+	}
+	if sources, ok := jumps[len(fn.Instructions)]; ok {
+		d.writeLabel(len(fn.Instructions), sources)
+		delete(jumps, len(fn.Instructions))
+	}
+	for offset := range jumps {
+		return fmt.Errorf("jump target %d is not an instruction boundary", offset)
+	}
+	return nil
+}
+
+func (d *disassembler) writeLabel(offset int, sources []int) {
+	if len(sources) == 0 {
+		fmt.Fprintf(&d.out, "%s:\n", label(offset))
+		return
+	}
+	from := make([]string, len(sources))
+	for i, s := range sources {
+		from[i] = strconv.Itoa(s)
+	}
+	fmt.Fprintf(&d.out, "%s: // from %s\n", label(offset), strings.Join(from, ", "))
+}
+
+// comment describes the operands of ins in fn
+func (d *disassembler) comment(fn *object.CompiledFunction, ins code.Instruction) string {
+	if len(ins.Operands) == 0 {
+		return ""
+	}
+	operand := ins.Operands[0]
+	name := func(names []string) string {
+		if operand < len(names) {
+			return names[operand]
+		}
+		return ""
+	}
+
+	switch ins.Op {
+	case code.OpConstant, code.OpClosure:
+		if operand < len(d.constants) {
+			return describe(d.constants[operand])
+		}
+	case code.OpGetGlobal, code.OpSetGlobal:
+		return name(d.globals)
+	case code.OpGetLocal, code.OpSetLocal, code.OpAssignLocal, code.OpCaptureLocal:
+		return name(fn.LocalNames)
+	case code.OpGetFree, code.OpAssignFree, code.OpCaptureFree:
+		return name(fn.FreeNames)
+	case code.OpGetBuiltin:
+		if operand < d.builtins.Len() {
+			return d.builtins.Name(operand)
+		}
+	case code.OpTry:
+		if operand < len(fn.Handlers) {
+			return "catch at " + label(fn.Handlers[operand].Catch)
+		}
+	}
+	return ""
+}
+
+// describe shows a constant in a comment
+func describe(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.String:
+		return strconv.Quote(obj.Value)
+	case *object.CompiledFunction:
+		return "function " + object.FunctionName(obj.Name)
+	}
+	return obj.Inspect()
+}
+
+// opcodes maps the names of the opcodes to their values
+var opcodes = map[string]code.Opcode{}
+
+func init() {
+	for op := 0; op < 256; op++ {
+		if def, err := code.Lookup(byte(op)); err == nil {
+			opcodes[def.Name] = code.Opcode(op)
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"lyz-lang-2nd/token"
+	"sort"
 )
 
 type Instructions []byte
@@ -12,36 +14,62 @@ type Instructions []byte
 type Opcode byte
 
 const (
-	OpConstant       Opcode = iota // 0
-	OpAdd                          // 1
-	OpPop                          // 2
-	OpSub                          // 3
-	OpMul                          // 4
-	OpDiv                          // 5
-	OpTrue                         // 6
-	OpFalse                        // 7
-	OpEqual                        // 8
-	OpNotEqual                     // 9
-	OpGreaterThan                  // 10
-	OpMinus                        // 11
-	OpBang                         // 12
-	OpJumpNotTruthy                // 13
-	OpJump                         // 14
-	OpNull                         // 15
-	OpSetGlobal                    // 16
-	OpGetGlobal                    // 17
-	OpArray                        // 18
-	OpHash                         // 19
-	OpIndex                        // 20
-	OpCall                         // 21
-	OpReturnValue                  // 22
-	OpReturn                       // 23
-	OpSetLocal                     // 24
-	OpGetLocal                     // 25
-	OpGetBuiltin                   // 26
-	OpClosure                      // 27
-	OpGetFree                      // 28
-	OpCurrentClosure               // 29
+	OpConstant           Opcode = iota // 0
+	OpAdd                              // 1
+	OpPop                              // 2
+	OpSub                              // 3
+	OpMul                              // 4
+	OpDiv                              // 5
+	OpTrue                             // 6
+	OpFalse                            // 7
+	OpEqual                            // 8
+	OpNotEqual                         // 9
+	OpGreaterThan                      // 10
+	OpMinus                            // 11
+	OpBang                             // 12
+	OpJumpNotTruthy                    // 13
+	OpJump                             // 14
+	OpNull                             // 15
+	OpSetGlobal                        // 16
+	OpGetGlobal                        // 17
+	OpArray                            // 18
+	OpHash                             // 19
+	OpIndex                            // 20
+	OpCall                             // 21
+	OpReturnValue                      // 22
+	OpReturn                           // 23
+	OpSetLocal                         // 24
+	OpGetLocal                         // 25
+	OpGetBuiltin                       // 26
+	OpClosure                          // 27
+	OpGetFree                          // 28
+	OpCurrentClosure                   // 29
+	OpInterpolate                      // 30
+	OpIter                             // 31
+	OpIterNext                         // 32
+	OpAssignLocal                      // 33
+	OpAssignFree                       // 34
+	OpCaptureLocal                     // 35
+	OpCaptureFree                      // 36
+	OpSetIndex                         // 37
+	OpJumpNotTruthyOrPop               // 38
+	OpJumpTruthyOrPop                  // 39
+	OpLessThan                         // 40
+	OpLessOrEqual                      // 41
+	OpGreaterOrEqual                   // 42
+	OpMod                              // 43
+	OpPow                              // 44
+	OpBitAnd                           // 45
+	OpBitOr                            // 46
+	OpBitXor                           // 47
+	OpShiftLeft                        // 48
+	OpShiftRight                       // 49
+	OpBitNot                           // 50
+	OpTry                              // 51
+	OpEndTry                           // 52
+	OpThrow                            // 53
+	OpWide                             // 54
+	OpCaughtError                      // 55
 )
 
 type Definition struct {
@@ -80,6 +108,72 @@ var definitions = map[Opcode]*Definition{
 	OpClosure:        {"OpClosure", []int{2, 1}},
 	OpGetFree:        {"OpGetFree", []int{1}},
 	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	OpInterpolate:    {"OpInterpolate", []int{2}},
+	OpIter:           {"OpIter", []int{}},
+	OpIterNext:       {"OpIterNext", []int{2}},
+	OpAssignLocal:    {"OpAssignLocal", []int{1}},
+	OpAssignFree:     {"OpAssignFree", []int{1}},
+	OpCaptureLocal:   {"OpCaptureLocal", []int{1}},
+	OpCaptureFree:    {"OpCaptureFree", []int{1}},
+	OpSetIndex:       {"OpSetIndex", []int{}},
+
+	// the short-circuit jumps leave the tested value on the stack when they
+	// jump and pop it otherwise
+	OpJumpNotTruthyOrPop: {"OpJumpNotTruthyOrPop", []int{2}},
+	OpJumpTruthyOrPop:    {"OpJumpTruthyOrPop", []int{2}},
+
+	OpLessThan:       {"OpLessThan", []int{}},
+	OpLessOrEqual:    {"OpLessOrEqual", []int{}},
+	OpGreaterOrEqual: {"OpGreaterOrEqual", []int{}},
+	OpMod:            {"OpMod", []int{}},
+	OpPow:            {"OpPow", []int{}},
+	OpBitAnd:         {"OpBitAnd", []int{}},
+	OpBitOr:          {"OpBitOr", []int{}},
+	OpBitXor:         {"OpBitXor", []int{}},
+	OpShiftLeft:      {"OpShiftLeft", []int{}},
+	OpShiftRight:     {"OpShiftRight", []int{}},
+	OpBitNot:         {"OpBitNot", []int{}},
+	OpTry:            {"OpTry", []int{2}},
+	OpEndTry:         {"OpEndTry", []int{}},
+	OpThrow:          {"OpThrow", []int{}},
+
+	// OpCaughtError replaces the value a handler received by the error it
+	// was thrown with, which a finally block rethrows with its stack trace
+	OpCaughtError: {"OpCaughtError", []int{}},
+
+	// OpWide is a prefix doubling the operand widths of the next instruction
+	OpWide: {"OpWide", []int{}},
+}
+
+// jumps are the opcodes whose first operand is an instruction offset. Their
+// operands are patched in place by the compiler, so they cannot be widened.
+var jumps = map[Opcode]bool{
+	OpJump:               true,
+	OpJumpNotTruthy:      true,
+	OpJumpNotTruthyOrPop: true,
+	OpJumpTruthyOrPop:    true,
+	OpIterNext:           true,
+}
+
+// IsJump reports whether the first operand of op is a jump target
+func IsJump(op Opcode) bool {
+	return jumps[op]
+}
+
+// wideDefinitions holds the definitions of the opcodes that may follow OpWide
+var wideDefinitions = map[Opcode]*Definition{}
+
+func init() {
+	for op, def := range definitions {
+		if len(def.OperandWidths) == 0 || jumps[op] {
+			continue
+		}
+		widths := make([]int, len(def.OperandWidths))
+		for i, w := range def.OperandWidths {
+			widths[i] = 2 * w
+		}
+		wideDefinitions[op] = &Definition{def.Name, widths}
+	}
 }
 
 func Lookup(op byte) (*Definition, error) {
@@ -90,14 +184,77 @@ func Lookup(op byte) (*Definition, error) {
 	return def, nil
 }
 
+// LookupWide returns the definition of op when it is prefixed by OpWide
+func LookupWide(op byte) (*Definition, error) {
+	def, ok := wideDefinitions[Opcode(op)]
+	if !ok {
+		if _, err := Lookup(op); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("opcode %s cannot be widened", definitions[Opcode(op)].Name)
+	}
+	return def, nil
+}
+
+// Make encodes an instruction. It returns an empty instruction when Encode
+// would fail, so it is meant for operands known to be valid.
 func Make(op Opcode, operands ...int) []byte {
+	ins, err := Encode(op, operands...)
+	if err != nil {
+		return []byte{}
+	}
+	return ins
+}
+
+// Encode encodes an instruction, prefixing it with OpWide when an operand
+// does not fit its normal width. Operands that do not fit at all are an error.
+func Encode(op Opcode, operands ...int) ([]byte, error) {
 	def, ok := definitions[op]
 	if !ok {
-		return []byte{}
+		return nil, fmt.Errorf("opcode %d undefined", op)
 	}
+	if len(operands) != len(def.OperandWidths) {
+		return nil, fmt.Errorf("%s expects %d operands, got %d", def.Name, len(def.OperandWidths), len(operands))
+	}
+
+	if fitsWidths(def.OperandWidths, operands) {
+		return encode(op, def.OperandWidths, operands), nil
+	}
+	if wide, ok := wideDefinitions[op]; ok && fitsWidths(wide.OperandWidths, operands) {
+		return append([]byte{byte(OpWide)}, encode(op, wide.OperandWidths, operands)...), nil
+	}
+	for i, o := range operands {
+		if !fitsWidth(maxWidth(op, def.OperandWidths[i]), o) {
+			return nil, fmt.Errorf("operand %d of %s out of range: %d", i, def.Name, o)
+		}
+	}
+	return nil, fmt.Errorf("operands of %s out of range: %v", def.Name, operands)
+}
+
+// maxWidth is the widest encoding available for an operand of op
+func maxWidth(op Opcode, width int) int {
+	if _, ok := wideDefinitions[op]; ok {
+		return 2 * width
+	}
+	return width
+}
 
+func fitsWidths(widths []int, operands []int) bool {
+	for i, o := range operands {
+		if !fitsWidth(widths[i], o) {
+			return false
+		}
+	}
+	return true
+}
+
+func fitsWidth(width int, operand int) bool {
+	return operand >= 0 && uint64(operand) < 1<<(8*uint(width))
+}
+
+func encode(op Opcode, widths []int, operands []int) []byte {
 	instructionLen := 1
-	for _, w := range def.OperandWidths {
+	for _, w := range widths {
 		instructionLen += w
 	}
 
@@ -105,8 +262,10 @@ func Make(op Opcode, operands ...int) []byte {
 	instruction[0] = byte(op)
 	offset := 1
 	for i, o := range operands {
-		w := def.OperandWidths[i]
+		w := widths[i]
 		switch w {
+		case 4:
+			binary.BigEndian.PutUint32(instruction[offset:], uint32(o))
 		case 2:
 			binary.BigEndian.PutUint16(instruction[offset:], uint16(o))
 		case 1:
@@ -123,6 +282,9 @@ func ReadOperands(def *Definition, operands []byte) ([]int, int) {
 	offset := 0
 	for _, w := range def.OperandWidths {
 		switch w {
+		case 4:
+			v := ReadUint32(operands[offset:])
+			r = append(r, int(v))
 		case 2:
 			v := ReadUint16(operands[offset:])
 			r = append(r, int(v))
@@ -136,6 +298,66 @@ func ReadOperands(def *Definition, operands []byte) ([]int, int) {
 	return r, offset
 }
 
+// Instruction is a decoded instruction. An OpWide prefix is folded into the
+// opcode it widens, with Def describing the wide operands.
+type Instruction struct {
+	Offset   int
+	Op       Opcode
+	Def      *Definition
+	Operands []int
+}
+
+// DecodeError reports malformed instructions
+type DecodeError struct {
+	Offset  int
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%04d: %s", e.Offset, e.Message)
+}
+
+// Decode splits ins into instructions, failing with a *DecodeError on an
+// undefined opcode or a truncated instruction
+func Decode(ins Instructions) ([]Instruction, error) {
+	var decoded []Instruction
+	for offset := 0; offset < len(ins); {
+		start := offset
+		def, err := Lookup(ins[offset])
+		if err != nil {
+			return nil, &DecodeError{start, err.Error()}
+		}
+		if Opcode(ins[offset]) == OpWide {
+			offset++
+			if offset == len(ins) {
+				return nil, &DecodeError{start, "OpWide at end of instructions"}
+			}
+			def, err = LookupWide(ins[offset])
+			if err != nil {
+				return nil, &DecodeError{start, err.Error()}
+			}
+		}
+		op := Opcode(ins[offset])
+		offset++
+
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if offset+width > len(ins) {
+			return nil, &DecodeError{start, fmt.Sprintf("truncated %s instruction", def.Name)}
+		}
+		operands, read := ReadOperands(def, ins[offset:])
+		offset += read
+		decoded = append(decoded, Instruction{start, op, def, operands})
+	}
+	return decoded, nil
+}
+
+func ReadUint32(ins Instructions) uint32 {
+	return binary.BigEndian.Uint32(ins)
+}
+
 func ReadUint16(ins Instructions) uint16 {
 	return binary.BigEndian.Uint16(ins)
 }
@@ -150,11 +372,32 @@ func (ins Instructions) String() string {
 	for i < len(ins) {
 		def, err := Lookup(ins[i])
 		if err != nil {
-			fmt.Fprintf(&out, "ERROR: %s\n", err)
+			// skip the byte, so that the rest is still shown
+			fmt.Fprintf(&out, "%04d ERROR: %s\n\t", i, err)
+			i++
 			continue
 		}
+		prefix, start := "", i
+		if Opcode(ins[i]) == OpWide && i+1 < len(ins) {
+			def, err = LookupWide(ins[i+1])
+			if err != nil {
+				fmt.Fprintf(&out, "%04d ERROR: %s\n\t", i, err)
+				i += 2
+				continue
+			}
+			prefix = "OpWide "
+			i++
+		}
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if i+1+width > len(ins) {
+			fmt.Fprintf(&out, "%04d ERROR: truncated %s%s\n\t", start, prefix, def.Name)
+			break
+		}
 		operands, read := ReadOperands(def, ins[i+1:])
-		fmt.Fprintf(&out, "%04d %s\n\t", i, ins.fmtInstruction(def, operands))
+		fmt.Fprintf(&out, "%04d %s%s\n\t", start, prefix, ins.fmtInstruction(def, operands))
 		i += 1 + read
 	}
 	return out.String()
@@ -175,3 +418,31 @@ func (ins Instructions) fmtInstruction(def *Definition, operands []int) string {
 	}
 	return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
 }
+
+// SourcePosition maps the instruction starting at Offset to its source position
+type SourcePosition struct {
+	Offset int
+	Pos    token.Position
+}
+
+// SourceMap is a list of SourcePositions ordered by Offset. An entry covers
+// every instruction up to the next entry.
+type SourceMap []SourcePosition
+
+// Lookup returns the source position of the instruction containing offset
+func (sm SourceMap) Lookup(offset int) (token.Position, bool) {
+	i := sort.Search(len(sm), func(i int) bool { return sm[i].Offset > offset })
+	if i == 0 {
+		return token.Position{}, false
+	}
+	return sm[i-1].Pos, true
+}
+
+// ExceptionHandler describes a try block of a function. OpTry activates the
+// handler for the instructions in [Start, End); an exception raised while it
+// is active unwinds to Catch with the thrown value on the stack.
+type ExceptionHandler struct {
+	Start int
+	End   int
+	Catch int
+}
@@ -1,6 +1,9 @@
 package code
 
-import "testing"
+import (
+	"lyz-lang-2nd/token"
+	"testing"
+)
 
 func TestMake(t *testing.T) {
 	tests := []struct {
@@ -17,6 +20,9 @@ func TestMake(t *testing.T) {
 		{OpJump, []int{112}, []byte{byte(OpJump), 0, 112}},
 		{OpGetLocal, []int{255}, []byte{byte(OpGetLocal), 255}},
 		{OpClosure, []int{65534, 255}, []byte{byte(OpClosure), 255, 254, 255}},
+		{OpGetLocal, []int{256}, []byte{byte(OpWide), byte(OpGetLocal), 1, 0}},
+		{OpConstant, []int{65536}, []byte{byte(OpWide), byte(OpConstant), 0, 1, 0, 0}},
+		{OpClosure, []int{1, 256}, []byte{byte(OpWide), byte(OpClosure), 0, 0, 0, 1, 1, 0}},
 	}
 
 	for _, tt := range tests {
@@ -33,6 +39,45 @@ func TestMake(t *testing.T) {
 	}
 }
 
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		op       Opcode
+		operands []int
+		expected string
+	}{
+		{OpGetLocal, []int{65536}, "operand 0 of OpGetLocal out of range: 65536"},
+		{OpGetLocal, []int{-1}, "operand 0 of OpGetLocal out of range: -1"},
+		{OpJump, []int{65536}, "operand 0 of OpJump out of range: 65536"},
+		{OpClosure, []int{1}, "OpClosure expects 2 operands, got 1"},
+		{Opcode(255), []int{}, "opcode 255 undefined"},
+	}
+
+	for _, tt := range tests {
+		_, err := Encode(tt.op, tt.operands...)
+		if err == nil {
+			t.Fatalf("expected error for %d %v", tt.op, tt.operands)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err.Error())
+		}
+	}
+}
+
+func TestLookupWide(t *testing.T) {
+	def, err := LookupWide(byte(OpClosure))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if def.OperandWidths[0] != 4 || def.OperandWidths[1] != 2 {
+		t.Errorf("wrong wide operand widths: %v", def.OperandWidths)
+	}
+
+	_, err = LookupWide(byte(OpJump))
+	if err == nil || err.Error() != "opcode OpJump cannot be widened" {
+		t.Errorf("wrong error for OpJump: %v", err)
+	}
+}
+
 func TestInstructionsString(t *testing.T) {
 	instructions := []Instructions{
 		Make(OpAdd),
@@ -40,12 +85,14 @@ func TestInstructionsString(t *testing.T) {
 		Make(OpConstant, 2),
 		Make(OpConstant, 65535),
 		Make(OpClosure, 65535, 255),
+		Make(OpGetLocal, 256),
 	}
 	expected := `0000 OpAdd
 	0001 OpGetLocal 1
 	0003 OpConstant 2
 	0006 OpConstant 65535
 	0009 OpClosure 65535 255
+	0013 OpWide OpGetLocal 256
 	`
 	concatted := Instructions{}
 	for _, ins := range instructions {
@@ -56,6 +103,22 @@ func TestInstructionsString(t *testing.T) {
 	}
 }
 
+func TestInstructionsStringInvalid(t *testing.T) {
+	tests := []struct {
+		ins      Instructions
+		expected string
+	}{
+		{Instructions{255, byte(OpAdd)}, "0000 ERROR: opcode 255 undefined\n\t0001 OpAdd\n\t"},
+		{Instructions{byte(OpWide), byte(OpJump), byte(OpAdd)}, "0000 ERROR: opcode OpJump cannot be widened\n\t0002 OpAdd\n\t"},
+		{Instructions{byte(OpAdd), byte(OpConstant), 0}, "0000 OpAdd\n\t0001 ERROR: truncated OpConstant\n\t"},
+	}
+	for _, tt := range tests {
+		if got := tt.ins.String(); got != tt.expected {
+			t.Errorf("instructions wrongly formatted.\nwant=%q\n got=%q", tt.expected, got)
+		}
+	}
+}
+
 func TestReadOperands(t *testing.T) {
 	tests := []struct {
 		op        Opcode
@@ -83,3 +146,34 @@ func TestReadOperands(t *testing.T) {
 		}
 	}
 }
+
+func TestSourceMapLookup(t *testing.T) {
+	sm := SourceMap{
+		{Offset: 0, Pos: token.Position{Line: 1, Column: 1}},
+		{Offset: 3, Pos: token.Position{Line: 2, Column: 5}},
+		{Offset: 7, Pos: token.Position{Line: 3, Column: 2}},
+	}
+	tests := []struct {
+		offset   int
+		expected string
+	}{
+		{0, "1:1"},
+		{2, "1:1"},
+		{3, "2:5"},
+		{6, "2:5"},
+		{100, "3:2"},
+	}
+	for _, tt := range tests {
+		pos, ok := sm.Lookup(tt.offset)
+		if !ok {
+			t.Fatalf("no position for offset %d", tt.offset)
+		}
+		if pos.String() != tt.expected {
+			t.Errorf("wrong position for offset %d. want=%s, got=%s", tt.offset, tt.expected, pos)
+		}
+	}
+
+	if _, ok := (SourceMap{}).Lookup(0); ok {
+		t.Errorf("empty source map returned a position")
+	}
+}
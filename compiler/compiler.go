@@ -5,6 +5,7 @@ import (
 	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/code"
 	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/token"
 	"sort"
 )
 
@@ -12,6 +13,23 @@ type CompilationScope struct {
 	instructions        code.Instructions
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+	sourceMap           code.SourceMap
+	handlers            []code.ExceptionHandler
+	loops               []*loopContext
+	tries               []*tryContext
+}
+
+// loopContext collects the jumps of a loop being compiled
+type loopContext struct {
+	continueTarget int   // position continue jumps back to
+	breaks         []int // positions of the OpJumps to patch with the loop exit
+	tryDepth       int   // number of enclosing tries when the loop started
+}
+
+// tryContext is an active exception handler whose finally block, if any, has
+// to run when control leaves it by break, continue or return
+type tryContext struct {
+	finally *ast.BlockStatement
 }
 
 type EmittedInstruction struct {
@@ -24,14 +42,39 @@ type Compiler struct {
 	symbolTable *SymbolTable
 	scopes      []CompilationScope
 	scopeIndex  int
+	pos         token.Position // position of the node being compiled
+	err         error          // first instruction that could not be encoded
 }
 
 type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
+	SourceMap    code.SourceMap
+	Handlers     []code.ExceptionHandler
+}
+
+// HasResult reports whether the program ends with an expression statement,
+// whose value is the last one the VM pops. Only expression statements end
+// with an OpPop, see compileTryStatement.
+func (b *Bytecode) HasResult() bool {
+	ins, err := code.Decode(b.Instructions)
+	return err == nil && len(ins) > 0 && ins[len(ins)-1].Op == code.OpPop
+}
+
+// Options configure a Compiler created by NewWithOptions
+type Options struct {
+	// Builtins are the builtins the program can call, object.DefaultBuiltins
+	// if nil. The VM running the program needs the same registry.
+	Builtins *object.BuiltinRegistry
 }
 
 func New() *Compiler {
+	return NewWithOptions(Options{})
+}
+
+// NewWithOptions creates a compiler whose symbol table defines the builtins
+// of opts
+func NewWithOptions(opts Options) *Compiler {
 	mainScope := CompilationScope{
 		instructions:        code.Instructions{},
 		lastInstruction:     EmittedInstruction{},
@@ -39,9 +82,7 @@ func New() *Compiler {
 	}
 
 	st := NewSymbolTable()
-	for i, b := range object.Builtins {
-		st.DefineBuiltin(i, b.Name)
-	}
+	st.DefineBuiltins(opts.Builtins)
 
 	return &Compiler{
 		constants:   []object.Object{},
@@ -62,10 +103,26 @@ func (c *Compiler) Bytecode() *Bytecode {
 	return &Bytecode{
 		Instructions: c.currentInstructions(),
 		Constants:    c.constants,
+		SourceMap:    c.scopes[c.scopeIndex].sourceMap,
+		Handlers:     c.scopes[c.scopeIndex].handlers,
 	}
 }
 
-func (c *Compiler) Compile(node ast.Node) error {
+func (c *Compiler) Compile(node ast.Node) (err error) {
+	if node == nil {
+		return nil
+	}
+	outerPos := c.pos
+	if pos := node.Pos(); pos.IsValid() {
+		c.pos = pos
+	}
+	defer func() {
+		c.pos = outerPos
+		if err == nil {
+			err = c.err
+		}
+	}()
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -81,18 +138,8 @@ func (c *Compiler) Compile(node ast.Node) error {
 		}
 		c.emit(code.OpPop)
 	case *ast.InfixExpression:
-		// reorder code for operator "<" to ">"
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogicalExpression(node)
 		}
 
 		err := c.Compile(node.Left)
@@ -103,27 +150,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
-		switch node.Operator {
-		case "+":
-			c.emit(code.OpAdd)
-		case "-":
-			c.emit(code.OpSub)
-		case "*":
-			c.emit(code.OpMul)
-		case "/":
-			c.emit(code.OpDiv)
-		case ">":
-			c.emit(code.OpGreaterThan)
-		case "==":
-			c.emit(code.OpEqual)
-		case "!=":
-			c.emit(code.OpNotEqual)
-		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+		op, ok := infixOpcodes[node.Operator]
+		if !ok {
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
+		c.emit(op)
 	case *ast.IntegerLiteral:
 		integer := &object.Integer{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(integer))
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -140,8 +177,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMinus)
 		case "!":
 			c.emit(code.OpBang)
+		case "~":
+			c.emit(code.OpBitNot)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 	case *ast.IfExpression:
 		err := c.Compile(node.Condition)
@@ -153,9 +192,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
-		if c.lastInstructionIs(code.OpPop) {
-			c.removeLastPop()
-		}
+		c.keepBlockValue()
 
 		jumpPos := c.emit(code.OpJump, 9999)
 
@@ -169,9 +206,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 			if err != nil {
 				return err
 			}
-			if c.lastInstructionIs(code.OpPop) {
-				c.removeLastPop()
-			}
+			c.keepBlockValue()
 		}
 		afterAlternativePos := len(c.currentInstructions())
 		c.changeOperand(jumpPos, afterAlternativePos)
@@ -188,20 +223,100 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if err != nil {
 			return err
 		}
-		if symbol.Scope == LocalScope {
-			c.emit(code.OpSetLocal, symbol.Index)
-		} else {
-			c.emit(code.OpSetGlobal, symbol.Index)
+		c.storeSymbol(symbol)
+	case *ast.AssignStatement:
+		return c.compileAssignment(node)
+	case *ast.WhileStatement:
+		loopStart := len(c.currentInstructions())
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+		exitJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		breaks, err := c.compileLoopBody(node.Body, loopStart)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStart)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterLoopPos)
+		for _, pos := range breaks {
+			c.changeOperand(pos, afterLoopPos)
+		}
+	case *ast.ForStatement:
+		err := c.Compile(node.Iterable)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpIter)
+		iterator := c.symbolTable.Define("$iterator")
+		c.storeSymbol(iterator)
+
+		loopStart := len(c.currentInstructions())
+		c.loadSymbol(iterator)
+		exitJumpPos := c.emit(code.OpIterNext, 9999)
+		// every iteration assigns the same variable, also when a closure
+		// captured it, as globals and the evaluator's variables are shared
+		c.assignSymbol(c.symbolTable.Define(node.Variable.Value))
+
+		breaks, err := c.compileLoopBody(node.Body, loopStart)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loopStart)
+
+		afterLoopPos := len(c.currentInstructions())
+		c.changeOperand(exitJumpPos, afterLoopPos)
+		for _, pos := range breaks {
+			c.changeOperand(pos, afterLoopPos)
 		}
+	case *ast.BreakStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: break outside loop", node.Pos())
+		}
+		err := c.exitTries(loop.tryDepth)
+		if err != nil {
+			return err
+		}
+		loop.breaks = append(loop.breaks, c.emit(code.OpJump, 9999))
+	case *ast.ContinueStatement:
+		loop := c.currentLoop()
+		if loop == nil {
+			return fmt.Errorf("%s: continue outside loop", node.Pos())
+		}
+		err := c.exitTries(loop.tryDepth)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, loop.continueTarget)
+	case *ast.TryStatement:
+		return c.compileTryStatement(node)
+	case *ast.ThrowStatement:
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpThrow)
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
-			return fmt.Errorf("variable %s was not defined", node.Value)
+			return fmt.Errorf("%s: variable %s was not defined", node.Pos(), node.Value)
 		}
 		c.loadSymbol(symbol)
 	case *ast.StringLiteral:
 		s := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(s))
+	case *ast.InterpolatedString:
+		for _, part := range node.Parts {
+			err := c.Compile(part)
+			if err != nil {
+				return err
+			}
+		}
+		c.emit(code.OpInterpolate, len(node.Parts))
 	case *ast.ArrayLiteral:
 		for _, elem := range node.Elements {
 			err := c.Compile(elem)
@@ -263,19 +378,37 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
+		localNames := c.symbolTable.DefinedNames()
+		sourceMap := c.scopes[c.scopeIndex].sourceMap
+		handlers := c.scopes[c.scopeIndex].handlers
 		instructions := c.leaveScope()
 
 		for _, s := range freeSymbols {
-			c.loadSymbol(s)
+			c.captureSymbol(s)
 		}
 
-		compiledFn := &object.CompiledFunction{Instructions: instructions, NumLocals: numLocals, NumParameters: len(node.Parameters)}
+		compiledFn := &object.CompiledFunction{
+			Instructions:  instructions,
+			NumLocals:     numLocals,
+			NumParameters: len(node.Parameters),
+			Name:          node.Name,
+			SourceMap:     sourceMap,
+			Handlers:      handlers,
+			LocalNames:    localNames,
+		}
+		for _, s := range freeSymbols {
+			compiledFn.FreeNames = append(compiledFn.FreeNames, s.Name)
+		}
 		c.emit(code.OpClosure, c.addConstant(compiledFn), len(freeSymbols))
 	case *ast.ReturnStatement:
 		err := c.Compile(node.ReturnValue)
 		if err != nil {
 			return err
 		}
+		err = c.exitTries(0)
+		if err != nil {
+			return err
+		}
 		c.emit(code.OpReturnValue)
 	case *ast.CallExpression:
 		err := c.Compile(node.Function)
@@ -294,6 +427,250 @@ func (c *Compiler) Compile(node ast.Node) error {
 	return nil
 }
 
+// compileLogicalExpression compiles "&&" and "||" so the right operand is
+// only evaluated when the left one does not decide the result. The value of
+// the expression is whichever operand was evaluated last.
+func (c *Compiler) compileLogicalExpression(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jump := code.OpJumpNotTruthyOrPop
+	if node.Operator == "||" {
+		jump = code.OpJumpTruthyOrPop
+	}
+	jumpPos := c.emit(jump, 9999)
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+	c.changeOperand(jumpPos, len(c.currentInstructions()))
+	return nil
+}
+
+var infixOpcodes = map[string]code.Opcode{
+	"+":  code.OpAdd,
+	"-":  code.OpSub,
+	"*":  code.OpMul,
+	"/":  code.OpDiv,
+	"%":  code.OpMod,
+	"**": code.OpPow,
+	"&":  code.OpBitAnd,
+	"|":  code.OpBitOr,
+	"^":  code.OpBitXor,
+	"<<": code.OpShiftLeft,
+	">>": code.OpShiftRight,
+	"==": code.OpEqual,
+	"!=": code.OpNotEqual,
+	">":  code.OpGreaterThan,
+	"<":  code.OpLessThan,
+	">=": code.OpGreaterOrEqual,
+	"<=": code.OpLessOrEqual,
+}
+
+var compoundAssignmentOpcodes = map[string]code.Opcode{
+	"+=": code.OpAdd,
+	"-=": code.OpSub,
+	"*=": code.OpMul,
+	"/=": code.OpDiv,
+}
+
+func (c *Compiler) compileAssignment(node *ast.AssignStatement) error {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		symbol, ok := c.symbolTable.Resolve(target.Value)
+		if !ok {
+			return fmt.Errorf("%s: variable %s was not defined", target.Pos(), target.Value)
+		}
+		switch symbol.Scope {
+		case BuiltinScope:
+			return fmt.Errorf("%s: cannot assign to builtin %s", target.Pos(), target.Value)
+		case FunctionScope:
+			return fmt.Errorf("%s: cannot assign to function %s inside its own body", target.Pos(), target.Value)
+		}
+
+		if node.Operator != "=" {
+			c.loadSymbol(symbol)
+		}
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		if node.Operator != "=" {
+			op, ok := compoundAssignmentOpcodes[node.Operator]
+			if !ok {
+				return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
+			}
+			c.emit(op)
+		}
+		c.assignSymbol(symbol)
+	case *ast.IndexExpression:
+		if node.Operator != "=" {
+			return fmt.Errorf("%s: operator %s not supported on index expressions", node.Pos(), node.Operator)
+		}
+		err := c.Compile(target.Left)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(target.Index)
+		if err != nil {
+			return err
+		}
+		err = c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpSetIndex)
+	default:
+		return fmt.Errorf("%s: cannot assign to %s", node.Pos(), node.Target.String())
+	}
+	return nil
+}
+
+// compileTryStatement lays out a try statement as
+//
+//	OpTry h; <block>; OpEndTry; <finally>; OpJump end
+//	catch: <store e>; OpTry h2; <catch>; OpEndTry; <finally>; OpJump end
+//	rethrow: OpCaughtError; <store exception>; <finally>; <load exception>; OpThrow
+//	end:
+//
+// where the second handler and the rethrow path only exist with a finally
+// block, which is compiled once for every way of leaving the statement.
+func (c *Compiler) compileTryStatement(node *ast.TryStatement) error {
+	exits := []int{}
+
+	catchHandler, err := c.compileProtected(node.Block, node.Finally)
+	if err != nil {
+		return err
+	}
+	exits = append(exits, c.emit(code.OpJump, 9999))
+	c.setHandlerCatch(catchHandler)
+
+	if node.Catch != nil {
+		c.storeSymbol(c.symbolTable.Define(node.CatchParam.Value))
+		if node.Finally == nil {
+			err := c.Compile(node.Catch)
+			if err != nil {
+				return err
+			}
+			// keeps the catch block's last OpPop from being mistaken for
+			// the value of an enclosing block
+			exits = append(exits, c.emit(code.OpJump, 9999))
+		} else {
+			rethrowHandler, err := c.compileProtected(node.Catch, node.Finally)
+			if err != nil {
+				return err
+			}
+			exits = append(exits, c.emit(code.OpJump, 9999))
+			c.setHandlerCatch(rethrowHandler)
+		}
+	}
+
+	if node.Finally != nil {
+		exception := c.symbolTable.Define("$exception")
+		c.emit(code.OpCaughtError)
+		c.storeSymbol(exception)
+		err := c.Compile(node.Finally)
+		if err != nil {
+			return err
+		}
+		c.loadSymbol(exception)
+		c.emit(code.OpThrow)
+	}
+
+	end := len(c.currentInstructions())
+	for _, pos := range exits {
+		c.changeOperand(pos, end)
+	}
+	return nil
+}
+
+// compileProtected compiles block under a new exception handler followed by
+// finally, and returns the index of the handler
+func (c *Compiler) compileProtected(block, finally *ast.BlockStatement) (int, error) {
+	scope := &c.scopes[c.scopeIndex]
+	index := len(scope.handlers)
+	scope.handlers = append(scope.handlers, code.ExceptionHandler{})
+	start := c.emit(code.OpTry, index)
+
+	scope.tries = append(scope.tries, &tryContext{finally: finally})
+	err := c.Compile(block)
+	scope = &c.scopes[c.scopeIndex]
+	scope.tries = scope.tries[:len(scope.tries)-1]
+	if err != nil {
+		return 0, err
+	}
+
+	c.emit(code.OpEndTry)
+	scope.handlers[index].Start = start
+	scope.handlers[index].End = len(scope.instructions)
+
+	if finally != nil {
+		err = c.Compile(finally)
+	}
+	return index, err
+}
+
+func (c *Compiler) setHandlerCatch(index int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.handlers[index].Catch = len(scope.instructions)
+}
+
+// exitTries deactivates the handlers entered after the first depth tries of
+// the current scope and runs their finally blocks, innermost first
+func (c *Compiler) exitTries(depth int) error {
+	tries := c.scopes[c.scopeIndex].tries
+	for i := len(tries) - 1; i >= depth; i-- {
+		c.emit(code.OpEndTry)
+		if tries[i].finally == nil {
+			continue
+		}
+		// the finally block runs outside the try it belongs to
+		c.scopes[c.scopeIndex].tries = append([]*tryContext{}, tries[:i]...)
+		err := c.Compile(tries[i].finally)
+		c.scopes[c.scopeIndex].tries = tries
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compileLoopBody compiles the body of a loop whose continue statements jump
+// to continueTarget, and returns the positions of its break jumps
+func (c *Compiler) compileLoopBody(body *ast.BlockStatement, continueTarget int) ([]int, error) {
+	scope := &c.scopes[c.scopeIndex]
+	loop := &loopContext{continueTarget: continueTarget, tryDepth: len(scope.tries)}
+	scope.loops = append(scope.loops, loop)
+
+	err := c.Compile(body)
+
+	scope = &c.scopes[c.scopeIndex]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+	return loop.breaks, err
+}
+
+func (c *Compiler) currentLoop() *loopContext {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// keepBlockValue leaves the value of the block just compiled on the stack:
+// the value of its last expression statement, or null if it ends with
+// another statement
+func (c *Compiler) keepBlockValue() {
+	if c.lastInstructionIs(code.OpPop) {
+		c.removeLastPop()
+	} else {
+		c.emit(code.OpNull)
+	}
+}
+
 func (c *Compiler) replaceLastPopWithReturn() {
 	pos := c.currentLastInstructions().Position
 	c.replaceInstruction(pos, code.Make(code.OpReturnValue))
@@ -306,12 +683,32 @@ func (c *Compiler) addConstant(obj object.Object) int {
 }
 
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
-	ins := code.Make(op, operands...)
+	ins, err := code.Encode(op, operands...)
+	if err != nil {
+		c.setError(err)
+	}
+	if (op == code.OpSetGlobal || op == code.OpGetGlobal) && operands[0] >= MaxGlobals {
+		c.setError(fmt.Errorf("global index out of range: %d, at most %d globals", operands[0], MaxGlobals))
+	}
 	pos := c.addInstruction(ins)
 	c.setLastInstruction(op, pos)
+	c.addSourcePosition(pos)
 	return pos
 }
 
+// addSourcePosition records the current node position for the instruction at
+// offset, unless the previous entry already carries the same position
+func (c *Compiler) addSourcePosition(offset int) {
+	if !c.pos.IsValid() {
+		return
+	}
+	sm := c.scopes[c.scopeIndex].sourceMap
+	if len(sm) > 0 && sm[len(sm)-1].Pos == c.pos {
+		return
+	}
+	c.scopes[c.scopeIndex].sourceMap = append(sm, code.SourcePosition{Offset: offset, Pos: c.pos})
+}
+
 func (c *Compiler) addInstruction(ins []byte) int {
 	posNewInstruction := len(c.currentInstructions())
 	updatedInstruction := append(c.currentInstructions(), ins...)
@@ -335,8 +732,15 @@ func (c *Compiler) lastInstructionIs(op code.Opcode) bool {
 }
 
 func (c *Compiler) removeLastPop() {
-	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:c.currentLastInstructions().Position]
+	last := c.currentLastInstructions().Position
+	c.scopes[c.scopeIndex].instructions = c.currentInstructions()[:last]
 	c.scopes[c.scopeIndex].lastInstruction = c.currentPreviousInstructions()
+
+	sm := c.scopes[c.scopeIndex].sourceMap
+	for len(sm) > 0 && sm[len(sm)-1].Offset >= last {
+		sm = sm[:len(sm)-1]
+	}
+	c.scopes[c.scopeIndex].sourceMap = sm
 }
 
 func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
@@ -348,10 +752,22 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 
 func (c *Compiler) changeOperand(pos int, operand int) {
 	op := code.Opcode(c.currentInstructions()[pos])
-	newInstruction := code.Make(op, operand)
+	newInstruction, err := code.Encode(op, operand)
+	if err != nil {
+		c.setError(err)
+		return
+	}
 	c.replaceInstruction(pos, newInstruction)
 }
 
+// setError records an instruction that could not be encoded. Compile reports
+// the first such error instead of returning corrupted bytecode.
+func (c *Compiler) setError(err error) {
+	if c.err == nil {
+		c.err = fmt.Errorf("%s: %s", c.pos, err)
+	}
+}
+
 func (c *Compiler) enterScope() {
 	scope := CompilationScope{
 		instructions:        code.Instructions{},
@@ -384,6 +800,40 @@ func (c *Compiler) currentPreviousInstructions() EmittedInstruction {
 	return c.scopes[c.scopeIndex].previousInstruction
 }
 
+func (c *Compiler) storeSymbol(s Symbol) {
+	if s.Scope == LocalScope {
+		c.emit(code.OpSetLocal, s.Index)
+	} else {
+		c.emit(code.OpSetGlobal, s.Index)
+	}
+}
+
+// assignSymbol stores the top of the stack into an existing variable. Unlike
+// storeSymbol it writes through the cell of a captured local.
+func (c *Compiler) assignSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		c.emit(code.OpAssignLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpAssignFree, s.Index)
+	}
+}
+
+// captureSymbol pushes the variable s for an OpClosure, boxing locals in a
+// cell so the closure shares them with the enclosing function
+func (c *Compiler) captureSymbol(s Symbol) {
+	switch s.Scope {
+	case LocalScope:
+		c.emit(code.OpCaptureLocal, s.Index)
+	case FreeScope:
+		c.emit(code.OpCaptureFree, s.Index)
+	default:
+		c.loadSymbol(s)
+	}
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
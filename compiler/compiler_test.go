@@ -1,12 +1,16 @@
 package compiler
 
 import (
+	"bytes"
 	"fmt"
 	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/internal/lyztest"
 	"lyz-lang-2nd/lexer"
 	"lyz-lang-2nd/object"
 	"lyz-lang-2nd/parser"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -78,6 +82,11 @@ func testConstants(t *testing.T, expected []interface{}, actual []object.Object)
 			if err != nil {
 				return fmt.Errorf("constant %d - testIntegerObject failed: %s", i, err)
 			}
+		case float64:
+			err := testFloatObject(constant, actual[i])
+			if err != nil {
+				return fmt.Errorf("constant %d - testFloatObject failed: %s", i, err)
+			}
 		case string:
 			err := testStringObject(constant, actual[i])
 			if err != nil {
@@ -108,6 +117,17 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	result, ok := actual.(*object.String)
 	if !ok {
@@ -170,7 +190,112 @@ func TestIntegerArithmetic(t *testing.T) {
 				code.Make(code.OpPop),
 			},
 		},
+		{
+			input:             "1 % 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMod),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 ** 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpPow),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 & 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitAnd),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 | 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitOr),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 ^ 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpBitXor),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 << 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftLeft),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 >> 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpShiftRight),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "~1",
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpBitNot),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+	runCompilerTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             "1.5 * 2",
+			expectedConstants: []interface{}{1.5, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpMul),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "-2.5e-1",
+			expectedConstants: []interface{}{0.25},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpMinus),
+				code.Make(code.OpPop),
+			},
+		},
 	}
+
 	runCompilerTests(t, tests)
 }
 
@@ -204,11 +329,31 @@ func TestBooleanExpressions(t *testing.T) {
 		},
 		{
 			input:             "1 < 2",
-			expectedConstants: []interface{}{2, 1},
+			expectedConstants: []interface{}{1, 2},
 			expectedInstructions: []code.Instructions{
 				code.Make(code.OpConstant, 0),
 				code.Make(code.OpConstant, 1),
-				code.Make(code.OpGreaterThan),
+				code.Make(code.OpLessThan),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 <= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpLessOrEqual),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             "1 >= 2",
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpGreaterOrEqual),
 				code.Make(code.OpPop),
 			},
 		},
@@ -265,6 +410,45 @@ func TestBooleanExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLogicalOperators(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `true && false`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthyOrPop, 5),
+				// 0004
+				code.Make(code.OpFalse),
+				// 0005
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `1 || 2 && 3`,
+			expectedConstants: []interface{}{1, 2, 3},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpJumpTruthyOrPop, 15),
+				// 0006
+				code.Make(code.OpConstant, 1),
+				// 0009
+				code.Make(code.OpJumpNotTruthyOrPop, 15),
+				// 0012
+				code.Make(code.OpConstant, 2),
+				// 0015
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -319,6 +503,329 @@ func TestConditionals(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestLoops(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `while (true) { 1; break; continue; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 17),
+				// 0004
+				code.Make(code.OpConstant, 0),
+				// 0007
+				code.Make(code.OpPop),
+				// 0008
+				code.Make(code.OpJump, 17),
+				// 0011
+				code.Make(code.OpJump, 0),
+				// 0014
+				code.Make(code.OpJump, 0),
+			},
+		},
+		{
+			input:             `for (x in [1]) { x; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpConstant, 0),
+				// 0003
+				code.Make(code.OpArray, 1),
+				// 0006
+				code.Make(code.OpIter),
+				// 0007
+				code.Make(code.OpSetGlobal, 0),
+				// 0010
+				code.Make(code.OpGetGlobal, 0),
+				// 0013
+				code.Make(code.OpIterNext, 26),
+				// 0016
+				code.Make(code.OpSetGlobal, 1),
+				// 0019
+				code.Make(code.OpGetGlobal, 1),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpJump, 10),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `let x = 1; x += 2;`,
+			expectedConstants: []interface{}{1, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpSetGlobal, 0),
+			},
+		},
+		{
+			input:             `let a = [1]; a[0] = 2;`,
+			expectedConstants: []interface{}{1, 0, 2},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpArray, 1),
+				code.Make(code.OpSetGlobal, 0),
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpSetIndex),
+			},
+		},
+		{
+			input: `fn() { let x = 1; let f = fn() { x = x * 2; }; x -= 1; }`,
+			expectedConstants: []interface{}{
+				1,
+				2,
+				[]code.Instructions{
+					code.Make(code.OpGetFree, 0),
+					code.Make(code.OpConstant, 1),
+					code.Make(code.OpMul),
+					code.Make(code.OpAssignFree, 0),
+					code.Make(code.OpReturn),
+				},
+				1,
+				[]code.Instructions{
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpSetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
+					code.Make(code.OpClosure, 2, 1),
+					code.Make(code.OpSetLocal, 1),
+					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpConstant, 3),
+					code.Make(code.OpSub),
+					code.Make(code.OpAssignLocal, 0),
+					code.Make(code.OpReturn),
+				},
+			},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpClosure, 4, 0),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`x = 1;`, "1:1: variable x was not defined"},
+		{`len = 1;`, "1:1: cannot assign to builtin len"},
+		{`let f = fn() { f = 1; };`, "1:16: cannot assign to function f inside its own body"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		err := New().Compile(program)
+		if err == nil {
+			t.Fatalf("%q: expected compiler error", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	program := parse(lyztest.WideCall(300))
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	call := code.Make(code.OpCall, 300)
+	if !bytes.Contains(bytecode.Instructions, call) {
+		t.Errorf("main instructions do not contain %q:\n%s", code.Instructions(call), bytecode.Instructions)
+	}
+	fn, ok := bytecode.Constants[0].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 0 is not a function. got=%T", bytecode.Constants[0])
+	}
+	for _, ins := range [][]byte{code.Make(code.OpSetLocal, 599), code.Make(code.OpGetLocal, 599)} {
+		if !bytes.Contains(fn.Instructions, ins) {
+			t.Errorf("function instructions do not contain %q", code.Instructions(ins))
+		}
+	}
+}
+
+func TestInstructionLimits(t *testing.T) {
+	input := "if (true) { " + strings.Repeat("1; ", 20000) + "}"
+
+	program := parse(input)
+	err := New().Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error")
+	}
+	expected := "1:1: operand 0 of OpJumpNotTruthy out of range: 80006"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err.Error())
+	}
+}
+
+func TestGlobalsLimit(t *testing.T) {
+	symbols := NewSymbolTable()
+	for i := 0; i < MaxGlobals; i++ {
+		symbols.Define("g" + lyztest.Name(i))
+	}
+
+	err := NewWithState(symbols, []object.Object{}).Compile(parse("ga = 1;\nlet extra = 2;"))
+	if err == nil {
+		t.Fatalf("expected compiler error")
+	}
+	expected := "2:1: global index out of range: 65536, at most 65536 globals"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err.Error())
+	}
+}
+
+func TestTryStatements(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `try { throw 1; } catch (e) { e; }`,
+			expectedConstants: []interface{}{1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 0),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpThrow),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpJump, 21),
+				// 0011
+				code.Make(code.OpSetGlobal, 0),
+				// 0014
+				code.Make(code.OpGetGlobal, 0),
+				// 0017
+				code.Make(code.OpPop),
+				// 0018
+				code.Make(code.OpJump, 21),
+			},
+		},
+		{
+			input:             `try { 1; } finally { 2; }`,
+			expectedConstants: []interface{}{1, 2, 2},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTry, 0),
+				// 0003
+				code.Make(code.OpConstant, 0),
+				// 0006
+				code.Make(code.OpPop),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpConstant, 1),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpJump, 27),
+				// 0015
+				code.Make(code.OpCaughtError),
+				// 0016
+				code.Make(code.OpSetGlobal, 0),
+				// 0019
+				code.Make(code.OpConstant, 2),
+				// 0022
+				code.Make(code.OpPop),
+				// 0023
+				code.Make(code.OpGetGlobal, 0),
+				// 0026
+				code.Make(code.OpThrow),
+			},
+		},
+		{
+			input:             `while (true) { try { break; } finally { 1; } }`,
+			expectedConstants: []interface{}{1, 1, 1},
+			expectedInstructions: []code.Instructions{
+				// 0000
+				code.Make(code.OpTrue),
+				// 0001
+				code.Make(code.OpJumpNotTruthy, 38),
+				// 0004
+				code.Make(code.OpTry, 0),
+				// 0007
+				code.Make(code.OpEndTry),
+				// 0008
+				code.Make(code.OpConstant, 0),
+				// 0011
+				code.Make(code.OpPop),
+				// 0012
+				code.Make(code.OpJump, 38),
+				// 0015
+				code.Make(code.OpEndTry),
+				// 0016
+				code.Make(code.OpConstant, 1),
+				// 0019
+				code.Make(code.OpPop),
+				// 0020
+				code.Make(code.OpJump, 35),
+				// 0023
+				code.Make(code.OpCaughtError),
+				// 0024
+				code.Make(code.OpSetGlobal, 0),
+				// 0027
+				code.Make(code.OpConstant, 2),
+				// 0030
+				code.Make(code.OpPop),
+				// 0031
+				code.Make(code.OpGetGlobal, 0),
+				// 0034
+				code.Make(code.OpThrow),
+				// 0035
+				code.Make(code.OpJump, 0),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
+func TestExceptionHandlers(t *testing.T) {
+	program := parse(`fn() { try { 1; } catch (e) { 2; } finally { 3; } }`)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	fn, ok := compiler.Bytecode().Constants[len(compiler.Bytecode().Constants)-1].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("last constant is not a CompiledFunction")
+	}
+	expected := []code.ExceptionHandler{
+		{Start: 0, End: 8, Catch: 15},
+		{Start: 17, End: 25, Catch: 32},
+	}
+	if len(fn.Handlers) != len(expected) {
+		t.Fatalf("wrong number of handlers. want=%d, got=%d (%+v)", len(expected), len(fn.Handlers), fn.Handlers)
+	}
+	for i, h := range expected {
+		if fn.Handlers[i] != h {
+			t.Errorf("handlers[%d] wrong. want=%+v, got=%+v", i, h, fn.Handlers[i])
+		}
+	}
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -391,6 +898,35 @@ func TestStringExpressions(t *testing.T) {
 	runCompilerTests(t, tests)
 }
 
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []compilerTestCase{
+		{
+			input:             `"a ${1 + 2} b"`,
+			expectedConstants: []interface{}{"a ", 1, 2, " b"},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpConstant, 1),
+				code.Make(code.OpConstant, 2),
+				code.Make(code.OpAdd),
+				code.Make(code.OpConstant, 3),
+				code.Make(code.OpInterpolate, 3),
+				code.Make(code.OpPop),
+			},
+		},
+		{
+			input:             `"${true}"`,
+			expectedConstants: []interface{}{},
+			expectedInstructions: []code.Instructions{
+				code.Make(code.OpTrue),
+				code.Make(code.OpInterpolate, 1),
+				code.Make(code.OpPop),
+			},
+		},
+	}
+
+	runCompilerTests(t, tests)
+}
+
 func TestArrayLiterals(t *testing.T) {
 	tests := []compilerTestCase{
 		{
@@ -631,7 +1167,7 @@ func TestFunctionsWithoutReturnValue(t *testing.T) {
 				},
 			},
 			expectedInstructions: []code.Instructions{
-				code.Make(code.OpClosure, 0),
+				code.Make(code.OpClosure, 0, 0),
 				code.Make(code.OpPop),
 			},
 		},
@@ -887,7 +1423,7 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -917,13 +1453,13 @@ func TestClosures(t *testing.T) {
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 0, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 1, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -967,15 +1503,15 @@ func TestClosures(t *testing.T) {
 				[]code.Instructions{
 					code.Make(code.OpConstant, 2),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetFree, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureFree, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 4, 2),
 					code.Make(code.OpReturnValue),
 				},
 				[]code.Instructions{
 					code.Make(code.OpConstant, 1),
 					code.Make(code.OpSetLocal, 0),
-					code.Make(code.OpGetLocal, 0),
+					code.Make(code.OpCaptureLocal, 0),
 					code.Make(code.OpClosure, 5, 1),
 					code.Make(code.OpReturnValue),
 				},
@@ -1058,3 +1594,57 @@ func TestRecursiveFunctions(t *testing.T) {
 	}
 	runCompilerTests(t, tests)
 }
+
+func TestCompilerErrorPositions(t *testing.T) {
+	program := parse("let a = 1;\nlet b = a + c;")
+	compiler := New()
+	err := compiler.Compile(program)
+	if err == nil {
+		t.Fatalf("expected compiler error but resulted in none")
+	}
+	expected := "2:13: variable c was not defined"
+	if err.Error() != expected {
+		t.Errorf("wrong compiler error. want=%q, got=%q", expected, err)
+	}
+}
+
+func TestSourceMap(t *testing.T) {
+	program := parse("1;\nfn() {\n  2 }")
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := compiler.Bytecode()
+
+	// OpClosure of the function literal sits at offset 4
+	pos, ok := bytecode.SourceMap.Lookup(4)
+	if !ok || pos.String() != "2:1" {
+		t.Errorf("wrong position for OpClosure. got=%s", pos)
+	}
+
+	fn := bytecode.Constants[2].(*object.CompiledFunction)
+	pos, ok = fn.SourceMap.Lookup(0)
+	if !ok || pos.String() != "3:3" {
+		t.Errorf("wrong position inside function. got=%s", pos)
+	}
+}
+
+func TestVariableNames(t *testing.T) {
+	program := parse(`fn(a, b) { let c = a; fn(d) { a + c + d } }`)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	constants := compiler.Bytecode().Constants
+
+	inner := constants[0].(*object.CompiledFunction)
+	if !reflect.DeepEqual(inner.LocalNames, []string{"d"}) || !reflect.DeepEqual(inner.FreeNames, []string{"a", "c"}) {
+		t.Errorf("wrong names for inner function. locals=%v, free=%v", inner.LocalNames, inner.FreeNames)
+	}
+	outer := constants[1].(*object.CompiledFunction)
+	if !reflect.DeepEqual(outer.LocalNames, []string{"a", "b", "c"}) || outer.FreeNames != nil {
+		t.Errorf("wrong names for outer function. locals=%v, free=%v", outer.LocalNames, outer.FreeNames)
+	}
+}
@@ -0,0 +1,622 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/token"
+	"math"
+	"sort"
+)
+
+// A .lyzc file holds a serialized Bytecode:
+//
+//	magic    "LYZC"
+//	version  uint16, big endian
+//	flags    byte, flagDebug if the debug sections are present
+//	main     the main function, encoded like a CompiledFunction
+//	          without its header
+//	pool     uvarint count followed by the tagged constants
+//
+// Integers are encoded as varints and lengths and counts as uvarints.
+// Function and variable names and source maps are debug sections: they only
+// make stack traces and disassembly readable and are left out when
+// marshaling without debug info.
+const (
+	BytecodeMagic   = "LYZC"
+	BytecodeVersion = 1
+)
+
+const flagDebug = 1 << 0
+
+// constant tags
+const (
+	tagInteger byte = iota + 1
+	tagFloat
+	tagString
+	tagBoolean
+	tagNull
+	tagArray
+	tagHash
+	tagCompiledFunction
+
+	// runtime values, only found in session state
+	tagClosure
+	tagCell
+	tagBuiltin
+	tagError
+	tagConstant // a function of the constant pool, by index
+	tagRef      // a value written before, by the order it was first written
+)
+
+// Marshal encodes bytecode in the .lyzc format, including the debug sections
+// if debug is set
+func Marshal(bytecode *Bytecode, debug bool) ([]byte, error) {
+	e := &encoder{debug: debug}
+	e.writeHeader(BytecodeMagic, BytecodeVersion)
+	e.writeBody(bytecode.Instructions, bytecode.Handlers, bytecode.SourceMap)
+	if err := e.writeObjects(bytecode.Constants); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+// Unmarshal decodes bytecode in the .lyzc format
+func Unmarshal(data []byte) (*Bytecode, error) {
+	d, err := newDecoder(data, BytecodeMagic, BytecodeVersion, "lyzc")
+	if err != nil {
+		return nil, err
+	}
+	bytecode := &Bytecode{}
+	bytecode.Instructions, bytecode.Handlers, bytecode.SourceMap = d.readBody()
+	bytecode.Constants = d.readObjects()
+	if err := d.finish("lyzc"); err != nil {
+		return nil, err
+	}
+	return bytecode, nil
+}
+
+// writeHeader starts a file with magic and version
+func (e *encoder) writeHeader(magic string, version uint16) {
+	e.buf.WriteString(magic)
+	binary.Write(&e.buf, binary.BigEndian, version)
+	var flags byte
+	if e.debug {
+		flags |= flagDebug
+	}
+	e.buf.WriteByte(flags)
+}
+
+// newDecoder checks the header of a file of the named kind and returns a
+// decoder for its body
+func newDecoder(data []byte, magic string, version uint16, kind string) (*decoder, error) {
+	if len(data) < len(magic)+3 || string(data[:len(magic)]) != magic {
+		return nil, fmt.Errorf("not a %s file", kind)
+	}
+	data = data[len(magic):]
+	if v := binary.BigEndian.Uint16(data); v != version {
+		return nil, fmt.Errorf("unsupported %s version %d, want %d", kind, v, version)
+	}
+	flags := data[2]
+	if flags&^flagDebug != 0 {
+		return nil, fmt.Errorf("unknown %s flags %#x", kind, flags)
+	}
+	return &decoder{data: data[3:], header: len(magic) + 3, debug: flags&flagDebug != 0}, nil
+}
+
+// finish checks that all the data was read, returning the first error with
+// its offset in the file
+func (d *decoder) finish(kind string) error {
+	if d.err == nil && len(d.data) > 0 {
+		d.start = d.offset
+		d.fail("%d trailing bytes", len(d.data))
+	}
+	if d.err != nil {
+		return fmt.Errorf("invalid %s file at offset %d: %s", kind, d.header+d.offset, d.err)
+	}
+	return nil
+}
+
+type encoder struct {
+	buf   bytes.Buffer
+	debug bool
+
+	// refs numbers the mutable values written so far, in the order they
+	// were first written. It is only set when writing runtime values, which
+	// may share and cycle through them.
+	refs      map[object.Object]int
+	constants []object.Object         // the pool of tagConstant references
+	builtins  *object.BuiltinRegistry // the registry naming tagBuiltin values
+}
+
+func (e *encoder) writeUvarint(v int) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutUvarint(b[:], uint64(v))])
+}
+
+func (e *encoder) writeVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUvarint(len(b))
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeUvarint(len(s))
+	e.buf.WriteString(s)
+}
+
+func (e *encoder) writeStrings(strs []string) {
+	e.writeUvarint(len(strs))
+	for _, s := range strs {
+		e.writeString(s)
+	}
+}
+
+// writeBody writes the parts shared by the main function and compiled functions
+func (e *encoder) writeBody(ins code.Instructions, handlers []code.ExceptionHandler, sm code.SourceMap) {
+	e.writeBytes(ins)
+	e.writeUvarint(len(handlers))
+	for _, h := range handlers {
+		e.writeUvarint(h.Start)
+		e.writeUvarint(h.End)
+		e.writeUvarint(h.Catch)
+	}
+	if !e.debug {
+		return
+	}
+	e.writeUvarint(len(sm))
+	for _, sp := range sm {
+		e.writeUvarint(sp.Offset)
+		e.writeString(sp.Pos.Filename)
+		e.writeUvarint(sp.Pos.Offset)
+		e.writeUvarint(sp.Pos.Line)
+		e.writeUvarint(sp.Pos.Column)
+	}
+}
+
+func (e *encoder) writeObjects(objs []object.Object) error {
+	e.writeUvarint(len(objs))
+	for _, obj := range objs {
+		if err := e.writeObject(obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *encoder) writeObject(obj object.Object) error {
+	if e.refs != nil && e.writeReference(obj) {
+		return nil
+	}
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(tagInteger)
+		e.writeVarint(obj.Value)
+	case *object.Float:
+		e.buf.WriteByte(tagFloat)
+		binary.Write(&e.buf, binary.BigEndian, math.Float64bits(obj.Value))
+	case *object.String:
+		e.buf.WriteByte(tagString)
+		e.writeString(obj.Value)
+	case *object.Boolean:
+		e.buf.WriteByte(tagBoolean)
+		if obj.Value {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case *object.Null:
+		e.buf.WriteByte(tagNull)
+	case *object.Array:
+		e.buf.WriteByte(tagArray)
+		e.writeUvarint(len(obj.Elements))
+		for _, el := range obj.Elements {
+			if err := e.writeObject(el); err != nil {
+				return err
+			}
+		}
+	case *object.Hash:
+		e.buf.WriteByte(tagHash)
+		e.writeUvarint(len(obj.Pairs))
+		// sort the pairs so that equal hashes marshal to equal bytes
+		keys := make([]object.HashKey, 0, len(obj.Pairs))
+		for k := range obj.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Type != keys[j].Type {
+				return keys[i].Type < keys[j].Type
+			}
+			return keys[i].Value < keys[j].Value
+		})
+		for _, k := range keys {
+			pair := obj.Pairs[k]
+			if err := e.writeObject(pair.Key); err != nil {
+				return err
+			}
+			if err := e.writeObject(pair.Value); err != nil {
+				return err
+			}
+		}
+	case *object.CompiledFunction:
+		e.buf.WriteByte(tagCompiledFunction)
+		e.writeUvarint(obj.NumLocals)
+		e.writeUvarint(obj.NumParameters)
+		if e.debug {
+			e.writeString(obj.Name)
+			e.writeStrings(obj.LocalNames)
+			e.writeStrings(obj.FreeNames)
+		}
+		e.writeBody(obj.Instructions, obj.Handlers, obj.SourceMap)
+	default:
+		if e.refs == nil {
+			return fmt.Errorf("cannot marshal %s constant", obj.Type())
+		}
+		return e.writeRuntimeObject(obj)
+	}
+	return nil
+}
+
+// writeReference writes a reference to obj if it was written before or is a
+// function of the constant pool, and otherwise numbers obj if it is mutable
+func (e *encoder) writeReference(obj object.Object) bool {
+	switch obj.(type) {
+	case *object.Array, *object.Hash, *object.Closure, *object.Cell, *object.Error:
+		if ref, ok := e.refs[obj]; ok {
+			e.buf.WriteByte(tagRef)
+			e.writeUvarint(ref)
+			return true
+		}
+		e.refs[obj] = len(e.refs)
+	case *object.CompiledFunction:
+		for i, c := range e.constants {
+			if c == obj {
+				e.buf.WriteByte(tagConstant)
+				e.writeUvarint(i)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *encoder) writeRuntimeObject(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Closure:
+		e.buf.WriteByte(tagClosure)
+		if err := e.writeObject(obj.Fn); err != nil {
+			return err
+		}
+		return e.writeObjects(obj.Free)
+	case *object.Cell:
+		e.buf.WriteByte(tagCell)
+		return e.writeObject(obj.Value)
+	case *object.Builtin:
+		i, ok := e.builtins.IndexOf(obj)
+		if !ok {
+			return errors.New("cannot marshal unknown builtin")
+		}
+		e.buf.WriteByte(tagBuiltin)
+		e.writeString(e.builtins.Name(i))
+		return nil
+	case *object.Error:
+		e.buf.WriteByte(tagError)
+		e.writeString(obj.Message)
+		if obj.Value == nil {
+			e.buf.WriteByte(0)
+			return nil
+		}
+		e.buf.WriteByte(1)
+		return e.writeObject(obj.Value)
+	}
+	return fmt.Errorf("cannot marshal %s value", obj.Type())
+}
+
+// decoder reads from data and remembers the first error, after which every
+// read returns a zero value
+type decoder struct {
+	data   []byte
+	header int // length of the header before the body
+	offset int // offset of data in the body
+	start  int // offset of the value being read
+	debug  bool
+	err    error
+
+	// refs holds the mutable values read so far when reading runtime
+	// values, see encoder
+	refs      []object.Object
+	runtime   bool
+	constants []object.Object
+	builtins  *object.BuiltinRegistry
+}
+
+// fail records an error for the value being read
+func (d *decoder) fail(format string, a ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf(format, a...)
+		d.offset = d.start
+	}
+}
+
+func (d *decoder) readByte() byte {
+	if d.err != nil {
+		return 0
+	}
+	d.start = d.offset
+	if len(d.data) == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	b := d.data[0]
+	d.advance(1)
+	return b
+}
+
+func (d *decoder) advance(n int) {
+	d.data = d.data[n:]
+	d.offset += n
+}
+
+func (d *decoder) readUvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	d.start = d.offset
+	v, n := binary.Uvarint(d.data)
+	if n == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	if n < 0 {
+		d.fail("malformed varint")
+		return 0
+	}
+	d.advance(n)
+	return v
+}
+
+func (d *decoder) readVarint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	d.start = d.offset
+	v, n := binary.Varint(d.data)
+	if n == 0 {
+		d.fail("unexpected end of data")
+		return 0
+	}
+	if n < 0 {
+		d.fail("malformed varint")
+		return 0
+	}
+	d.advance(n)
+	return v
+}
+
+// readLength reads a length or count, which cannot exceed the remaining data
+// since every element takes at least one byte
+func (d *decoder) readLength() int {
+	v := d.readUvarint()
+	if v > uint64(len(d.data)) {
+		d.fail("length %d exceeds remaining data", v)
+		return 0
+	}
+	return int(v)
+}
+
+// readInt reads a non-negative int such as an offset or a count
+func (d *decoder) readInt() int {
+	v := d.readUvarint()
+	if v > math.MaxInt32 {
+		d.fail("value %d out of range", v)
+		return 0
+	}
+	return int(v)
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readLength()
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.data)
+	d.advance(n)
+	return b
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readStrings() []string {
+	var strs []string
+	n := d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		strs = append(strs, d.readString())
+	}
+	return strs
+}
+
+func (d *decoder) readBody() (code.Instructions, []code.ExceptionHandler, code.SourceMap) {
+	ins := code.Instructions(d.readBytes())
+	var handlers []code.ExceptionHandler
+	n := d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		handlers = append(handlers, code.ExceptionHandler{
+			Start: d.readInt(),
+			End:   d.readInt(),
+			Catch: d.readInt(),
+		})
+	}
+	if !d.debug {
+		return ins, handlers, nil
+	}
+	var sm code.SourceMap
+	n = d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		offset := d.readInt()
+		pos := token.Position{Filename: d.readString()}
+		pos.Offset = d.readInt()
+		pos.Line = d.readInt()
+		pos.Column = d.readInt()
+		sm = append(sm, code.SourcePosition{Offset: offset, Pos: pos})
+	}
+	return ins, handlers, sm
+}
+
+func (d *decoder) readObjects() []object.Object {
+	var objs []object.Object
+	n := d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		objs = append(objs, d.readObject())
+	}
+	return objs
+}
+
+// ref numbers a mutable value before its contents are read, like the
+// encoder does
+func (d *decoder) ref(obj object.Object) {
+	if d.runtime {
+		d.refs = append(d.refs, obj)
+	}
+}
+
+func (d *decoder) readObject() object.Object {
+	start := d.offset
+	tag := d.readByte()
+	if d.err != nil {
+		return nil
+	}
+	if tag >= tagClosure && !d.runtime {
+		d.fail("unknown constant tag %d", tag)
+		return nil
+	}
+	switch tag {
+	case tagInteger:
+		return &object.Integer{Value: d.readVarint()}
+	case tagFloat:
+		d.start = d.offset
+		if len(d.data) < 8 {
+			d.fail("unexpected end of data")
+			return nil
+		}
+		v := math.Float64frombits(binary.BigEndian.Uint64(d.data))
+		d.advance(8)
+		return &object.Float{Value: v}
+	case tagString:
+		return &object.String{Value: d.readString()}
+	case tagBoolean:
+		switch b := d.readByte(); b {
+		case 0, 1:
+			return &object.Boolean{Value: b == 1}
+		default:
+			d.fail("invalid boolean %d", b)
+			return nil
+		}
+	case tagNull:
+		return &object.Null{}
+	case tagArray:
+		arr := &object.Array{}
+		d.ref(arr)
+		n := d.readLength()
+		arr.Elements = make([]object.Object, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			arr.Elements = append(arr.Elements, d.readObject())
+		}
+		return arr
+	case tagHash:
+		hash := &object.Hash{}
+		d.ref(hash)
+		n := d.readLength()
+		pairs := make(map[object.HashKey]object.HashPair, n)
+		hash.Pairs = pairs
+		for i := 0; i < n && d.err == nil; i++ {
+			key := d.readObject()
+			value := d.readObject()
+			if d.err != nil {
+				break
+			}
+			hashKey, ok := key.(object.Hashable)
+			if !ok {
+				d.fail("unusable as hash key: %s", key.Type())
+				break
+			}
+			pairs[hashKey.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return hash
+	case tagCompiledFunction:
+		fn := &object.CompiledFunction{NumLocals: d.readInt(), NumParameters: d.readInt()}
+		if d.debug {
+			fn.Name = d.readString()
+			fn.LocalNames = d.readStrings()
+			fn.FreeNames = d.readStrings()
+		}
+		fn.Instructions, fn.Handlers, fn.SourceMap = d.readBody()
+		return fn
+	case tagClosure:
+		closure := &object.Closure{}
+		d.ref(closure)
+		fnStart := d.offset
+		fn, ok := d.readObject().(*object.CompiledFunction)
+		if !ok {
+			d.start = fnStart
+			d.fail("closure of a value that is not a function")
+			return nil
+		}
+		closure.Fn = fn
+		closure.Free = d.readObjects()
+		return closure
+	case tagCell:
+		cell := &object.Cell{}
+		d.ref(cell)
+		cell.Value = d.readObject()
+		return cell
+	case tagBuiltin:
+		name := d.readString()
+		if i, ok := d.builtins.Lookup(name); ok {
+			return d.builtins.Get(i)
+		}
+		d.start = start
+		d.fail("unknown builtin %q", name)
+		return nil
+	case tagError:
+		err := &object.Error{}
+		d.ref(err)
+		err.Message = d.readString()
+		switch b := d.readByte(); b {
+		case 0:
+		case 1:
+			err.Value = d.readObject()
+		default:
+			d.fail("invalid error value flag %d", b)
+		}
+		return err
+	case tagConstant:
+		i := d.readInt()
+		if i >= len(d.constants) {
+			d.start = start
+			d.fail("constant %d out of range, pool has %d constants", i, len(d.constants))
+			return nil
+		}
+		return d.constants[i]
+	case tagRef:
+		i := d.readInt()
+		if i >= len(d.refs) {
+			d.start = start
+			d.fail("reference %d out of range, %d values read", i, len(d.refs))
+			return nil
+		}
+		return d.refs[i]
+	default:
+		d.fail("unknown constant tag %d", tag)
+		return nil
+	}
+}
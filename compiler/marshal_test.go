@@ -0,0 +1,159 @@
+package compiler
+
+import (
+	"lyz-lang-2nd/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	input := `
+let add = fn(a, b) { a + b };
+let counter = fn() {
+	let n = 0;
+	fn() { n = n + 1; n }
+};
+let s = "x${1.5}";
+try { throw "boom"; } catch (e) { e; } finally { 2; }
+add(1, 2);
+`
+	program := parse(input)
+	comp := New()
+	if err := comp.Compile(program); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+
+	data, err := Marshal(bytecode, true)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if !strings.HasPrefix(string(data), BytecodeMagic) {
+		t.Errorf("missing magic. got=%q", data[:4])
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if !reflect.DeepEqual(bytecode, decoded) {
+		t.Errorf("bytecode changed by round trip.\nwant=%+v\n got=%+v", bytecode, decoded)
+	}
+
+	stripped, err := Marshal(bytecode, false)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if len(stripped) >= len(data) {
+		t.Errorf("stripped bytecode is not smaller. debug=%d, stripped=%d", len(data), len(stripped))
+	}
+	decoded, err = Unmarshal(stripped)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if decoded.SourceMap != nil {
+		t.Errorf("stripped bytecode has a source map")
+	}
+	if !reflect.DeepEqual(bytecode.Instructions, decoded.Instructions) {
+		t.Errorf("wrong instructions.\nwant=%s\n got=%s", bytecode.Instructions, decoded.Instructions)
+	}
+	for i, c := range decoded.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		want := bytecode.Constants[i].(*object.CompiledFunction)
+		if fn.Name != "" || fn.SourceMap != nil || fn.LocalNames != nil || fn.FreeNames != nil {
+			t.Errorf("constant %d: stripped function has debug info", i)
+		}
+		if !reflect.DeepEqual(want.Instructions, fn.Instructions) || !reflect.DeepEqual(want.Handlers, fn.Handlers) {
+			t.Errorf("constant %d: wrong function body", i)
+		}
+	}
+}
+
+func TestMarshalConstants(t *testing.T) {
+	constants := []object.Object{
+		&object.Integer{Value: -1 << 62},
+		&object.Float{Value: 2.5},
+		&object.String{Value: "héllo"},
+		&object.Boolean{Value: true},
+		&object.Null{},
+		&object.Array{Elements: []object.Object{&object.Integer{Value: 1}, &object.String{Value: "a"}}},
+		&object.Hash{Pairs: map[object.HashKey]object.HashPair{
+			(&object.String{Value: "k"}).HashKey(): {Key: &object.String{Value: "k"}, Value: &object.Integer{Value: 2}},
+			(&object.Integer{Value: 3}).HashKey():  {Key: &object.Integer{Value: 3}, Value: &object.Array{}},
+		}},
+	}
+	bytecode := &Bytecode{Instructions: []byte{}, Constants: constants}
+
+	data, err := Marshal(bytecode, true)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	decoded, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	for i, c := range constants {
+		hash, ok := c.(*object.Hash)
+		if !ok {
+			if c.Inspect() != decoded.Constants[i].Inspect() || c.Type() != decoded.Constants[i].Type() {
+				t.Errorf("constant %d: want=%s, got=%s", i, c.Inspect(), decoded.Constants[i].Inspect())
+			}
+			continue
+		}
+		decodedHash, ok := decoded.Constants[i].(*object.Hash)
+		if !ok || len(decodedHash.Pairs) != len(hash.Pairs) {
+			t.Fatalf("constant %d: want=%s, got=%s", i, c.Inspect(), decoded.Constants[i].Inspect())
+		}
+		for k, pair := range hash.Pairs {
+			if decodedHash.Pairs[k].Value.Inspect() != pair.Value.Inspect() {
+				t.Errorf("constant %d: wrong value for %s", i, pair.Key.Inspect())
+			}
+		}
+	}
+
+	again, err := Marshal(decoded, true)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if string(again) != string(data) {
+		t.Errorf("marshaling is not deterministic")
+	}
+}
+
+func TestMarshalErrors(t *testing.T) {
+	_, err := Marshal(&Bytecode{Constants: []object.Object{object.Builtins[0].Builtin}}, true)
+	if err == nil || err.Error() != "cannot marshal BUILTIN constant" {
+		t.Errorf("wrong marshal error: %v", err)
+	}
+
+	valid, err := Marshal(&Bytecode{Instructions: []byte{1, 2}, Constants: []object.Object{&object.Integer{Value: 1}}}, false)
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"", "not a lyzc file"},
+		{"LYZX\x00\x01\x00", "not a lyzc file"},
+		{"LYZC\x00\x02\x00", "unsupported lyzc version 2, want 1"},
+		{"LYZC\x00\x01\x80", "unknown lyzc flags 0x80"},
+		{string(valid[:len(valid)-1]), "invalid lyzc file at offset 13: unexpected end of data"},
+		{string(valid) + "\x00", "invalid lyzc file at offset 14: 1 trailing bytes"},
+		{"LYZC\x00\x01\x00\x05\x01", "invalid lyzc file at offset 7: length 5 exceeds remaining data"},
+		{"LYZC\x00\x01\x00\x00\x00\x01\x63", "invalid lyzc file at offset 10: unknown constant tag 99"},
+	}
+
+	for _, tt := range tests {
+		_, err := Unmarshal([]byte(tt.data))
+		if err == nil {
+			t.Fatalf("%q: expected error", tt.data)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.data, tt.expected, err.Error())
+		}
+	}
+}
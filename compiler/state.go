@@ -0,0 +1,147 @@
+package compiler
+
+import (
+	"fmt"
+	"lyz-lang-2nd/object"
+	"sort"
+)
+
+// State is what a session of successive compilations accumulates: the
+// symbol table and constant pool each compilation extends, and the values
+// the programs run so far left in the globals
+type State struct {
+	Symbols   *SymbolTable
+	Constants []object.Object
+	Globals   []object.Object // by the index of their symbol
+
+	// Builtins are the builtins the symbols refer to, object.DefaultBuiltins
+	// if nil
+	Builtins *object.BuiltinRegistry
+}
+
+// A session file holds a serialized State:
+//
+//	magic      "LYZS"
+//	version    uint16, big endian
+//	flags      byte, always flagDebug
+//	constants  uvarint count followed by the tagged constants
+//	symbols    uvarint number of definitions, then a uvarint count of
+//	            symbols, each a name, a scope and an index
+//	globals    uvarint count of the globals that are set, each an index
+//	            followed by the tagged value
+//
+// Values are tagged like constants. Closures, cells, builtins and errors may
+// appear among the globals, and a value that is shared, or contains itself,
+// is written once and referred to by tagRef afterwards. Builtins are written
+// by name, so a session must be read with the builtins it was saved with.
+const (
+	StateMagic   = "LYZS"
+	StateVersion = 1
+)
+
+// MarshalState encodes s in the session file format
+func MarshalState(s *State) ([]byte, error) {
+	e := &encoder{debug: true}
+	e.writeHeader(StateMagic, StateVersion)
+	if err := e.writeObjects(s.Constants); err != nil {
+		return nil, err
+	}
+
+	// only the outermost symbol table persists between compilations
+	symbols := make([]Symbol, 0, len(s.Symbols.store))
+	for _, sym := range s.Symbols.store {
+		symbols = append(symbols, sym)
+	}
+	sort.Slice(symbols, func(i, j int) bool { return symbols[i].Name < symbols[j].Name })
+	e.writeUvarint(s.Symbols.numDefinitions)
+	e.writeUvarint(len(symbols))
+	for _, sym := range symbols {
+		e.writeString(sym.Name)
+		e.writeString(string(sym.Scope))
+		e.writeUvarint(sym.Index)
+	}
+
+	e.refs, e.constants, e.builtins = map[object.Object]int{}, s.Constants, s.Builtins
+	if e.builtins == nil {
+		e.builtins = object.DefaultBuiltins()
+	}
+	names := s.Symbols.DefinedNames()
+	var set []int
+	for i, g := range s.Globals {
+		if g != nil {
+			set = append(set, i)
+		}
+	}
+	e.writeUvarint(len(set))
+	for _, i := range set {
+		e.writeUvarint(i)
+		if err := e.writeObject(s.Globals[i]); err != nil {
+			name := fmt.Sprintf("%d", i)
+			if i < len(names) && names[i] != "" {
+				name = names[i]
+			}
+			return nil, fmt.Errorf("global %s: %s", name, err)
+		}
+	}
+	return e.buf.Bytes(), nil
+}
+
+// UnmarshalState decodes a State in the session file format, finding the
+// builtins it refers to in builtins, or object.DefaultBuiltins if it is nil.
+// Its Globals have one slot per global definition of its symbol table.
+func UnmarshalState(data []byte, builtins *object.BuiltinRegistry) (*State, error) {
+	d, err := newDecoder(data, StateMagic, StateVersion, "session")
+	if err != nil {
+		return nil, err
+	}
+	if builtins == nil {
+		builtins = object.DefaultBuiltins()
+	}
+	s := &State{Constants: d.readObjects(), Symbols: NewSymbolTable(), Builtins: builtins}
+
+	s.Symbols.numDefinitions = d.readInt()
+	if d.err == nil && s.Symbols.numDefinitions > MaxGlobals {
+		d.fail("%d definitions exceed the %d globals", s.Symbols.numDefinitions, MaxGlobals)
+	}
+	n := d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		sym := Symbol{Name: d.readString()}
+		start := d.offset
+		sym.Scope, sym.Index = SymbolScope(d.readString()), d.readInt()
+		switch {
+		case d.err != nil:
+		case sym.Scope != GlobalScope && sym.Scope != BuiltinScope:
+			d.start = start
+			d.fail("symbol %s has scope %s", sym.Name, sym.Scope)
+		case sym.Scope == GlobalScope && sym.Index >= s.Symbols.numDefinitions:
+			d.fail("symbol %s index %d out of range, %d definitions", sym.Name, sym.Index, s.Symbols.numDefinitions)
+		case sym.Scope == BuiltinScope:
+			if i, ok := builtins.Lookup(sym.Name); !ok || i != sym.Index {
+				d.start = start
+				d.fail("builtin %s at index %d is not registered", sym.Name, sym.Index)
+			}
+		}
+		s.Symbols.store[sym.Name] = sym
+	}
+
+	if d.err != nil {
+		return nil, d.finish("session")
+	}
+	d.runtime, d.constants, d.builtins = true, s.Constants, builtins
+	s.Globals = make([]object.Object, s.Symbols.numDefinitions)
+	n = d.readLength()
+	for i := 0; i < n && d.err == nil; i++ {
+		index := d.readInt()
+		if d.err == nil && index >= len(s.Globals) {
+			d.fail("global index %d out of range, %d definitions", index, len(s.Globals))
+		}
+		value := d.readObject()
+		if d.err == nil {
+			s.Globals[index] = value
+		}
+	}
+	if err := d.finish("session"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
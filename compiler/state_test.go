@@ -0,0 +1,140 @@
+package compiler
+
+import (
+	"lyz-lang-2nd/object"
+	"strings"
+	"testing"
+)
+
+func TestMarshalStateRoundTrip(t *testing.T) {
+	comp := New()
+	if err := comp.Compile(parse(`let a = 1; let f = fn(x) { x + 1 }; let a = 2;`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	bytecode := comp.Bytecode()
+	fn := bytecode.Constants[2].(*object.CompiledFunction)
+
+	cell := &object.Cell{Value: &object.Integer{Value: 5}}
+	cycle := &object.Array{}
+	cycle.Elements = []object.Object{cycle}
+	thrown := &object.Error{Message: "uncaught exception: x", Value: &object.String{Value: "x"}}
+	globals := []object.Object{
+		&object.Array{Elements: []object.Object{
+			&object.Closure{Fn: fn, Free: []object.Object{cell}},
+			&object.Closure{Fn: fn, Free: []object.Object{cell}},
+			cycle,
+		}},
+		object.Builtins[1].Builtin,
+		&object.Hash{Pairs: map[object.HashKey]object.HashPair{
+			(&object.String{Value: "e"}).HashKey(): {Key: &object.String{Value: "e"}, Value: thrown},
+		}},
+	}
+
+	data, err := MarshalState(&State{Symbols: comp.symbolTable, Constants: bytecode.Constants, Globals: globals})
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+	if !strings.HasPrefix(string(data), StateMagic) {
+		t.Errorf("missing magic. got=%q", data[:4])
+	}
+	state, err := UnmarshalState(data, nil)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+
+	for _, name := range []string{"a", "f", "len", "puts"} {
+		want, _ := comp.symbolTable.Resolve(name)
+		if got, ok := state.Symbols.Resolve(name); !ok || got != want {
+			t.Errorf("wrong symbol %s. want=%+v, got=%+v", name, want, got)
+		}
+	}
+	if len(state.Globals) != 3 || state.Symbols.Define("b").Index != 3 {
+		t.Errorf("wrong number of global definitions. got=%d", len(state.Globals))
+	}
+	if len(state.Constants) != len(bytecode.Constants) {
+		t.Fatalf("wrong number of constants. want=%d, got=%d", len(bytecode.Constants), len(state.Constants))
+	}
+
+	elements := state.Globals[0].(*object.Array).Elements
+	first, second := elements[0].(*object.Closure), elements[1].(*object.Closure)
+	if first.Fn != state.Constants[2] || second.Fn != state.Constants[2] {
+		t.Errorf("closures do not refer to the function in the constant pool")
+	}
+	if first.Free[0] != second.Free[0] || first.Free[0].(*object.Cell).Value.Inspect() != "5" {
+		t.Errorf("closures do not share their cell")
+	}
+	if arr := elements[2].(*object.Array); arr.Elements[0] != arr {
+		t.Errorf("cycle not restored")
+	}
+	if state.Globals[1] != object.Builtins[1].Builtin {
+		t.Errorf("wrong builtin. got=%v", state.Globals[1])
+	}
+	pair := state.Globals[2].(*object.Hash).Pairs[(&object.String{Value: "e"}).HashKey()]
+	if err, ok := pair.Value.(*object.Error); !ok || err.Message != thrown.Message || err.Value.Inspect() != "x" {
+		t.Errorf("wrong error. got=%v", pair.Value)
+	}
+}
+
+func TestMarshalStateErrors(t *testing.T) {
+	symbols := NewSymbolTable()
+	symbols.Define("f")
+	_, err := MarshalState(&State{Symbols: symbols, Globals: []object.Object{&object.Function{}}})
+	if err == nil || err.Error() != "global f: cannot marshal FUNCTION value" {
+		t.Errorf("wrong marshal error: %v", err)
+	}
+
+	tests := []struct {
+		data     string
+		expected string
+	}{
+		{"LYZC\x00\x01\x01", "not a session file"},
+		{"LYZS\x00\x02\x01", "unsupported session version 2, want 1"},
+		{"LYZS\x00\x01\x01\x00\x01\x01\x01aGLOBAL\x01\x00", "invalid session file at offset 12: length 71 exceeds remaining data"},
+		{"LYZS\x00\x01\x01\x00\x01\x01\x01a\x05LOCAL\x00\x00", "invalid session file at offset 12: symbol a has scope LOCAL"},
+		{"LYZS\x00\x01\x01\x00\x01\x00\x01\x01\x00", "invalid session file at offset 11: global index 1 out of range, 1 definitions"},
+		{"LYZS\x00\x01\x00\x00\xff\xff\xff\xff\x04\x00", "invalid session file at offset 8: 1342177279 definitions exceed the 65536 globals"},
+		{"LYZS\x00\x01\x01\x00\x00\x01\x01x\x07BUILTIN\x00\x00", "invalid session file at offset 12: builtin x at index 0 is not registered"},
+		{"LYZS\x00\x01\x01\x00\x01\x00\x01\x00\x0e\x00", "invalid session file at offset 12: reference 0 out of range, 0 values read"},
+		{"LYZS\x00\x01\x01\x00\x01\x00\x01\x00\x0d\x00", "invalid session file at offset 12: constant 0 out of range, pool has 0 constants"},
+		{"LYZS\x00\x01\x01\x00\x01\x00\x01\x00\x0b\x01x", "invalid session file at offset 12: unknown builtin \"x\""},
+		{"LYZS\x00\x01\x01\x00\x01\x00\x01\x00\x09\x01\x00", "invalid session file at offset 13: closure of a value that is not a function"},
+		{"LYZS\x00\x01\x01\x01\x09\x00\x00\x00\x00", "invalid session file at offset 8: unknown constant tag 9"},
+	}
+	for _, tt := range tests {
+		_, err := UnmarshalState([]byte(tt.data), nil)
+		if err == nil {
+			t.Fatalf("%q: expected error", tt.data)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.data, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestMarshalStateBuiltins(t *testing.T) {
+	builtins := object.NewBuiltinRegistry()
+	query := builtins.Register("query", func(args ...object.Object) object.Object { return nil })
+	comp := NewWithOptions(Options{Builtins: builtins})
+	if err := comp.Compile(parse(`let q = query;`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	globals := []object.Object{builtins.Get(query)}
+	data, err := MarshalState(&State{Symbols: comp.symbolTable, Globals: globals, Builtins: builtins})
+	if err != nil {
+		t.Fatalf("marshal error: %s", err)
+	}
+
+	state, err := UnmarshalState(data, builtins)
+	if err != nil {
+		t.Fatalf("unmarshal error: %s", err)
+	}
+	if state.Globals[0] != builtins.Get(query) || state.Builtins != builtins {
+		t.Errorf("builtin not restored from the registry")
+	}
+	if _, err := UnmarshalState(data, nil); err == nil || !strings.Contains(err.Error(), "builtin query at index 6 is not registered") {
+		t.Errorf("expected the default builtins to reject the session, got=%v", err)
+	}
+	if _, err := MarshalState(&State{Symbols: comp.symbolTable, Globals: globals}); err == nil {
+		t.Errorf("expected a builtin unknown to the default builtins to fail")
+	}
+}
@@ -1,5 +1,7 @@
 package compiler
 
+import "lyz-lang-2nd/object"
+
 type SymbolScope string
 
 const (
@@ -10,6 +12,10 @@ const (
 	FunctionScope SymbolScope = "FUNCTION"
 )
 
+// MaxGlobals is the number of global variables a program can define, the
+// size of the globals store of the VM
+const MaxGlobals = 1 << 16
+
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
@@ -52,6 +58,27 @@ func (st *SymbolTable) Define(name string) Symbol {
 	return s
 }
 
+// NumDefinitions returns the number of symbols defined in st, the number of
+// slots its variables need
+func (st *SymbolTable) NumDefinitions() int {
+	return st.numDefinitions
+}
+
+// DefinedNames returns the names of the symbols defined in st by index. The
+// slot of a name that was defined again is left empty.
+func (st *SymbolTable) DefinedNames() []string {
+	if st.numDefinitions == 0 {
+		return nil
+	}
+	names := make([]string, st.numDefinitions)
+	for _, s := range st.store {
+		if s.Scope == GlobalScope || s.Scope == LocalScope {
+			names[s.Index] = s.Name
+		}
+	}
+	return names
+}
+
 func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
 	s, ok := st.store[name]
 	if !ok && st.Outer != nil {
@@ -80,6 +107,17 @@ func (st *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	return s
 }
 
+// DefineBuiltins defines the builtins of registry, or of
+// object.DefaultBuiltins if it is nil, by their index in it
+func (st *SymbolTable) DefineBuiltins(registry *object.BuiltinRegistry) {
+	if registry == nil {
+		registry = object.DefaultBuiltins()
+	}
+	for i := 0; i < registry.Len(); i++ {
+		st.DefineBuiltin(i, registry.Name(i))
+	}
+}
+
 func (s *SymbolTable) defineFree(original Symbol) Symbol {
 	s.FreeSymbols = append(s.FreeSymbols, original)
 
@@ -94,3 +132,18 @@ func (s *SymbolTable) DefineFunctionName(name string) Symbol {
 	s.store[name] = symbol
 	return symbol
 }
+
+// Copy returns a copy of st that symbols can be defined in without changing
+// st. The outer table is shared.
+func (st *SymbolTable) Copy() *SymbolTable {
+	c := &SymbolTable{
+		store:          make(map[string]Symbol, len(st.store)),
+		numDefinitions: st.numDefinitions,
+		Outer:          st.Outer,
+		FreeSymbols:    append([]Symbol{}, st.FreeSymbols...),
+	}
+	for name, s := range st.store {
+		c.store[name] = s
+	}
+	return c
+}
@@ -266,3 +266,23 @@ func TestShadowingFunctionName(t *testing.T) {
 			expected.Name, expected, result)
 	}
 }
+
+func TestCopy(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	copied := global.Copy()
+	copied.Define("b")
+	copied.Define("a")
+
+	if _, ok := global.Resolve("b"); ok {
+		t.Errorf("symbol defined in the copy resolves in the original")
+	}
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+	if result, _ := global.Resolve("a"); result != expected {
+		t.Errorf("expected a to resolve to %+v, got=%+v", expected, result)
+	}
+	expected = Symbol{Name: "a", Scope: GlobalScope, Index: 2}
+	if result, _ := copied.Resolve("a"); result != expected {
+		t.Errorf("expected a to resolve to %+v in the copy, got=%+v", expected, result)
+	}
+}
@@ -1,14 +0,0 @@
-package evaluator
-
-import (
-	"lyz-lang-2nd/object"
-)
-
-var builtins = map[string]object.Object{
-	"len":   object.GetBuiltinByName("len"),
-	"first": object.GetBuiltinByName("first"),
-	"last":  object.GetBuiltinByName("last"),
-	"rest":  object.GetBuiltinByName("rest"),
-	"push":  object.GetBuiltinByName("push"),
-	"puts":  object.GetBuiltinByName("puts"),
-}
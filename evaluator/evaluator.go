@@ -4,15 +4,41 @@ import (
 	"fmt"
 	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/token"
+	"math"
+	"strings"
 )
 
+// MaxCallDepth is the number of nested function calls after which a call
+// fails with a stack overflow, like in the VM
+const MaxCallDepth = 1024
+
 var (
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
-	NULL  = &object.Null{}
+	TRUE     = &object.Boolean{Value: true}
+	FALSE    = &object.Boolean{Value: false}
+	NULL     = &object.Null{}
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// Eval evaluates node. A failure is returned as an *object.Error whose
+// RuntimeError method gives the stack trace once it reaches the program.
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	result := eval(node, env)
+	if err, ok := result.(*object.Error); ok && !err.Pos.IsValid() {
+		// the innermost node an error comes out of locates it
+		err.Pos = node.Pos()
+	}
+	return result
+}
+
+// Apply calls fn, a function or builtin, with args. A failure is returned
+// as an *object.Error like from Eval.
+func Apply(fn object.Object, args ...object.Object) object.Object {
+	return applyFunction(fn, args, 0)
+}
+
+func eval(node ast.Node, env *object.Environment) object.Object {
 	switch node := node.(type) {
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
@@ -20,6 +46,8 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return Eval(node.Expression, env)
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
 	case *ast.Boolean:
 		return nativeBoolToBooleanObject(node.Value)
 	case *ast.PrefixExpression:
@@ -27,17 +55,24 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return evalPrefixExpression(node.Operator, right, env.CheckedArithmetic())
 	case *ast.InfixExpression:
 		left := Eval(node.Left, env)
 		if isError(left) {
 			return left
 		}
+		if node.Operator == "&&" || node.Operator == "||" {
+			// the right operand only runs when the left does not decide the result
+			if isTruthy(left) == (node.Operator == "||") {
+				return left
+			}
+			return Eval(node.Right, env)
+		}
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return evalInfixExpression(node.Operator, left, right, env.CheckedArithmetic())
 	case *ast.IfExpression:
 		return evalIfExpression(node, env)
 	case *ast.BlockStatement:
@@ -54,12 +89,30 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return val
 		}
 		env.Set(node.Name.Value, val)
+	case *ast.AssignStatement:
+		return evalAssignStatement(node, env)
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+	case *ast.ForStatement:
+		return evalForStatement(node, env)
+	case *ast.TryStatement:
+		return evalTryStatement(node, env)
+	case *ast.ThrowStatement:
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return object.NewThrownError(val)
+	case *ast.BreakStatement:
+		return BREAK
+	case *ast.ContinueStatement:
+		return CONTINUE
 	case *ast.Identifier:
 		return evalIdentifier(node, env)
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Body: body, Env: env}
+		return &object.Function{Name: node.Name, Parameters: params, Body: body, Env: env}
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
 		if isError(function) {
@@ -69,9 +122,11 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if len(args) == 1 && isError(args[0]) {
 			return args[0]
 		}
-		return applyFunction(function, args)
+		return applyFunction(function, args, env.Depth())
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
+	case *ast.InterpolatedString:
+		return evalInterpolatedString(node, env)
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
@@ -103,12 +158,35 @@ func evalProgram(stms []ast.Statement, env *object.Environment) object.Object {
 		case *object.ReturnValue:
 			return r.Value
 		case *object.Error:
-			return r
+			return leaveFunction(r, object.MainFunctionName)
 		}
 	}
 	return result
 }
 
+// leaveFunction records in err's stack trace that it propagated out of the
+// named function, so the caller's position is recorded next
+func leaveFunction(err *object.Error, name string) *object.Error {
+	err.Trace, err.Omitted = object.AddFrame(err.Trace, err.Omitted, object.StackFrame{Function: name, Pos: err.Pos})
+	err.Pos = token.Position{}
+	return err
+}
+
+func evalInterpolatedString(node *ast.InterpolatedString, env *object.Environment) object.Object {
+	var out strings.Builder
+	for _, part := range node.Parts {
+		value := Eval(part, env)
+		if isError(value) {
+			return value
+		}
+		if value == nil {
+			value = NULL
+		}
+		out.WriteString(value.Inspect())
+	}
+	return &object.String{Value: out.String()}
+}
+
 func evalHashLiteral(node *ast.HashLiteral, env *object.Environment) object.Object {
 	pairs := make(map[object.HashKey]object.HashPair)
 	for k, v := range node.Pairs {
@@ -167,12 +245,26 @@ func evalArrayIndexExpression(array object.Object, index object.Object) object.O
 	return arrayObject.Elements[idx]
 }
 
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// applyFunction calls fn with args from code running inside depth calls
+func applyFunction(fn object.Object, args []object.Object, depth int) object.Object {
 	switch f := fn.(type) {
 	case *object.Function:
+		if len(args) != len(f.Parameters) {
+			return newError("wrong number of arguments: want=%d, got=%d", len(f.Parameters), len(args))
+		}
+		if depth >= MaxCallDepth {
+			return newError("stack overflow")
+		}
 		extendedEnv := entendFunctionEnv(f, args)
+		extendedEnv.SetDepth(depth + 1)
 		evaluated := Eval(f.Body, extendedEnv)
-		return unwrapReturnValue(evaluated)
+		if err, ok := evaluated.(*object.Error); ok {
+			return leaveFunction(err, object.FunctionName(f.Name))
+		}
+		if result := unwrapReturnValue(evaluated); result != nil {
+			return result
+		}
+		return NULL
 	case *object.Builtin:
 		if result := f.Fn(args...); result != nil {
 			return result
@@ -215,8 +307,8 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 		return val
 	}
 
-	if builtin, ok := builtins[node.Value]; ok {
-		return builtin
+	if i, ok := env.Builtins().Lookup(node.Value); ok {
+		return env.Builtins().Get(i)
 	}
 
 	return newError("identifier not found: " + node.Value)
@@ -229,7 +321,7 @@ func evalBlockStatement(stms []ast.Statement, env *object.Environment) object.Ob
 		result = Eval(stm, env)
 		if result != nil {
 			r := result.Type()
-			if r == object.RETURN_VALUE_OBJ || r == object.ERROR_OBJ {
+			if r == object.RETURN_VALUE_OBJ || r == object.ERROR_OBJ || r == object.BREAK_OBJ || r == object.CONTINUE_OBJ {
 				return result
 			}
 		}
@@ -244,21 +336,27 @@ func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	return FALSE
 }
 
-func evalPrefixExpression(op string, value object.Object) object.Object {
+func evalPrefixExpression(op string, value object.Object, checked bool) object.Object {
 	switch op {
 	case "!":
 		return evalBangOperatorExpression(value)
 	case "-":
-		return evalMinusPrefixOperatorExpression(value)
+		return evalMinusPrefixOperatorExpression(value, checked)
+	case "~":
+		return evalBitNotOperatorExpression(value)
 	default:
 		return newError("unknown operator: %s%s", op, value.Type())
 	}
 }
 
-func evalInfixExpression(op string, left, right object.Object) object.Object {
+// evalInfixExpression applies op to its operands. With checked set, integer
+// overflow is an error.
+func evalInfixExpression(op string, left, right object.Object, checked bool) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
-		return evalIntegerInfixExpression(op, left, right)
+		return evalIntegerInfixExpression(op, left, right, checked)
+	case isNumber(left) && isNumber(right):
+		return evalFloatInfixExpression(op, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(op, left, right)
 	case op == "==":
@@ -285,30 +383,124 @@ func evalBangOperatorExpression(value object.Object) object.Object {
 	}
 }
 
-func evalMinusPrefixOperatorExpression(value object.Object) object.Object {
-	if value.Type() != object.INTEGER_OBJ {
+func evalMinusPrefixOperatorExpression(value object.Object, checked bool) object.Object {
+	switch value := value.(type) {
+	case *object.Integer:
+		result, ok := object.CheckedNeg(value.Value)
+		if !ok && checked {
+			return newError("integer overflow")
+		}
+		return &object.Integer{Value: result}
+	case *object.Float:
+		return &object.Float{Value: -value.Value}
+	default:
 		return newError("unknown operator: -%s", value.Type())
 	}
-	result := value.(*object.Integer).Value
-	return &object.Integer{Value: -result}
 }
 
-func evalIntegerInfixExpression(operator string, left, right object.Object) object.Object {
+func evalBitNotOperatorExpression(value object.Object) object.Object {
+	integer, ok := value.(*object.Integer)
+	if !ok {
+		return newError("unknown operator: ~%s", value.Type())
+	}
+	return &object.Integer{Value: ^integer.Value}
+}
+
+func evalIntegerInfixExpression(operator string, left, right object.Object, checked bool) object.Object {
 	leftVal := left.(*object.Integer).Value
 	rightVal := right.(*object.Integer).Value
+	var result int64
+	ok := true
 	switch operator {
 	case "+":
-		return &object.Integer{Value: leftVal + rightVal}
+		result, ok = object.CheckedAdd(leftVal, rightVal)
 	case "-":
-		return &object.Integer{Value: leftVal - rightVal}
+		result, ok = object.CheckedSub(leftVal, rightVal)
 	case "*":
-		return &object.Integer{Value: leftVal * rightVal}
+		result, ok = object.CheckedMul(leftVal, rightVal)
 	case "/":
-		return &object.Integer{Value: leftVal / rightVal}
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		result, ok = object.CheckedDiv(leftVal, rightVal)
+	case "%":
+		if rightVal == 0 {
+			return newError("modulo by zero")
+		}
+		result = leftVal % rightVal
+	case "**":
+		if rightVal < 0 {
+			return newError("negative exponent in integer power: %d", rightVal)
+		}
+		result, ok = object.CheckedPow(leftVal, rightVal)
+	case "&":
+		result = leftVal & rightVal
+	case "|":
+		result = leftVal | rightVal
+	case "^":
+		result = leftVal ^ rightVal
+	case "<<", ">>":
+		if rightVal < 0 {
+			return newError("negative shift count: %d", rightVal)
+		}
+		if operator == "<<" {
+			result, ok = object.CheckedShl(leftVal, rightVal)
+		} else {
+			result = leftVal >> uint64(rightVal)
+		}
+	case "<":
+		return nativeBoolToBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBoolToBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBoolToBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
+	}
+	if !ok && checked {
+		return newError("integer overflow")
+	}
+	return &object.Integer{Value: result}
+}
+
+// evalFloatInfixExpression handles float operands, promoting an integer
+// operand to float
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("modulo by zero")
+		}
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "**":
+		return &object.Float{Value: math.Pow(leftVal, rightVal)}
 	case "<":
 		return nativeBoolToBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBoolToBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBoolToBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBoolToBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBoolToBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -333,13 +525,170 @@ func evalIfExpression(cond *ast.IfExpression, env *object.Environment) object.Ob
 		return condition
 	}
 
+	var result object.Object
 	if isTruthy(condition) {
-		return Eval(cond.Consequence, env)
+		result = Eval(cond.Consequence, env)
 	} else if cond.Alternative != nil {
-		return Eval(cond.Alternative, env)
-	} else {
+		result = Eval(cond.Alternative, env)
+	}
+	// a branch ending in a statement has no value
+	if result == nil {
 		return NULL
 	}
+	return result
+}
+
+func isNumber(obj object.Object) bool {
+	t := obj.Type()
+	return t == object.INTEGER_OBJ || t == object.FLOAT_OBJ
+}
+
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
+func evalAssignStatement(node *ast.AssignStatement, env *object.Environment) object.Object {
+	switch target := node.Target.(type) {
+	case *ast.Identifier:
+		current, ok := env.Get(target.Value)
+		if !ok {
+			if _, ok := env.Builtins().Lookup(target.Value); ok {
+				return newError("cannot assign to builtin %s", target.Value)
+			}
+			return newError("identifier not found: " + target.Value)
+		}
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		if node.Operator != "=" {
+			val = evalInfixExpression(strings.TrimSuffix(node.Operator, "="), current, val, env.CheckedArithmetic())
+			if isError(val) {
+				return val
+			}
+		}
+		env.Assign(target.Value, val)
+	case *ast.IndexExpression:
+		left := Eval(target.Left, env)
+		if isError(left) {
+			return left
+		}
+		index := Eval(target.Index, env)
+		if isError(index) {
+			return index
+		}
+		val := Eval(node.Value, env)
+		if isError(val) {
+			return val
+		}
+		return evalIndexAssignment(left, index, val)
+	default:
+		return newError("cannot assign to %s", node.Target.String())
+	}
+	return nil
+}
+
+func evalIndexAssignment(left, index, val object.Object) object.Object {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return newError("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return newError("index out of range: %d", i.Value)
+		}
+		left.Elements[i.Value] = val
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return newError("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: val}
+	default:
+		return newError("index assignment not supported: %s", left.Type())
+	}
+	return nil
+}
+
+func evalWhileStatement(node *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(node.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		result := Eval(node.Body, env)
+		if result == BREAK {
+			return nil
+		}
+		if isError(result) || (result != nil && result.Type() == object.RETURN_VALUE_OBJ) {
+			return result
+		}
+	}
+}
+
+func evalForStatement(node *ast.ForStatement, env *object.Environment) object.Object {
+	iterable := Eval(node.Iterable, env)
+	if isError(iterable) {
+		return iterable
+	}
+	iterator, ok := object.NewIterator(iterable)
+	if !ok {
+		return newError("cannot iterate over %s", iterable.Type())
+	}
+
+	for {
+		elem, ok := iterator.Next()
+		if !ok {
+			return nil
+		}
+		env.Set(node.Variable.Value, elem)
+
+		result := Eval(node.Body, env)
+		if result == BREAK {
+			return nil
+		}
+		if isError(result) || (result != nil && result.Type() == object.RETURN_VALUE_OBJ) {
+			return result
+		}
+	}
+}
+
+func evalTryStatement(node *ast.TryStatement, env *object.Environment) object.Object {
+	result := Eval(node.Block, env)
+	if err, ok := result.(*object.Error); ok && node.Catch != nil {
+		env.Set(node.CatchParam.Value, err.Thrown())
+		result = Eval(node.Catch, env)
+	}
+
+	if node.Finally != nil {
+		// a finally block that throws, returns or jumps overrides the result
+		if finally := Eval(node.Finally, env); isAbrupt(finally) {
+			return finally
+		}
+	}
+	if isAbrupt(result) {
+		return result
+	}
+	return nil
+}
+
+// isAbrupt reports whether obj ends the evaluation of the enclosing statements
+func isAbrupt(obj object.Object) bool {
+	if obj == nil {
+		return false
+	}
+	return obj == BREAK || obj == CONTINUE || obj.Type() == object.ERROR_OBJ || obj.Type() == object.RETURN_VALUE_OBJ
 }
 
 func isTruthy(obj object.Object) bool {
@@ -4,6 +4,7 @@ import (
 	"lyz-lang-2nd/lexer"
 	"lyz-lang-2nd/object"
 	"lyz-lang-2nd/parser"
+	"math"
 	"testing"
 )
 
@@ -27,6 +28,19 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"5 ** 0", 1},
+		{"6 & 3", 2},
+		{"6 | 3", 7},
+		{"6 ^ 3", 5},
+		{"1 << 4", 16},
+		{"-16 >> 2", -4},
+		{"~5", -6},
+		{"1 + 2 << 1", 6},
 	}
 
 	for _, tt := range tests {
@@ -35,6 +49,44 @@ func TestEvalIntegerExpression(t *testing.T) {
 	}
 }
 
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", 2},
+		{"false && 2", false},
+		{"1 || 2", 1},
+		{"1 < 2 && 2 < 3", true},
+		{"let n = 0; let f = fn() { n += 1; true }; false && f(); true || f(); n", 0},
+		{"let n = 0; let f = fn() { n += 1; true }; true && f(); false || f(); n", 2},
+		{"false || x", "identifier not found: x"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -59,6 +111,12 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
+		{"1.5 <= 2", true},
+		{"2 >= 2.5", false},
 	}
 
 	for _, tt := range tests {
@@ -91,6 +149,60 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"1.5", 1.5},
+		{"2e3", 2000},
+		{"-2.5", -2.5},
+		{"1.5 + 2.25", 3.75},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2},
+		{"7 / 2.0", 3.5},
+		{"1.0 / 4 - 1", -0.75},
+		{"7.5 % 2", 1.5},
+		{"4 ** 0.5", 2},
+		{"2.0 ** 3", 8},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+
+	boolTests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1.5 > 1", true},
+		{"1 < 1.5", true},
+		{"1 == 1.0", true},
+		{"1.5 != 1.5", false},
+	}
+
+	for _, tt := range boolTests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	floatObj, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+
+	if floatObj.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g", floatObj.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func testBooleanObject(t *testing.T, obj object.Object, expected bool) bool {
 	boolObj, ok := obj.(*object.Boolean)
 	if !ok {
@@ -136,13 +248,26 @@ func TestIfElseExpressions(t *testing.T) {
 		{"if (1 > 2) { 10 }", nil},
 		{"if (1 > 2) { 10 } else { 20 }", 20},
 		{"if (1 < 2) { 10 } else { 20 }", 10},
+		{"if (true) { let x = 1; }", nil},
+		{"if (false) { 10 } else { }", nil},
+		{"let f = fn(n) { if (n > 0) { let m = n; } else { 1 } }; f(1)", nil},
+		{"let f = fn() { let y = 2; }; f()", nil},
+		{"if (true) { try { throw 1 } catch (e) { 3 } }", nil},
+		{"[if (true) { let x = 1; }]", "[null]"},
+		{"let a = if (true) { let x = 1; }; [a]", "[null]"},
+		{"let f = fn() { let y = 2; }; [f()]", "[null]"},
+		{"[1, if (true) { try { throw 1 } catch (e) { 3 } }]", "[1, null]"},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
-		integer, ok := tt.expected.(int)
-		if ok {
-			testIntegerObject(t, evaluated, int64(integer))
-		} else {
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			if evaluated.Inspect() != expected {
+				t.Errorf("%q: got=%s, want=%s", tt.input, evaluated.Inspect(), expected)
+			}
+		default:
 			testNullObject(t, evaluated)
 		}
 	}
@@ -234,6 +359,22 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "Monkey"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"1 / 0",
+			"division by zero",
+		},
+		{
+			"5 % 0",
+			"modulo by zero",
+		},
+		{
+			"1.0 / 0",
+			"division by zero",
+		},
+		{
+			"1.5 % 0.0",
+			"modulo by zero",
+		},
 	}
 	for _, tt := range tests {
 		evaluated := testEval(tt.input)
@@ -250,6 +391,38 @@ func TestErrorHandling(t *testing.T) {
 	}
 }
 
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		input     string
+		unchecked int64
+	}{
+		{"9223372036854775807 + 1", math.MinInt64},
+		{"-9223372036854775807 - 2", math.MaxInt64},
+		{"4611686018427387904 * 2", math.MinInt64},
+		{"let x = -9223372036854775807 - 1; -x", math.MinInt64},
+		{"let x = -9223372036854775807 - 1; x / -1", math.MinInt64},
+		{"2 ** 63", math.MinInt64},
+		{"1 << 63", math.MinInt64},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+
+		testIntegerObject(t, Eval(program, object.NewEnvironment()), tt.unchecked)
+
+		env := object.NewEnvironment()
+		env.SetCheckedArithmetic(true)
+		errObj, ok := Eval(program, env).(*object.Error)
+		if !ok {
+			t.Errorf("%q: expected overflow error", tt.input)
+			continue
+		}
+		if errObj.Message != "integer overflow" {
+			t.Errorf("%q: wrong error message. got=%q", tt.input, errObj.Message)
+		}
+	}
+}
+
 func TestLetStatements(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -326,6 +499,197 @@ func TestStringConcatenation(t *testing.T) {
 	}
 }
 
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"plain ${"string"}"`, "plain string"},
+		{`let name = "lyz"; let age = 2; "hello ${name}, you are ${age + 1}"`, "hello lyz, you are 3"},
+		{`"${1.5} ${true} ${[1, 2]} ${if (false) { 1 }}"`, "1.5 true [1, 2] null"},
+		{`let f = fn(x) { "<${x}>" }; "${f("a")}${f(1)}"`, "<a><1>"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		str, ok := evaluated.(*object.String)
+		if !ok {
+			t.Fatalf("object is not String. got=%T (%+v)", evaluated, evaluated)
+		}
+		if str.Value != tt.expected {
+			t.Errorf("String has wrong value. want=%q, got=%q", tt.expected, str.Value)
+		}
+	}
+}
+
+func TestLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let f = fn() { while (true) { break; } 5 }; f()`, 5},
+		{`let f = fn(arr, t) { for (x in arr) { if (x == t) { return x * 10; } } -1 }; f([1, 2, 3], 2)`, 20},
+		{`let f = fn(arr, t) { for (x in arr) { if (x == t) { return x * 10; } } -1 }; f([1, 2, 3], 5)`, -1},
+		{`let f = fn(arr) { for (x in arr) { if (x < 3) { continue; } return x; } 0 }; f([1, 2, 3, 4])`, 3},
+		{`for (x in 5) { x }`, "cannot iterate over INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let x = 1; x = x + 1; x`, 2},
+		{`let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x`, 6},
+		{`let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; } sum`, 15},
+		{`let counter = fn() { let n = 0; fn() { n += 1; n } }; let c = counter(); c(); c(); c()`, 3},
+		{`let x = 1; let f = fn() { x = 5; }; f(); x`, 5},
+		{`let a = [1, 2, 3]; a[1] = 20; a[1]`, 20},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"]`, 5},
+		{`y = 1;`, "identifier not found: y"},
+		{`len = 1;`, "cannot assign to builtin len"},
+		{`let a = [1]; a[1] = 2;`, "index out of range: 1"},
+		{`let x = 1; x[0] = 1;`, "index assignment not supported: INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("object is not Error. got=%T (%+v)", evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let r = 0; try { throw 1; r = 2; } catch (e) { r = e; } r`, 1},
+		{`let r = ""; try { len(1); } catch (e) { r = e; } r`, "argument to `len` not supported, got INTEGER"},
+		{`let r = 0; try { r = 1; } catch (e) { r = 2; } r`, 1},
+		{`let n = 0; try { n += 1; } finally { n *= 10; } n`, 10},
+		{`let n = 0; try { throw 1; } catch (e) { n += e; } finally { n *= 10; } n`, 10},
+		{`let n = 0; let f = fn() { try { throw 5; } finally { n = 1; } }; let r = 0; try { f(); } catch (e) { r = e + n; } r`, 6},
+		{`let n = 0; let f = fn() { try { return 1; } finally { n = 10; } }; f() + n`, 11},
+		{`let n = 0; while (true) { try { break; } finally { n += 1; } } n`, 1},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue; } n += x; } finally { n += 10; } } n`, 34},
+		{`let r = 0; try { try { throw 1; } catch (e) { throw e + 1; } } catch (e) { r = e; } r`, 2},
+		{`let n = 0; let r = 0; try { try { throw 1; } catch (e) { throw 2; } finally { n = 5; } } catch (e) { r = e + n; } r`, 7},
+		{`let f = fn() { try { throw 1; } catch (e) { return e + 1; } }; 10 + f()`, 12},
+		{`let f = fn(n) { if (n == 0) { throw "bottom"; } f(n - 1) }; let r = ""; try { f(50); } catch (e) { r = e; } r`, "bottom"},
+		{`let f = fn() { try { return 1; } catch (e) { return 2; } }; f(); let r = 0; try { throw 3; } catch (e) { r = e; } r`, 3},
+		{`let r = 0; try { throw {"code": 4}; } catch (e) { r = e["code"]; } r`, 4},
+		{`let r = ""; try { 1 + "a"; } catch (e) { r = e; } r`, "type mismatch: INTEGER + STRING"},
+		{`throw "boom";`, &object.Error{Message: "uncaught exception: boom"}},
+		{`try { throw 1; } finally { 2; }`, &object.Error{Message: "uncaught exception: 1"}},
+		{`try { len(1); } catch (e) { throw e; }`, &object.Error{Message: "uncaught exception: argument to `len` not supported, got INTEGER"}},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			str, ok := evaluated.(*object.String)
+			if !ok {
+				t.Errorf("%q: object is not String. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if str.Value != expected {
+				t.Errorf("%q: wrong string. expected=%q, got=%q", tt.input, expected, str.Value)
+			}
+		case *object.Error:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("%q: object is not Error. got=%T (%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected.Message {
+				t.Errorf("%q: wrong error message. expected=%q, got=%q", tt.input, expected.Message, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestStackTraces(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+		expectedFrames  []string
+	}{
+		{
+			"let add = fn(a, b) { a + b };\nlet outer = fn() {\n  let inner = fn() { add(1) };\n  inner()\n};\nouter();",
+			"wrong number of arguments: want=2, got=1",
+			[]string{"inner (3:22)", "outer (4:3)", "<main> (6:1)"},
+		},
+		{
+			"let f = fn() { len(1) };\nf()",
+			"argument to `len` not supported, got INTEGER",
+			[]string{"f (1:16)", "<main> (2:1)"},
+		},
+		{
+			"fn() { throw 1; }()",
+			"uncaught exception: 1",
+			[]string{"<anonymous> (1:8)", "<main> (1:1)"},
+		},
+		{
+			"let f = fn(x) { x + \"a\" };\nlet g = fn() { [1, f(2)] };\n1 + g();",
+			"type mismatch: INTEGER + STRING",
+			[]string{"f (1:17)", "g (2:20)", "<main> (3:5)"},
+		},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Fatalf("%q: object is not Error. got=%T (%+v)", tt.input, evaluated, evaluated)
+		}
+		rerr := errObj.RuntimeError()
+		if rerr.Message != tt.expectedMessage {
+			t.Errorf("wrong message. want=%q, got=%q", tt.expectedMessage, rerr.Message)
+		}
+		if len(rerr.Frames) != len(tt.expectedFrames) {
+			t.Fatalf("wrong number of frames. want=%d, got=%d (%v)", len(tt.expectedFrames), len(rerr.Frames), rerr.Frames)
+		}
+		for i, f := range tt.expectedFrames {
+			if rerr.Frames[i].String() != f {
+				t.Errorf("frames[%d] wrong. want=%q, got=%q", i, f, rerr.Frames[i].String())
+			}
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -533,3 +897,19 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+func TestEnvironmentBuiltins(t *testing.T) {
+	builtins := object.NewBuiltinRegistry()
+	builtins.Register("double", func(args ...object.Object) object.Object {
+		return &object.Integer{Value: 2 * args[0].(*object.Integer).Value}
+	})
+	env := object.NewEnvironment()
+	env.SetBuiltins(builtins)
+	program := parser.New(lexer.New("let f = fn(x) { double(x) }; f(len([1, 2]))")).ParseProgram()
+	testIntegerObject(t, Eval(program, env), 4)
+
+	evaluated := testEval("double(1)")
+	if err, ok := evaluated.(*object.Error); !ok || err.Message != "identifier not found: double" {
+		t.Errorf("builtin of another environment found. got=%v", evaluated)
+	}
+}
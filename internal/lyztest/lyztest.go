@@ -0,0 +1,31 @@
+// Package lyztest generates Lyz source code for the tests of several packages.
+package lyztest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Name spells i in base 26 with the letters a to z, since identifiers
+// cannot contain digits
+func Name(i int) string {
+	name := string(rune('a' + i%26))
+	for i /= 26; i > 0; i /= 26 {
+		name = string(rune('a'+i%26)) + name
+	}
+	return name
+}
+
+// WideCall returns a call of a function literal with n parameters, which it
+// copies into n locals before returning the last one. The arguments are 0 to
+// n-1, so the call evaluates to n-1.
+func WideCall(n int) string {
+	var params, args, locals []string
+	for i := 0; i < n; i++ {
+		params = append(params, "p"+Name(i))
+		args = append(args, fmt.Sprintf("%d", i))
+		locals = append(locals, fmt.Sprintf("let local%s = p%s;", Name(i), Name(i)))
+	}
+	return fmt.Sprintf("fn(%s) { %s local%s }(%s)",
+		strings.Join(params, ", "), strings.Join(locals, " "), Name(n-1), strings.Join(args, ", "))
+}
@@ -1,21 +1,62 @@
 package lexer
 
-import "lyz-lang-2nd/token"
+import (
+	"fmt"
+	"lyz-lang-2nd/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Error describes malformed input found by the lexer. The lexer returns an
+// ILLEGAL token at Pos and carries on.
+type Error struct {
+	Pos token.Position
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%s: %s", e.Pos, e.Msg) }
 
 type Lexer struct {
 	input        string
+	filename     string
 	position     int  // current position in input (points to current char)
 	readPosition int  // current reading position in input (after current char)
 	ch           byte // current char under examination
+	line         int  // line of current char
+	column       int  // column of current char
+
+	keepComments bool // return comments as COMMENT tokens instead of skipping them
+	errors       []*Error
+
+	// templates holds one entry per "${" whose closing "}" is still ahead
+	templates []template
+}
+
+type template struct {
+	start      token.Position // opening quote of the string
+	braceDepth int            // '{' opened inside the interpolation and not yet closed
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewFile("", input)
+}
+
+// NewFile creates a lexer whose token positions carry the given file name
+func NewFile(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
 func (l *Lexer) readChar() {
+	if l.readPosition > len(l.input) {
+		return // already at EOF
+	}
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -23,12 +64,89 @@ func (l *Lexer) readChar() {
 	}
 	l.position = l.readPosition
 	l.readPosition++
+	l.column++
+}
+
+// currentPosition returns the source position of the current char
+func (l *Lexer) currentPosition() token.Position {
+	return token.Position{
+		Filename: l.filename,
+		Offset:   l.position,
+		Line:     l.line,
+		Column:   l.column,
+	}
+}
+
+// KeepComments makes the lexer return comments as COMMENT tokens, so that
+// tools like a formatter can preserve them
+func (l *Lexer) KeepComments(keep bool) {
+	l.keepComments = keep
+}
+
+// Errors returns every error found so far
+func (l *Lexer) Errors() []*Error {
+	return l.errors
+}
+
+func (l *Lexer) errorf(pos token.Position, format string, a ...interface{}) {
+	l.errors = append(l.errors, &Error{Pos: pos, Msg: fmt.Sprintf(format, a...)})
 }
 
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	for {
+		l.skipWhitespaces()
 
-	l.skipWhitespaces()
+		pos := l.currentPosition()
+		var tok token.Token
+		if l.ch == '/' && (l.peekChar() == '/' || l.peekChar() == '*') {
+			tok = l.readComment()
+			if tok.Type == token.COMMENT && !l.keepComments {
+				continue
+			}
+		} else {
+			tok = l.nextToken()
+		}
+		tok.Pos = pos
+		tok.End = l.currentPosition()
+		return tok
+	}
+}
+
+// readComment reads a "//" comment up to the end of the line, or a possibly
+// nested "/* */" comment
+func (l *Lexer) readComment() token.Token {
+	pos := l.currentPosition()
+	start := l.position
+
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+		return token.Token{Type: token.COMMENT, Literal: l.input[start:l.position]}
+	}
+
+	depth := 0
+	for {
+		switch {
+		case l.ch == 0:
+			l.errorf(pos, "unterminated block comment")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start:l.position]}
+		case l.ch == '/' && l.peekChar() == '*':
+			depth++
+			l.readChar()
+		case l.ch == '*' && l.peekChar() == '/':
+			depth--
+			l.readChar()
+		}
+		l.readChar()
+		if depth == 0 {
+			return token.Token{Type: token.COMMENT, Literal: l.input[start:l.position]}
+		}
+	}
+}
+
+func (l *Lexer) nextToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '=':
@@ -40,9 +158,9 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.ASSIGN, l.ch)
 		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		tok = l.newOperatorToken(token.PLUS, token.PLUS_ASSIGN)
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		tok = l.newOperatorToken(token.MINUS, token.MINUS_ASSIGN)
 	case '!':
 		if l.peekChar() == '=' {
 			l.readChar()
@@ -52,31 +170,80 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '*' {
+			tok = l.newTwoCharToken(token.POWER)
+		} else {
+			tok = l.newOperatorToken(token.ASTERISK, token.ASTERISK_ASSIGN)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
+	case '^':
+		tok = newToken(token.BIT_XOR, l.ch)
+	case '~':
+		tok = newToken(token.TILDE, l.ch)
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		tok = l.newOperatorToken(token.SLASH, token.SLASH_ASSIGN)
 	case '(':
 		tok = newToken(token.LPAREN, l.ch)
 	case ')':
 		tok = newToken(token.RPAREN, l.ch)
 	case '{':
+		if n := len(l.templates); n > 0 {
+			l.templates[n-1].braceDepth++
+		}
 		tok = newToken(token.LBRACE, l.ch)
 	case '}':
+		if n := len(l.templates); n > 0 {
+			if l.templates[n-1].braceDepth == 0 {
+				start := l.templates[n-1].start
+				l.templates = l.templates[:n-1]
+				tok = l.readStringPart(start, true)
+				break
+			}
+			l.templates[n-1].braceDepth--
+		}
 		tok = newToken(token.RBRACE, l.ch)
 	case ',':
 		tok = newToken(token.COMMA, l.ch)
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
+	case '&':
+		if l.peekChar() == '&' {
+			tok = l.newTwoCharToken(token.AND)
+		} else {
+			tok = newToken(token.BIT_AND, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			tok = l.newTwoCharToken(token.OR)
+		} else {
+			tok = newToken(token.BIT_OR, l.ch)
+		}
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		switch l.peekChar() {
+		case '=':
+			tok = l.newTwoCharToken(token.LT_EQ)
+		case '<':
+			tok = l.newTwoCharToken(token.SHL)
+		default:
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		switch l.peekChar() {
+		case '=':
+			tok = l.newTwoCharToken(token.GT_EQ)
+		case '>':
+			tok = l.newTwoCharToken(token.SHR)
+		default:
+			tok = newToken(token.GT, l.ch)
+		}
 	case 0:
 		tok.Literal = ""
 		tok.Type = token.EOF
 	case '"':
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		tok = l.readStringPart(l.currentPosition(), false)
+	case '`':
+		tok = l.readRawString()
 	case '[':
 		tok = newToken(token.LBRACKET, l.ch)
 	case ']':
@@ -89,10 +256,10 @@ func (l *Lexer) NextToken() token.Token {
 			tok.Type = token.LookupIdent(tok.Literal)
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Type, tok.Literal = l.readNumber()
 			return tok
 		} else {
+			l.errorf(l.currentPosition(), "illegal character %q", l.ch)
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
@@ -109,12 +276,40 @@ func (l *Lexer) readIdentifier() string {
 	return l.input[pos:l.position]
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads an integer or a float with an optional fraction and
+// exponent, e.g. 5, 1.25, 3e8, 6.02E-23. An exponent marker must be followed
+// by digits, after an optional sign.
+func (l *Lexer) readNumber() (token.TokenType, string) {
+	start := l.currentPosition()
 	pos := l.position
+	var tt token.TokenType = token.INT
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tt = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		tt = token.FLOAT
+		l.readChar()
+		if l.ch == '+' || l.ch == '-' {
+			l.readChar()
+		}
+		if !isDigit(l.ch) {
+			l.errorf(start, "invalid exponent in %s", l.input[pos:l.position])
+			return token.ILLEGAL, l.input[pos:l.position]
+		}
+		l.readDigits()
+	}
+	return tt, l.input[pos:l.position]
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[pos:l.position]
 }
 
 func (l *Lexer) skipWhitespaces() {
@@ -124,10 +319,33 @@ func (l *Lexer) skipWhitespaces() {
 }
 
 func (l *Lexer) peekChar() byte {
-	if l.readPosition >= len(l.input) {
+	return l.peekCharAt(1)
+}
+
+// peekCharAt returns the char n positions after the current one
+func (l *Lexer) peekCharAt(n int) byte {
+	pos := l.position + n
+	if pos >= len(l.input) {
 		return 0
 	}
-	return l.input[l.readPosition]
+	return l.input[pos]
+}
+
+// newOperatorToken returns the compound assignment form of an operator when
+// the current char is followed by '='
+func (l *Lexer) newOperatorToken(op, opAssign token.TokenType) token.Token {
+	if l.peekChar() == '=' {
+		ch := l.ch
+		l.readChar()
+		return token.Token{Type: opAssign, Literal: string(ch) + "="}
+	}
+	return newToken(string(op), l.ch)
+}
+
+// newTwoCharToken consumes the next char as the second half of op
+func (l *Lexer) newTwoCharToken(op token.TokenType) token.Token {
+	l.readChar()
+	return token.Token{Type: op, Literal: string(op)}
 }
 
 func newToken(keywords string, ch byte) token.Token {
@@ -145,13 +363,118 @@ func isDigit(ch byte) bool {
 	return '0' <= ch && ch <= '9'
 }
 
-func (l *Lexer) readString() string {
-	pos := l.position + 1
+// readStringPart reads a double-quoted string, decoding escape sequences,
+// up to the closing quote or the next "${". The literal of the returned token
+// is the decoded text. continued is set when resuming after the "}" of an
+// interpolation, and start is the position of the opening quote.
+func (l *Lexer) readStringPart(start token.Position, continued bool) token.Token {
+	from := l.position
+	var out strings.Builder
+	valid := true
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
-			break
+		switch l.ch {
+		case '"':
+			tt := token.TokenType(token.STRING)
+			if continued {
+				tt = token.TEMPLATE_TAIL
+			}
+			if !valid {
+				tt = token.ILLEGAL
+			}
+			return token.Token{Type: tt, Literal: out.String()}
+		case '$':
+			if l.peekChar() != '{' {
+				out.WriteByte(l.ch)
+				break
+			}
+			l.readChar()
+			l.templates = append(l.templates, template{start: start})
+			tt := token.TokenType(token.TEMPLATE_HEAD)
+			if continued {
+				tt = token.TEMPLATE_MIDDLE
+			}
+			if !valid {
+				tt = token.ILLEGAL
+			}
+			return token.Token{Type: tt, Literal: out.String()}
+		case 0, '\n':
+			l.errorf(start, "unterminated string literal")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[from:l.position]}
+		case '\\':
+			if !l.readEscape(&out) {
+				valid = false
+			}
+		default:
+			out.WriteByte(l.ch)
 		}
 	}
-	return l.input[pos:l.position]
+}
+
+// readEscape decodes the escape sequence starting at the current backslash
+func (l *Lexer) readEscape(out *strings.Builder) bool {
+	pos := l.currentPosition()
+	if next := l.peekChar(); next == 0 || next == '\n' {
+		// readString reports the unterminated string
+		return true
+	}
+	l.readChar()
+	switch l.ch {
+	case 'n':
+		out.WriteByte('\n')
+	case 't':
+		out.WriteByte('\t')
+	case 'r':
+		out.WriteByte('\r')
+	case '0':
+		out.WriteByte(0)
+	case '\\', '"', '$':
+		out.WriteByte(l.ch)
+	case 'u':
+		if l.peekChar() != '{' {
+			l.errorf(pos, "invalid unicode escape, expected \\u{...}")
+			return false
+		}
+		l.readChar()
+		digits := l.position + 1
+		for isHexDigit(l.peekChar()) {
+			l.readChar()
+		}
+		hex := l.input[digits : l.position+1]
+		if l.peekChar() != '}' || len(hex) == 0 || len(hex) > 6 {
+			l.errorf(pos, "invalid unicode escape, expected 1 to 6 hex digits in \\u{...}")
+			return false
+		}
+		l.readChar()
+		r, _ := strconv.ParseUint(hex, 16, 32)
+		if !utf8.ValidRune(rune(r)) {
+			l.errorf(pos, "invalid unicode code point U+%s", strings.ToUpper(hex))
+			return false
+		}
+		out.WriteRune(rune(r))
+	default:
+		l.errorf(pos, "unknown escape sequence \\%c", l.ch)
+		return false
+	}
+	return true
+}
+
+// readRawString reads a backtick string which may span lines and has no
+// escape sequences
+func (l *Lexer) readRawString() token.Token {
+	start := l.currentPosition()
+	for {
+		l.readChar()
+		switch l.ch {
+		case '`':
+			return token.Token{Type: token.STRING, Literal: l.input[start.Offset+1 : l.position]}
+		case 0:
+			l.errorf(start, "unterminated raw string literal")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[start.Offset:l.position]}
+		}
+	}
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || ('a' <= ch && ch <= 'f') || ('A' <= ch && ch <= 'F')
 }
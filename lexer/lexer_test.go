@@ -12,7 +12,7 @@ func TestLexer(t *testing.T) {
 			x + y;
 			};
 			let result = add(five, ten);
-			!-/*5;
+			!-/ *5;
 			5 < 10 > 5;
 			if (5 < 10) {
 				return true;
@@ -134,3 +134,361 @@ func TestLexer(t *testing.T) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := "let x = 5;\n  x + \"ab\";"
+
+	tests := []struct {
+		expectedType token.TokenType
+		expectedPos  token.Position
+		expectedEnd  token.Position
+	}{
+		{token.LET, token.Position{Filename: "a.lyz", Offset: 0, Line: 1, Column: 1}, token.Position{Filename: "a.lyz", Offset: 3, Line: 1, Column: 4}},
+		{token.IDENT, token.Position{Filename: "a.lyz", Offset: 4, Line: 1, Column: 5}, token.Position{Filename: "a.lyz", Offset: 5, Line: 1, Column: 6}},
+		{token.ASSIGN, token.Position{Filename: "a.lyz", Offset: 6, Line: 1, Column: 7}, token.Position{Filename: "a.lyz", Offset: 7, Line: 1, Column: 8}},
+		{token.INT, token.Position{Filename: "a.lyz", Offset: 8, Line: 1, Column: 9}, token.Position{Filename: "a.lyz", Offset: 9, Line: 1, Column: 10}},
+		{token.SEMICOLON, token.Position{Filename: "a.lyz", Offset: 9, Line: 1, Column: 10}, token.Position{Filename: "a.lyz", Offset: 10, Line: 1, Column: 11}},
+		{token.IDENT, token.Position{Filename: "a.lyz", Offset: 13, Line: 2, Column: 3}, token.Position{Filename: "a.lyz", Offset: 14, Line: 2, Column: 4}},
+		{token.PLUS, token.Position{Filename: "a.lyz", Offset: 15, Line: 2, Column: 5}, token.Position{Filename: "a.lyz", Offset: 16, Line: 2, Column: 6}},
+		{token.STRING, token.Position{Filename: "a.lyz", Offset: 17, Line: 2, Column: 7}, token.Position{Filename: "a.lyz", Offset: 21, Line: 2, Column: 11}},
+		{token.SEMICOLON, token.Position{Filename: "a.lyz", Offset: 21, Line: 2, Column: 11}, token.Position{Filename: "a.lyz", Offset: 22, Line: 2, Column: 12}},
+		{token.EOF, token.Position{Filename: "a.lyz", Offset: 22, Line: 2, Column: 12}, token.Position{Filename: "a.lyz", Offset: 22, Line: 2, Column: 12}},
+	}
+
+	l := NewFile("a.lyz", input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Pos != tt.expectedPos {
+			t.Fatalf("tests[%d] - pos wrong. expected=%+v, got=%+v", i, tt.expectedPos, tok.Pos)
+		}
+		if tok.End != tt.expectedEnd {
+			t.Fatalf("tests[%d] - end wrong. expected=%+v, got=%+v", i, tt.expectedEnd, tok.End)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// leading comment
+let x = 1; // trailing
+/* block
+   comment */ x /* nested /* inner */ still comment */ / 2;
+`
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.COMMENT, "// leading comment"},
+		{token.LET, "let"},
+		{token.IDENT, "x"},
+		{token.ASSIGN, "="},
+		{token.INT, "1"},
+		{token.SEMICOLON, ";"},
+		{token.COMMENT, "// trailing"},
+		{token.COMMENT, "/* block\n   comment */"},
+		{token.IDENT, "x"},
+		{token.COMMENT, "/* nested /* inner */ still comment */"},
+		{token.SLASH, "/"},
+		{token.INT, "2"},
+		{token.SEMICOLON, ";"},
+		{token.EOF, ""},
+	}
+
+	for _, keep := range []bool{true, false} {
+		l := New(input)
+		l.KeepComments(keep)
+		for i, tt := range tests {
+			if !keep && tt.expectedType == token.COMMENT {
+				continue
+			}
+			tok := l.NextToken()
+			if tok.Type != tt.expectedType {
+				t.Fatalf("keep=%t tests[%d] - tokentype wrong. expected=%q, got=%q", keep, i, tt.expectedType, tok.Type)
+			}
+			if tok.Literal != tt.expectedLiteral {
+				t.Fatalf("keep=%t tests[%d] - literal wrong. expected=%q, got=%q", keep, i, tt.expectedLiteral, tok.Literal)
+			}
+		}
+		if len(l.Errors()) != 0 {
+			t.Errorf("unexpected lexer errors: %v", l.Errors())
+		}
+	}
+}
+
+func TestUnterminatedBlockComment(t *testing.T) {
+	l := New("1 /* open /* nested */")
+	l.NextToken()
+
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL {
+		t.Fatalf("tokentype wrong. expected=%q, got=%q", token.ILLEGAL, tok.Type)
+	}
+	errs := l.Errors()
+	if len(errs) != 1 {
+		t.Fatalf("wrong number of errors. want=1, got=%d", len(errs))
+	}
+	if errs[0].Error() != "1:3: unterminated block comment" {
+		t.Errorf("wrong error. got=%q", errs[0].Error())
+	}
+	if tok := l.NextToken(); tok.Type != token.EOF {
+		t.Errorf("expected EOF after unterminated comment, got=%q", tok.Type)
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	input := `5 1.25 3e8 6.02E-23 1e+2 7.x 2E0`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INT, "5"},
+		{token.FLOAT, "1.25"},
+		{token.FLOAT, "3e8"},
+		{token.FLOAT, "6.02E-23"},
+		{token.FLOAT, "1e+2"},
+		{token.INT, "7"},
+		{token.ILLEGAL, "."},
+		{token.IDENT, "x"},
+		{token.FLOAT, "2E0"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestInvalidExponents(t *testing.T) {
+	tests := []struct {
+		input    string
+		literal  string
+		expected string
+		next     token.TokenType
+	}{
+		{"2e", "2e", "1:1: invalid exponent in 2e", token.EOF},
+		{"1.5e;", "1.5e", "1:1: invalid exponent in 1.5e", token.SEMICOLON},
+		{"2e+", "2e+", "1:1: invalid exponent in 2e+", token.EOF},
+		{"x = 3E-y", "3E-", "1:5: invalid exponent in 3E-", token.IDENT},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+		for tok.Type != token.ILLEGAL && tok.Type != token.EOF {
+			tok = l.NextToken()
+		}
+		if tok.Type != token.ILLEGAL || tok.Literal != tt.literal {
+			t.Fatalf("%s: wrong token. expected ILLEGAL %q, got=%q %q", tt.input, tt.literal, tok.Type, tok.Literal)
+		}
+		errs := l.Errors()
+		if len(errs) != 1 || errs[0].Error() != tt.expected {
+			t.Errorf("%s: wrong errors. want=%q, got=%v", tt.input, tt.expected, errs)
+		}
+		if tok := l.NextToken(); tok.Type != tt.next {
+			t.Errorf("%s: wrong next token. want=%q, got=%q", tt.input, tt.next, tok.Type)
+		}
+	}
+}
+
+func TestStringEscapes(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"a\nb"`, "a\nb"},
+		{`"tab\there"`, "tab\there"},
+		{`"quote \"x\" back\\slash"`, `quote "x" back\slash`},
+		{`"\u{48}\u{e9}\u{1F600}"`, "Hé😀"},
+		{"`raw \\n \"string\"\nsecond line`", "raw \\n \"string\"\nsecond line"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+		if tok.Type != token.STRING {
+			t.Fatalf("%s: tokentype wrong. expected=%q, got=%q (%v)", tt.input, token.STRING, tok.Type, l.Errors())
+		}
+		if tok.Literal != tt.expected {
+			t.Errorf("%s: literal wrong. expected=%q, got=%q", tt.input, tt.expected, tok.Literal)
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Errorf("%s: expected EOF, got=%q", tt.input, tok.Type)
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"never closed`, "1:1: unterminated string literal"},
+		{"\"ends at\nnewline\"", "1:1: unterminated string literal"},
+		{`"trailing \`, "1:1: unterminated string literal"},
+		{`"bad \q escape"`, `1:6: unknown escape sequence \q`},
+		{`"\u{110000}"`, "1:2: invalid unicode code point U+110000"},
+		{`"\u{}"`, `1:2: invalid unicode escape, expected 1 to 6 hex digits in \u{...}`},
+		{`"\u41"`, `1:2: invalid unicode escape, expected \u{...}`},
+		{"`never closed", "1:1: unterminated raw string literal"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+		if tok.Type != token.ILLEGAL {
+			t.Fatalf("%s: tokentype wrong. expected=%q, got=%q", tt.input, token.ILLEGAL, tok.Type)
+		}
+		errs := l.Errors()
+		if len(errs) != 1 {
+			t.Fatalf("%s: wrong number of errors. want=1, got=%d (%v)", tt.input, len(errs), errs)
+		}
+		if errs[0].Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.input, tt.expected, errs[0].Error())
+		}
+	}
+}
+
+func TestInterpolatedStrings(t *testing.T) {
+	input := `"hello ${name}, you are ${age + {"a": 1}["a"]}!" "${x}" "cost: \${x} $5"`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.TEMPLATE_HEAD, "hello "},
+		{token.IDENT, "name"},
+		{token.TEMPLATE_MIDDLE, ", you are "},
+		{token.IDENT, "age"},
+		{token.PLUS, "+"},
+		{token.LBRACE, "{"},
+		{token.STRING, "a"},
+		{token.COLON, ":"},
+		{token.INT, "1"},
+		{token.RBRACE, "}"},
+		{token.LBRACKET, "["},
+		{token.STRING, "a"},
+		{token.RBRACKET, "]"},
+		{token.TEMPLATE_TAIL, "!"},
+		{token.TEMPLATE_HEAD, ""},
+		{token.IDENT, "x"},
+		{token.TEMPLATE_TAIL, ""},
+		{token.STRING, "cost: ${x} $5"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestAssignmentOperators(t *testing.T) {
+	input := `x = 1; x += 2; x -= 3; x *= 4; x /= 5; x + -1`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "x"}, {token.ASSIGN, "="}, {token.INT, "1"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PLUS_ASSIGN, "+="}, {token.INT, "2"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.MINUS_ASSIGN, "-="}, {token.INT, "3"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.ASTERISK_ASSIGN, "*="}, {token.INT, "4"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.SLASH_ASSIGN, "/="}, {token.INT, "5"}, {token.SEMICOLON, ";"},
+		{token.IDENT, "x"}, {token.PLUS, "+"}, {token.MINUS, "-"}, {token.INT, "1"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	input := `a && b || c & d | e`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.IDENT, "a"},
+		{token.AND, "&&"},
+		{token.IDENT, "b"},
+		{token.OR, "||"},
+		{token.IDENT, "c"},
+		{token.BIT_AND, "&"},
+		{token.IDENT, "d"},
+		{token.BIT_OR, "|"},
+		{token.IDENT, "e"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestArithmeticOperators(t *testing.T) {
+	input := `<= >= < > << >> % ** * *= ^ ~ & |`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LT_EQ, "<="},
+		{token.GT_EQ, ">="},
+		{token.LT, "<"},
+		{token.GT, ">"},
+		{token.SHL, "<<"},
+		{token.SHR, ">>"},
+		{token.PERCENT, "%"},
+		{token.POWER, "**"},
+		{token.ASTERISK, "*"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.BIT_XOR, "^"},
+		{token.TILDE, "~"},
+		{token.BIT_AND, "&"},
+		{token.BIT_OR, "|"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - literal wrong. expected=%q, got=%q", i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package lyz
+
+import (
+	"fmt"
+	"lyz-lang-2nd/object"
+	"math"
+	"reflect"
+)
+
+// ToObject converts a Go value to a LYZ value of the runtime's engine:
+//
+//	nil, nil pointers   null
+//	bool                boolean
+//	integers            integer, failing above math.MaxInt64
+//	float32, float64    float
+//	string              string
+//	slices and arrays   array
+//	maps                hash, whose keys must be integers, booleans or strings
+//	pointers            the value pointed to
+//	object.Object       the object itself
+//
+// Other values are an error, and so is a slice, map or pointer that
+// contains itself.
+func (r *Runtime) ToObject(v interface{}) (object.Object, error) {
+	return r.convert(v, map[visit]bool{})
+}
+
+// visit identifies a slice, map or pointer being converted
+type visit struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// convert converts v, failing if it is one of the values in visiting, which
+// contain it
+func (r *Runtime) convert(v interface{}, visiting map[visit]bool) (object.Object, error) {
+	switch v := v.(type) {
+	case nil:
+		return r.null, nil
+	case *object.Boolean:
+		// the engine only knows its own booleans and null
+		return r.boolean(v.Value), nil
+	case *object.Null:
+		return r.null, nil
+	case object.Object:
+		return v, nil
+	}
+	return r.toObject(reflect.ValueOf(v), visiting)
+}
+
+func (r *Runtime) boolean(b bool) object.Object {
+	if b {
+		return r.true
+	}
+	return r.false
+}
+
+func (r *Runtime) toObject(v reflect.Value, visiting map[visit]bool) (object.Object, error) {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map, reflect.Ptr:
+		if v.IsNil() {
+			break
+		}
+		key := visit{typ: v.Type(), ptr: v.Pointer()}
+		if v.Kind() == reflect.Slice {
+			key.len = v.Len()
+		}
+		if visiting[key] {
+			return nil, fmt.Errorf("%s contains itself", v.Type())
+		}
+		visiting[key] = true
+		defer delete(visiting, key)
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return r.boolean(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &object.Integer{Value: v.Int()}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%d overflows an integer", v.Uint())
+		}
+		return &object.Integer{Value: int64(v.Uint())}, nil
+	case reflect.Float32, reflect.Float64:
+		return &object.Float{Value: v.Float()}, nil
+	case reflect.String:
+		return &object.String{Value: v.String()}, nil
+	case reflect.Slice, reflect.Array:
+		elements := make([]object.Object, v.Len())
+		for i := range elements {
+			el, err := r.convert(v.Index(i).Interface(), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("element %d: %s", i, err)
+			}
+			elements[i] = el
+		}
+		return &object.Array{Elements: elements}, nil
+	case reflect.Map:
+		pairs := make(map[object.HashKey]object.HashPair, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, err := r.convert(iter.Key().Interface(), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("key %v: %s", iter.Key(), err)
+			}
+			hashable, ok := key.(object.Hashable)
+			if !ok {
+				return nil, fmt.Errorf("unusable as hash key: %s", key.Type())
+			}
+			value, err := r.convert(iter.Value().Interface(), visiting)
+			if err != nil {
+				return nil, fmt.Errorf("value of %v: %s", iter.Key(), err)
+			}
+			pairs[hashable.HashKey()] = object.HashPair{Key: key, Value: value}
+		}
+		return &object.Hash{Pairs: pairs}, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return r.null, nil
+		}
+		return r.convert(v.Elem().Interface(), visiting)
+	}
+	return nil, fmt.Errorf("cannot convert %s to a LYZ value", v.Type())
+}
+
+// FromObject converts a LYZ value to a Go value:
+//
+//	null      nil
+//	boolean   bool
+//	integer   int64
+//	float     float64
+//	string    string
+//	array     []interface{}
+//	hash      map[interface{}]interface{}
+//
+// The elements of arrays and hashes are converted in turn, and an array or
+// hash that contains itself gives a slice or map that does too. Other
+// values, such as functions, are returned as they are, so that they can be
+// passed back to the runtime.
+func FromObject(obj object.Object) interface{} {
+	return fromObject(obj, map[object.Object]interface{}{})
+}
+
+// fromObject converts obj, reusing the conversions in seen of the arrays and
+// hashes containing it
+func fromObject(obj object.Object, seen map[object.Object]interface{}) interface{} {
+	switch obj := obj.(type) {
+	case nil, *object.Null:
+		return nil
+	case *object.Boolean:
+		return obj.Value
+	case *object.Integer:
+		return obj.Value
+	case *object.Float:
+		return obj.Value
+	case *object.String:
+		return obj.Value
+	case *object.Array:
+		if v, ok := seen[obj]; ok {
+			return v
+		}
+		elements := make([]interface{}, len(obj.Elements))
+		seen[obj] = elements
+		for i, el := range obj.Elements {
+			elements[i] = fromObject(el, seen)
+		}
+		return elements
+	case *object.Hash:
+		if v, ok := seen[obj]; ok {
+			return v
+		}
+		m := make(map[interface{}]interface{}, len(obj.Pairs))
+		seen[obj] = m
+		for _, pair := range obj.Pairs {
+			m[fromObject(pair.Key, seen)] = fromObject(pair.Value, seen)
+		}
+		return m
+	}
+	return obj
+}
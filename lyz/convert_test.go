@@ -0,0 +1,137 @@
+package lyz
+
+import (
+	"lyz-lang-2nd/evaluator"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/vm"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToObject(t *testing.T) {
+	r := newRuntime(t, "vm")
+	n := 7
+	var nilPointer *int
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{nilPointer, "null"},
+		{&n, "7"},
+		{int8(-3), "-3"},
+		{uint64(math.MaxInt64), "9223372036854775807"},
+		{float32(0.5), "0.5"},
+		{"text", "text"},
+		{[]interface{}{1, "a", []bool{true}}, "[1, a, [true]]"},
+		{[2]string{"x", "y"}, "[x, y]"},
+		{map[int]string{1: "one"}, "{1: one}"},
+		{&object.Integer{Value: 9}, "9"},
+	}
+	for _, tt := range tests {
+		obj, err := r.ToObject(tt.input)
+		if err != nil {
+			t.Errorf("%#v: conversion failed: %s", tt.input, err)
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("%#v: got=%s, want=%s", tt.input, obj.Inspect(), tt.expected)
+		}
+	}
+
+	for _, input := range []interface{}{uint64(math.MaxInt64 + 1), struct{}{}, map[[1]int]int{{1}: 1}, []interface{}{func() {}}} {
+		if obj, err := r.ToObject(input); err == nil {
+			t.Errorf("%#v: expected an error, got=%s", input, obj.Inspect())
+		}
+	}
+}
+
+func TestToObjectCycles(t *testing.T) {
+	r := newRuntime(t, "vm")
+	slice := []interface{}{1, nil}
+	slice[1] = slice
+	hash := map[string]interface{}{}
+	hash["self"] = []interface{}{hash}
+	pointer := new(interface{})
+	*pointer = pointer
+	for _, input := range []interface{}{slice, hash, pointer} {
+		if _, err := r.ToObject(input); err == nil || !strings.Contains(err.Error(), "contains itself") {
+			t.Errorf("%T: expected a cycle error, got=%v", input, err)
+		}
+	}
+
+	// a value contained twice is no cycle
+	shared := []int{1}
+	obj, err := r.ToObject([][]int{shared, shared})
+	if err != nil {
+		t.Fatalf("conversion failed: %s", err)
+	}
+	if obj.Inspect() != "[[1], [1]]" {
+		t.Errorf("got=%s, want=[[1], [1]]", obj.Inspect())
+	}
+}
+
+func TestToObjectUsesEngineSingletons(t *testing.T) {
+	tests := []struct {
+		engine            string
+		true, false, null object.Object
+	}{
+		{"vm", vm.True, vm.False, vm.Null},
+		{"eval", evaluator.TRUE, evaluator.FALSE, evaluator.NULL},
+	}
+	for _, tt := range tests {
+		r := newRuntime(t, tt.engine)
+		for _, c := range []struct {
+			input    interface{}
+			expected object.Object
+		}{
+			{true, tt.true},
+			{false, tt.false},
+			{nil, tt.null},
+			{&object.Boolean{Value: true}, tt.true},
+			{&object.Null{}, tt.null},
+		} {
+			if obj, _ := r.ToObject(c.input); obj != c.expected {
+				t.Errorf("%s: %#v converted to another object than the engine's", tt.engine, c.input)
+			}
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	cyclic := &object.Array{}
+	cyclic.Elements = []object.Object{&object.Integer{Value: 1}, cyclic}
+	fn := &object.Builtin{}
+	hash := &object.Hash{Pairs: map[object.HashKey]object.HashPair{}}
+	for _, k := range []object.Object{&object.String{Value: "a"}, &object.Integer{Value: 2}} {
+		hash.Pairs[k.(object.Hashable).HashKey()] = object.HashPair{Key: k, Value: &object.Float{Value: 0.5}}
+	}
+
+	tests := []struct {
+		input    object.Object
+		expected interface{}
+	}{
+		{nil, nil},
+		{vm.Null, nil},
+		{evaluator.FALSE, false},
+		{&object.Integer{Value: -1}, int64(-1)},
+		{&object.String{Value: "s"}, "s"},
+		{hash, map[interface{}]interface{}{"a": 0.5, int64(2): 0.5}},
+		{fn, fn},
+	}
+	for _, tt := range tests {
+		if result := FromObject(tt.input); !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("%#v: got=%#v, want=%#v", tt.input, result, tt.expected)
+		}
+	}
+
+	result, ok := FromObject(cyclic).([]interface{})
+	if !ok || len(result) != 2 || result[0] != int64(1) {
+		t.Fatalf("cyclic array converted to %#v", result)
+	}
+	if inner, ok := result[1].([]interface{}); !ok || &inner[0] != &result[0] {
+		t.Errorf("cyclic array does not contain itself")
+	}
+}
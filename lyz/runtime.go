@@ -0,0 +1,181 @@
+// Package lyz embeds the LYZ interpreter in Go programs.
+//
+// A Runtime runs successive pieces of source sharing their global
+// variables, on the bytecode VM or on the tree-walking evaluator:
+//
+//	rt, err := lyz.NewRuntime(lyz.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	if _, err := rt.Exec("let double = fn(x) { x * 2 };"); err != nil {
+//		return err
+//	}
+//	result, err := rt.Call("double", 21) // int64(42)
+//
+// Go values are converted to LYZ values by Runtime.ToObject and back by
+// FromObject.
+package lyz
+
+import (
+	"fmt"
+	"lyz-lang-2nd/evaluator"
+	"lyz-lang-2nd/lexer"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/parser"
+	"lyz-lang-2nd/vm"
+	"strings"
+)
+
+// Options configure a Runtime
+type Options struct {
+	// Engine runs the programs: "vm", the default, or "eval"
+	Engine string
+
+	// CheckedArithmetic makes integer overflow a runtime error instead of
+	// wrapping around
+	CheckedArithmetic bool
+
+	// Filename names the source in the positions of errors
+	Filename string
+
+	// Builtins are the builtins the programs can call, such as host
+	// functions registered in a registry made by object.NewBuiltinRegistry,
+	// object.DefaultBuiltins if nil
+	Builtins *object.BuiltinRegistry
+}
+
+// Runtime runs LYZ source with the global variables left by the source run
+// before. It is not safe for concurrent use.
+type Runtime struct {
+	engine   string
+	filename string
+
+	session *vm.Session         // state of the vm engine
+	env     *object.Environment // state of the eval engine
+
+	// the values the engine compares by identity
+	true, false, null object.Object
+}
+
+// NewRuntime creates a runtime without globals
+func NewRuntime(opts Options) (*Runtime, error) {
+	r := &Runtime{engine: opts.Engine, filename: opts.Filename}
+	switch opts.Engine {
+	case "", "vm":
+		r.engine = "vm"
+		r.session = vm.NewSessionWithBuiltins(opts.Builtins)
+		r.session.SetCheckedArithmetic(opts.CheckedArithmetic)
+		r.true, r.false, r.null = vm.True, vm.False, vm.Null
+	case "eval":
+		r.env = object.NewEnvironment()
+		r.env.SetCheckedArithmetic(opts.CheckedArithmetic)
+		if opts.Builtins != nil {
+			r.env.SetBuiltins(opts.Builtins)
+		}
+		r.true, r.false, r.null = evaluator.TRUE, evaluator.FALSE, evaluator.NULL
+	default:
+		return nil, fmt.Errorf("unknown engine %q, want vm or eval", opts.Engine)
+	}
+	return r, nil
+}
+
+// Engine returns the name of the engine running the programs
+func (r *Runtime) Engine() string {
+	return r.engine
+}
+
+// ParseError lists the syntax errors of a source, each formatted as
+// "pos: message"
+type ParseError struct {
+	Errors []string
+}
+
+func (e *ParseError) Error() string {
+	return strings.Join(e.Errors, "\n")
+}
+
+// Exec runs src and returns the value of its last statement, converted by
+// FromObject, or nil if that is not an expression statement. It fails with
+// a *ParseError for invalid syntax and an *object.RuntimeError for a failure
+// at run time; the vm engine also reports compilation errors.
+func (r *Runtime) Exec(src string) (interface{}, error) {
+	p := parser.New(lexer.NewFile(r.filename, src))
+	program := p.ParseProgram()
+	if errs := p.Errs(); len(errs) != 0 {
+		return nil, &ParseError{Errors: errs}
+	}
+
+	if r.engine == "eval" {
+		result := evaluator.Eval(program, r.env)
+		if err, ok := result.(*object.Error); ok {
+			return nil, err.RuntimeError()
+		}
+		return FromObject(result), nil
+	}
+	result, err := r.session.Exec(program)
+	if err != nil {
+		return nil, err
+	}
+	return FromObject(result), nil
+}
+
+// Get returns the value of the global name, converted by FromObject
+func (r *Runtime) Get(name string) (interface{}, bool) {
+	obj, ok := r.lookup(name)
+	if !ok {
+		return nil, false
+	}
+	return FromObject(obj), true
+}
+
+func (r *Runtime) lookup(name string) (object.Object, bool) {
+	if r.engine == "eval" {
+		return r.env.Get(name)
+	}
+	return r.session.Get(name)
+}
+
+// Set assigns value, converted by ToObject, to the global name, defining it
+// if needed
+func (r *Runtime) Set(name string, value interface{}) error {
+	obj, err := r.ToObject(value)
+	if err != nil {
+		return fmt.Errorf("global %s: %s", name, err)
+	}
+	if r.engine == "eval" {
+		r.env.Set(name, obj)
+		return nil
+	}
+	return r.session.Set(name, obj)
+}
+
+// Call calls the function in the global fnName with args, converted by
+// ToObject, and returns its result converted by FromObject. A failure of
+// the function is returned as an *object.RuntimeError.
+func (r *Runtime) Call(fnName string, args ...interface{}) (interface{}, error) {
+	fn, ok := r.lookup(fnName)
+	if !ok {
+		return nil, fmt.Errorf("function %s is not defined", fnName)
+	}
+	objs := make([]object.Object, len(args))
+	for i, arg := range args {
+		obj, err := r.ToObject(arg)
+		if err != nil {
+			return nil, fmt.Errorf("argument %d of %s: %s", i, fnName, err)
+		}
+		objs[i] = obj
+	}
+
+	if r.engine == "eval" {
+		result := evaluator.Apply(fn, objs...)
+		if err, ok := result.(*object.Error); ok {
+			return nil, err.RuntimeError()
+		}
+		return FromObject(result), nil
+	}
+	result, err := r.session.Call(fn, objs...)
+	if err != nil {
+		return nil, err
+	}
+	return FromObject(result), nil
+}
@@ -0,0 +1,305 @@
+package lyz
+
+import (
+	"lyz-lang-2nd/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var engines = []string{"vm", "eval"}
+
+func newRuntime(t *testing.T, engine string) *Runtime {
+	t.Helper()
+	r, err := NewRuntime(Options{Engine: engine, Filename: "test.lyz"})
+	if err != nil {
+		t.Fatalf("NewRuntime failed: %s", err)
+	}
+	return r
+}
+
+func TestExec(t *testing.T) {
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		if _, err := r.Exec("let base = 40;"); err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		result, err := r.Exec("let add = fn(a, b) { a + b }; add(base, 2)")
+		if err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		if result != int64(42) {
+			t.Errorf("%s: result = %#v, want 42", engine, result)
+		}
+		result, err = r.Exec(`[base > 1, "s", 1.5, if (false) { 1 }]`)
+		if err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		if want := []interface{}{true, "s", 1.5, nil}; !reflect.DeepEqual(result, want) {
+			t.Errorf("%s: result = %#v, want %#v", engine, result, want)
+		}
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		_, err := r.Exec("let = 1;")
+		if perr, ok := err.(*ParseError); !ok || !strings.HasPrefix(perr.Errors[0], "test.lyz:1:") {
+			t.Errorf("%s: expected a parse error in test.lyz, got=%v", engine, err)
+		}
+
+		_, err = r.Exec("let f = fn() { 1 / 0 };\nf()")
+		rerr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expected a runtime error, got=%v", engine, err)
+		}
+		if want := "test.lyz:1:16: division by zero"; rerr.Error() != want {
+			t.Errorf("%s: error = %q, want %q", engine, rerr.Error(), want)
+		}
+	}
+
+	if _, err := NewRuntime(Options{Engine: "jit"}); err == nil {
+		t.Errorf("expected an unknown engine to be rejected")
+	}
+	r := newRuntime(t, "vm")
+	if _, err := r.Exec("undefined"); err == nil || !strings.Contains(err.Error(), "undefined") {
+		t.Errorf("expected a compilation error, got=%v", err)
+	}
+}
+
+func TestGetAndSet(t *testing.T) {
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		if _, ok := r.Get("config"); ok {
+			t.Errorf("%s: undefined global found", engine)
+		}
+		err := r.Set("config", map[string]interface{}{"name": "lyz", "sizes": []int{1, 2}, "debug": true})
+		if err != nil {
+			t.Fatalf("%s: set failed: %s", engine, err)
+		}
+		result, err := r.Exec(`let total = config["sizes"][0] + config["sizes"][1]; if (config["debug"]) { total } else { 0 }`)
+		if err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		if result != int64(3) {
+			t.Errorf("%s: result = %#v, want 3", engine, result)
+		}
+		if total, ok := r.Get("total"); !ok || total != int64(3) {
+			t.Errorf("%s: total = %#v, want 3", engine, total)
+		}
+		if err := r.Set("bad", make(chan int)); err == nil {
+			t.Errorf("%s: expected a channel to be rejected", engine)
+		}
+	}
+}
+
+func TestCall(t *testing.T) {
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		_, err := r.Exec(`
+let greet = fn(name, times) {
+	let out = [];
+	while (len(out) < times) { out = push(out, "hi " + name) }
+	out
+};
+let fail = fn() { throw "boom" };
+let counter = 0;
+let bump = fn() { counter = counter + 1; counter };
+`)
+		if err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		result, err := r.Call("greet", "bob", uint8(2))
+		if err != nil {
+			t.Fatalf("%s: call failed: %s", engine, err)
+		}
+		if want := []interface{}{"hi bob", "hi bob"}; !reflect.DeepEqual(result, want) {
+			t.Errorf("%s: result = %#v, want %#v", engine, result, want)
+		}
+
+		r.Call("bump")
+		if result, _ := r.Call("bump"); result != int64(2) {
+			t.Errorf("%s: bump = %#v, want 2", engine, result)
+		}
+		if counter, _ := r.Get("counter"); counter != int64(2) {
+			t.Errorf("%s: counter = %#v, want 2", engine, counter)
+		}
+
+		_, err = r.Call("fail")
+		rerr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expected a runtime error, got=%v", engine, err)
+		}
+		if len(rerr.Frames) != 1 || rerr.Frames[0].Function != "fail" || !strings.Contains(rerr.Message, "boom") {
+			t.Errorf("%s: wrong error: %s", engine, rerr.StackTrace())
+		}
+		if _, err := r.Call("greet", "bob"); err == nil || !strings.Contains(err.Error(), "wrong number of arguments") {
+			t.Errorf("%s: expected a wrong number of arguments, got=%v", engine, err)
+		}
+		if _, err := r.Call("missing"); err == nil {
+			t.Errorf("%s: expected calling an undefined function to fail", engine)
+		}
+		if _, err := r.Call("counter"); err == nil {
+			t.Errorf("%s: expected calling an integer to fail", engine)
+		}
+	}
+}
+
+func TestBuiltins(t *testing.T) {
+	for _, engine := range engines {
+		builtins := object.NewBuiltinRegistry()
+		var r *Runtime
+		builtins.Register("lookup", func(args ...object.Object) object.Object {
+			obj, err := r.ToObject(map[string]int{"answer": 42}[FromObject(args[0]).(string)])
+			if err != nil {
+				return &object.Error{Message: err.Error()}
+			}
+			return obj
+		})
+		r, err := NewRuntime(Options{Engine: engine, Builtins: builtins})
+		if err != nil {
+			t.Fatalf("%s: NewRuntime failed: %s", engine, err)
+		}
+		result, err := r.Exec(`let f = fn(key) { lookup(key) + len(key) }; f("answer")`)
+		if err != nil {
+			t.Fatalf("%s: exec failed: %s", engine, err)
+		}
+		if result != int64(48) {
+			t.Errorf("%s: result = %#v, want 48", engine, result)
+		}
+
+		other := newRuntime(t, engine)
+		if _, err := other.Exec(`lookup("answer")`); err == nil {
+			t.Errorf("%s: builtin of another runtime found", engine)
+		}
+	}
+}
+
+func TestLoopVariableCapture(t *testing.T) {
+	// closures made in a loop share its variable, in functions as at top level
+	inputs := []string{
+		"let fns = []; for (i in [0, 1, 2]) { fns = push(fns, fn() { i }) } [fns[0](), fns[1](), fns[2]()]",
+		"let f = fn() { let fns = []; for (i in [0, 1, 2]) { fns = push(fns, fn() { i }) } fns }; let fns = f(); [fns[0](), fns[1](), fns[2]()]",
+	}
+	for _, engine := range engines {
+		for _, input := range inputs {
+			result, err := newRuntime(t, engine).Exec(input)
+			if err != nil {
+				t.Fatalf("%s: exec failed: %s", engine, err)
+			}
+			if want := []interface{}{int64(2), int64(2), int64(2)}; !reflect.DeepEqual(result, want) {
+				t.Errorf("%s: %q = %#v, want %#v", engine, input, result, want)
+			}
+		}
+	}
+}
+
+func TestFinallyKeepsStackTrace(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { throw 1 } finally { 2 }", "test.lyz:1:7: uncaught exception: 1"},
+		{"try { 1 / 0 } finally { 2 }", "test.lyz:1:7: division by zero"},
+		{"try { throw 1 } catch (e) { throw 2 } finally { 3 }", "test.lyz:1:29: uncaught exception: 2"},
+		{"let f = fn() { try { throw 1 } finally { 2 } };\nf()", "test.lyz:1:22: uncaught exception: 1"},
+	}
+	for _, tt := range tests {
+		traces := map[string]string{}
+		for _, engine := range engines {
+			_, err := newRuntime(t, engine).Exec(tt.input)
+			rerr, ok := err.(*object.RuntimeError)
+			if !ok {
+				t.Fatalf("%s: expected a runtime error, got=%v", engine, err)
+			}
+			if rerr.Error() != tt.expected {
+				t.Errorf("%s: %q failed with %q, want %q", engine, tt.input, rerr.Error(), tt.expected)
+			}
+			traces[engine] = rerr.StackTrace()
+		}
+		if traces["vm"] != traces["eval"] {
+			t.Errorf("%q: stack traces differ:\nvm: %s\neval: %s", tt.input, traces["vm"], traces["eval"])
+		}
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		for _, input := range []string{"let g = fn() { g() }; g()", "let h = fn(n) { h(n + 1) + 1 }; h(0)"} {
+			_, err := r.Exec(input)
+			rerr, ok := err.(*object.RuntimeError)
+			if !ok {
+				t.Fatalf("%s: expected a runtime error, got=%v", engine, err)
+			}
+			if rerr.Message != "stack overflow" {
+				t.Errorf("%s: %q failed with %q, want a stack overflow", engine, input, rerr.Message)
+			}
+		}
+		if result, err := r.Exec("let f = fn(n) { if (n == 0) { 0 } else { f(n - 1) + 1 } }; f(500)"); err != nil || result != int64(500) {
+			t.Errorf("%s: recursion within the limit = %#v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestTruncatedStackTrace(t *testing.T) {
+	input := "let f = fn(n) { if (n == 0) { 1 / 0 } f(n - 1) };\nf(30)"
+	traces := map[string]string{}
+	for _, engine := range engines {
+		_, err := newRuntime(t, engine).Exec(input)
+		rerr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Fatalf("%s: expected a runtime error, got=%v", engine, err)
+		}
+		// 31 calls of f and the main function
+		if len(rerr.Frames) != 2*object.TraceEnds || rerr.Omitted != 32-2*object.TraceEnds {
+			t.Errorf("%s: wrong frames. got %d frames and %d omitted", engine, len(rerr.Frames), rerr.Omitted)
+		}
+		last := rerr.Frames[len(rerr.Frames)-1]
+		if rerr.Error() != "test.lyz:1:31: division by zero" || last.Function != object.MainFunctionName {
+			t.Errorf("%s: wrong error: %s", engine, rerr.StackTrace())
+		}
+		traces[engine] = rerr.StackTrace()
+	}
+	if traces["vm"] != traces["eval"] {
+		t.Errorf("stack traces differ:\nvm: %s\neval: %s", traces["vm"], traces["eval"])
+	}
+	if !strings.Contains(traces["vm"], "\n\t... 12 more\n\tat f (") {
+		t.Errorf("stack trace does not count the omitted frames:\n%s", traces["vm"])
+	}
+
+	for _, engine := range engines {
+		_, err := newRuntime(t, engine).Exec("let g = fn() { g() }; g()")
+		if rerr, ok := err.(*object.RuntimeError); !ok || len(rerr.Frames) != 2*object.TraceEnds {
+			t.Errorf("%s: stack overflow trace is not truncated: %v", engine, err)
+		}
+	}
+}
+
+func TestExecResultOfStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{"let x = 5;", nil},
+		{"x = 7;", nil},
+		{"x", int64(7)},
+		{"x; while (false) { }", nil},
+		{"x; try { 1 } catch (e) { 2 }", nil},
+		{"x; for (i in [1]) { i }", nil},
+		{"if (true) { x }", int64(7)},
+	}
+	for _, engine := range engines {
+		r := newRuntime(t, engine)
+		for _, tt := range tests {
+			result, err := r.Exec(tt.input)
+			if err != nil {
+				t.Fatalf("%s: exec failed: %s", engine, err)
+			}
+			if result != tt.expected {
+				t.Errorf("%s: %q = %#v, want %#v", engine, tt.input, result, tt.expected)
+			}
+		}
+	}
+}
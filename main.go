@@ -1,75 +1,385 @@
+// Command lyz runs LYZ programs and shows how they are compiled.
+//
+// Usage:
+//
+//	lyz <command> [flags] [file] [arguments]
+//
+// The commands are:
+//
+//	run      run a .lyz source file or a compiled .lyzc file
+//	repl     start the interactive interpreter
+//	compile  compile a source file to a .lyzc file
+//	disasm   print the bytecode of a source or .lyzc file
+//	ast      print the syntax tree of a source file
+//	tokens   print the tokens of a source file
+//
+// "lyz file.lyz" is short for "lyz run file.lyz" and "lyz" alone starts the
+// REPL. A file named "-" is read from standard input. The arguments after the
+// file are passed to the program in the global array args.
+//
+// The exit status is 0 on success, 1 if the program fails to parse, compile or
+// run, and 2 for invalid usage or unreadable files.
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"lyz-lang-2nd/asm"
+	"lyz-lang-2nd/ast"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/evaluator"
+	"lyz-lang-2nd/lexer"
+	"lyz-lang-2nd/object"
+	"lyz-lang-2nd/parser"
+	"lyz-lang-2nd/repl"
+	"lyz-lang-2nd/token"
+	"lyz-lang-2nd/vm"
 	"os"
 	"path/filepath"
-	"sort"
+	"strings"
 )
 
-var totalLines = 0
+// exit statuses
+const (
+	exitOK         = 0
+	exitScriptFail = 1
+	exitUsage      = 2
+)
+
+type command struct {
+	name    string
+	args    string // argument synopsis
+	summary string
+	run     func(fs *flag.FlagSet, args []string) int
+}
+
+var commands []*command
+
+func init() {
+	// assigned in init because help refers to commands
+	commands = []*command{
+		{"run", "[-engine vm|eval] [-checked] file [arguments]", "run a .lyz source file or a compiled .lyzc file", runCommand},
+		{"repl", "[-engine vm|eval]", "start the interactive interpreter", replCommand},
+		{"compile", "[-o out.lyzc] [-strip] file", "compile a source file to a .lyzc file", compileCommand},
+		{"disasm", "file", "print the bytecode of a source or .lyzc file", disasmCommand},
+		{"ast", "file", "print the syntax tree of a source file", astCommand},
+		{"tokens", "file", "print the tokens of a source file", tokensCommand},
+		{"help", "[command]", "show the usage of a command", helpCommand},
+	}
+}
 
 func main() {
-	// u, err := user.Current()
-	// if err != nil {
-	// 	log.Fatalln(err)
-	// }
-	// fmt.Printf("Hello %s! This is the LYZ programming language!\n", u.Username)
-	// fmt.Printf("Feel free to type in commands\n")
-	// repl.Start(os.Stdin, os.Stdout)
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) == 0 {
+		return replCommand(newFlagSet(lookup("repl")), nil)
+	}
+	cmd := lookup(args[0])
+	if cmd == nil {
+		if strings.HasPrefix(args[0], "-") || !isProgramFile(args[0]) {
+			fmt.Fprintf(os.Stderr, "lyz: unknown command %q\n", args[0])
+			usage(os.Stderr)
+			return exitUsage
+		}
+		cmd, args = lookup("run"), append([]string{"run"}, args...)
+	}
+	return cmd.run(newFlagSet(cmd), args[1:])
+}
+
+func lookup(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func isProgramFile(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".lyz" || ext == ".lyzc"
+}
 
-	fss := []fs{}
-	walkDir(".", &fss)
-	
-	sort.Slice(fss, func(i, j int) bool {
-		return fss[j].lines < fss[i].lines
-	})
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet("lyz "+cmd.name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: lyz %s %s\n", cmd.name, cmd.args)
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
-	for _, v := range fss {
-		log.Printf("%s: %d\n", v.path, v.lines)
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: lyz <command> [flags] [file] [arguments]\n\ncommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-8s %s\n", cmd.name, cmd.summary)
 	}
-	log.Printf("the total lines in source code: %d\n", totalLines)
 }
 
-func walkDir(dir string, fss *[]fs) {
-	fis, err := ioutil.ReadDir(dir)
+// parseFlags parses the flags of a command that takes a file followed by at
+// most maxArgs arguments, or any number if maxArgs is negative
+func parseFlags(fs *flag.FlagSet, args []string, maxArgs int) (file string, rest []string, ok bool) {
+	if err := fs.Parse(args); err != nil {
+		return "", nil, false
+	}
+	if fs.NArg() == 0 || (maxArgs >= 0 && fs.NArg()-1 > maxArgs) {
+		fs.Usage()
+		return "", nil, false
+	}
+	return fs.Arg(0), fs.Args()[1:], true
+}
+
+func fail(format string, a ...interface{}) int {
+	fmt.Fprintf(os.Stderr, "lyz: "+format+"\n", a...)
+	return exitUsage
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// loaded is a program read from a source or .lyzc file
+type loaded struct {
+	source   string
+	program  *ast.Program       // nil for a .lyzc file
+	bytecode *compiler.Bytecode // nil until compiled
+	symbols  *compiler.SymbolTable
+}
+
+// load reads and parses a source file or unmarshals a .lyzc file, reporting
+// failures on stderr
+func load(path string) (*loaded, int) {
+	data, err := readFile(path)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, fail("%s", err)
+	}
+	if bytes.HasPrefix(data, []byte(compiler.BytecodeMagic)) {
+		bytecode, err := compiler.Unmarshal(data)
+		if err != nil {
+			return nil, fail("%s: %s", path, err)
+		}
+		if err := vm.Verify(bytecode); err != nil {
+			return nil, fail("%s: %s", path, err)
+		}
+		return &loaded{bytecode: bytecode}, exitOK
+	}
+
+	source := string(data)
+	p := parser.New(lexer.NewFile(path, source))
+	program := p.ParseProgram()
+	if errs := p.Errs(); len(errs) != 0 {
+		for _, msg := range errs {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		return nil, exitScriptFail
+	}
+	return &loaded{source: source, program: program}, exitOK
+}
+
+// compile compiles the program unless it was loaded from a .lyzc file. The
+// global args is defined first, so that it is global 0 in every compiled
+// program.
+func (l *loaded) compile() int {
+	if l.bytecode != nil {
+		return exitOK
+	}
+	l.symbols = compiler.NewSymbolTable()
+	l.symbols.DefineBuiltins(nil)
+	l.symbols.Define("args")
+	comp := compiler.NewWithState(l.symbols, []object.Object{})
+	if err := comp.Compile(l.program); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitScriptFail
+	}
+	l.bytecode = comp.Bytecode()
+	return exitOK
+}
+
+// scriptArgs converts the arguments after the file into the args array
+func scriptArgs(file string, args []string) *object.Array {
+	elements := []object.Object{&object.String{Value: file}}
+	for _, arg := range args {
+		elements = append(elements, &object.String{Value: arg})
+	}
+	return &object.Array{Elements: elements}
+}
+
+func runCommand(fs *flag.FlagSet, args []string) int {
+	engine := fs.String("engine", "vm", "execute with the `engine` vm or eval")
+	checked := fs.Bool("checked", false, "report integer overflow as a runtime error")
+	file, rest, ok := parseFlags(fs, args, -1)
+	if !ok {
+		return exitUsage
+	}
+	if *engine != "vm" && *engine != "eval" {
+		return fail("unknown engine %q, want vm or eval", *engine)
 	}
+	l, status := load(file)
+	if l == nil {
+		return status
+	}
+	argv := scriptArgs(file, rest)
 
-	for _, fi := range fis {
-		path := filepath.Join(dir, fi.Name())
-		if path == ".git" {
-			continue
+	if *engine == "eval" {
+		if l.program == nil {
+			return fail("%s: compiled programs only run on the vm engine", file)
 		}
-		if fi.IsDir() {
-			walkDir(path, fss)
+		env := object.NewEnvironment()
+		env.SetCheckedArithmetic(*checked)
+		env.Set("args", argv)
+		if err, ok := evaluator.Eval(l.program, env).(*object.Error); ok {
+			fmt.Fprintln(os.Stderr, err.RuntimeError().StackTrace())
+			return exitScriptFail
 		}
-		ext := filepath.Ext(path)
-		if ext != ".go" {
-			continue
+		return exitOK
+	}
+
+	if status := l.compile(); status != exitOK {
+		return status
+	}
+	globals := make([]object.Object, vm.GlobalSize)
+	globals[0] = argv
+	machine := vm.NewWithGlobalsStore(l.bytecode, globals)
+	machine.SetCheckedArithmetic(*checked)
+	if err := machine.Run(); err != nil {
+		if rerr, ok := err.(*object.RuntimeError); ok {
+			fmt.Fprintln(os.Stderr, rerr.StackTrace())
+		} else {
+			fmt.Fprintln(os.Stderr, err)
 		}
-		f, err := os.Open(path)
-		if err != nil {
-			log.Println(err)
-			return
+		return exitScriptFail
+	}
+	return exitOK
+}
+
+func replCommand(fs *flag.FlagSet, args []string) int {
+	engine := fs.String("engine", "vm", "execute with the `engine` vm or eval")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return exitUsage
+	}
+	if *engine != "vm" && *engine != "eval" {
+		return fail("unknown engine %q, want vm or eval", *engine)
+	}
+	repl.StartEngine(os.Stdin, os.Stdout, *engine)
+	return exitOK
+}
+
+func compileCommand(fs *flag.FlagSet, args []string) int {
+	out := fs.String("o", "", "write the bytecode to `file` instead of the source name with a .lyzc extension")
+	strip := fs.Bool("strip", false, "leave out names and source maps")
+	file, _, ok := parseFlags(fs, args, 0)
+	if !ok {
+		return exitUsage
+	}
+	if *out == "" {
+		if file == "-" {
+			return fail("compiling standard input needs -o")
 		}
-		defer f.Close()
-		count := 0
-		scan := bufio.NewScanner(f)
-		for scan.Scan() {
-			count++
-			totalLines++
+		*out = strings.TrimSuffix(file, filepath.Ext(file)) + ".lyzc"
+	}
+	l, status := load(file)
+	if l == nil {
+		return status
+	}
+	if l.program == nil {
+		return fail("%s is already compiled", file)
+	}
+	if status := l.compile(); status != exitOK {
+		return status
+	}
+	data, err := compiler.Marshal(l.bytecode, !*strip)
+	if err != nil {
+		return fail("%s", err)
+	}
+	if err := ioutil.WriteFile(*out, data, 0644); err != nil {
+		return fail("%s", err)
+	}
+	return exitOK
+}
+
+func disasmCommand(fs *flag.FlagSet, args []string) int {
+	file, _, ok := parseFlags(fs, args, 0)
+	if !ok {
+		return exitUsage
+	}
+	l, status := load(file)
+	if l == nil {
+		return status
+	}
+	if status := l.compile(); status != exitOK {
+		return status
+	}
+	text, err := asm.DisassembleWith(l.bytecode, asm.Options{Symbols: l.symbols, Source: l.source})
+	if err != nil {
+		return fail("%s", err)
+	}
+	fmt.Print(text)
+	return exitOK
+}
+
+func astCommand(fs *flag.FlagSet, args []string) int {
+	file, _, ok := parseFlags(fs, args, 0)
+	if !ok {
+		return exitUsage
+	}
+	l, status := load(file)
+	if l == nil {
+		return status
+	}
+	if l.program == nil {
+		return fail("%s is compiled and has no syntax tree", file)
+	}
+	for _, stmt := range l.program.Statements {
+		fmt.Printf("%s\t%s\n", stmt.Pos(), stmt)
+	}
+	return exitOK
+}
+
+func tokensCommand(fs *flag.FlagSet, args []string) int {
+	file, _, ok := parseFlags(fs, args, 0)
+	if !ok {
+		return exitUsage
+	}
+	data, err := readFile(file)
+	if err != nil {
+		return fail("%s", err)
+	}
+	l := lexer.NewFile(file, string(data))
+	for {
+		tok := l.NextToken()
+		fmt.Printf("%s\t%s\t%q\n", tok.Pos, tok.Type, tok.Literal)
+		if tok.Type == token.EOF {
+			return exitOK
 		}
-		// log.Printf("%s: %d\n", path, count)
-		*fss = append(*fss, fs{path: path, lines: count})
-	}	
+	}
 }
 
-type fs struct {
-	path string
-	lines int
-}
\ No newline at end of file
+func helpCommand(fs *flag.FlagSet, args []string) int {
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() == 0 {
+		usage(os.Stdout)
+		return exitOK
+	}
+	cmd := lookup(fs.Arg(0))
+	if cmd == nil {
+		return fail("unknown command %q", fs.Arg(0))
+	}
+	help := newFlagSet(cmd)
+	help.SetOutput(os.Stdout)
+	cmd.run(help, []string{"-h"})
+	return exitOK
+}
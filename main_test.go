@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExitStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, source string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ok := write("ok.lyz", `if (len(args) != 2 || len(args[1]) != 1) { throw "wrong args"; }`)
+	syntax := write("syntax.lyz", "let x = ;")
+	failing := write("fail.lyz", "let f = fn() { 1 / 0 }; f()")
+	compiled := filepath.Join(dir, "ok.lyzc")
+
+	tests := []struct {
+		args     []string
+		expected int
+	}{
+		{[]string{"run", ok, "a"}, exitOK},
+		{[]string{ok, "a"}, exitOK},
+		{[]string{"run", "-engine", "eval", ok, "a"}, exitOK},
+		{[]string{"run", ok}, exitScriptFail},
+		{[]string{"run", "-engine", "eval", ok, "bb"}, exitScriptFail},
+		{[]string{"compile", "-o", compiled, ok}, exitOK},
+		{[]string{"run", compiled, "a"}, exitOK},
+		{[]string{"run", "-engine", "eval", compiled, "a"}, exitUsage},
+		{[]string{"run", syntax}, exitScriptFail},
+		{[]string{"run", failing}, exitScriptFail},
+		{[]string{"run", "-engine", "eval", failing}, exitScriptFail},
+		{[]string{"run", filepath.Join(dir, "missing.lyz")}, exitUsage},
+		{[]string{"run", "-engine", "js", ok}, exitUsage},
+		{[]string{"run"}, exitUsage},
+		{[]string{"bogus"}, exitUsage},
+	}
+	for _, tt := range tests {
+		if got := run(tt.args); got != tt.expected {
+			t.Errorf("lyz %v: wrong exit status. want=%d, got=%d", tt.args, tt.expected, got)
+		}
+	}
+}
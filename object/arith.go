@@ -0,0 +1,63 @@
+package object
+
+import "math"
+
+// The Checked functions perform int64 arithmetic, returning the wrapped
+// result and false when it overflows
+
+func CheckedAdd(a, b int64) (int64, bool) {
+	c := a + b
+	return c, (c > a) == (b > 0)
+}
+
+func CheckedSub(a, b int64) (int64, bool) {
+	c := a - b
+	return c, (c < a) == (b > 0)
+}
+
+func CheckedMul(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if (a == -1 && b == math.MinInt64) || (b == -1 && a == math.MinInt64) {
+		return c, false
+	}
+	return c, c/b == a
+}
+
+// CheckedDiv panics if b is zero, like the / operator
+func CheckedDiv(a, b int64) (int64, bool) {
+	return a / b, !(a == math.MinInt64 && b == -1)
+}
+
+func CheckedNeg(a int64) (int64, bool) {
+	return -a, a != math.MinInt64
+}
+
+// CheckedShl shifts a left by n >= 0 bits
+func CheckedShl(a int64, n int64) (int64, bool) {
+	if n >= 64 {
+		return 0, a == 0
+	}
+	c := a << uint64(n)
+	return c, c>>uint64(n) == a
+}
+
+// CheckedPow computes base ** exp for exp >= 0 by repeated squaring
+func CheckedPow(base, exp int64) (int64, bool) {
+	result, ok := int64(1), true
+	for exp > 0 {
+		var stepOk bool
+		if exp&1 == 1 {
+			result, stepOk = CheckedMul(result, base)
+			ok = ok && stepOk
+		}
+		exp >>= 1
+		if exp > 0 {
+			base, stepOk = CheckedMul(base, base)
+			ok = ok && stepOk
+		}
+	}
+	return result, ok
+}
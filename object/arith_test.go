@@ -0,0 +1,42 @@
+package object
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		name     string
+		fn       func() (int64, bool)
+		expected int64
+		ok       bool
+	}{
+		{"add", func() (int64, bool) { return CheckedAdd(1, 2) }, 3, true},
+		{"add overflow", func() (int64, bool) { return CheckedAdd(math.MaxInt64, 1) }, math.MinInt64, false},
+		{"add underflow", func() (int64, bool) { return CheckedAdd(math.MinInt64, -1) }, math.MaxInt64, false},
+		{"sub", func() (int64, bool) { return CheckedSub(1, 2) }, -1, true},
+		{"sub overflow", func() (int64, bool) { return CheckedSub(math.MinInt64, 1) }, math.MaxInt64, false},
+		{"mul", func() (int64, bool) { return CheckedMul(-3, 4) }, -12, true},
+		{"mul overflow", func() (int64, bool) { return CheckedMul(math.MaxInt64, 2) }, -2, false},
+		{"mul min by -1", func() (int64, bool) { return CheckedMul(math.MinInt64, -1) }, math.MinInt64, false},
+		{"div", func() (int64, bool) { return CheckedDiv(-7, 2) }, -3, true},
+		{"div min by -1", func() (int64, bool) { return CheckedDiv(math.MinInt64, -1) }, math.MinInt64, false},
+		{"neg", func() (int64, bool) { return CheckedNeg(5) }, -5, true},
+		{"neg min", func() (int64, bool) { return CheckedNeg(math.MinInt64) }, math.MinInt64, false},
+		{"shl", func() (int64, bool) { return CheckedShl(3, 4) }, 48, true},
+		{"shl overflow", func() (int64, bool) { return CheckedShl(1, 63) }, math.MinInt64, false},
+		{"shl wide", func() (int64, bool) { return CheckedShl(1, 64) }, 0, false},
+		{"pow", func() (int64, bool) { return CheckedPow(3, 4) }, 81, true},
+		{"pow zero", func() (int64, bool) { return CheckedPow(0, 0) }, 1, true},
+		{"pow overflow", func() (int64, bool) { return CheckedPow(2, 63) }, math.MinInt64, false},
+		{"pow negative base", func() (int64, bool) { return CheckedPow(-2, 63) }, math.MinInt64, true},
+	}
+
+	for _, tt := range tests {
+		result, ok := tt.fn()
+		if result != tt.expected || ok != tt.ok {
+			t.Errorf("%s: want=(%d, %t), got=(%d, %t)", tt.name, tt.expected, tt.ok, result, ok)
+		}
+	}
+}
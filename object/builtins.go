@@ -2,7 +2,8 @@ package object
 
 import "fmt"
 
-// Builtins functions used by vm, compiler and evaluator
+// Builtins functions used by vm, compiler and evaluator by default, see
+// DefaultBuiltins
 var Builtins = []struct {
 	Name    string
 	Builtin *Builtin
@@ -116,6 +117,77 @@ func GetBuiltinByName(name string) *Builtin {
 	return nil
 }
 
+// BuiltinRegistry holds the builtins a program can call. Compiled code
+// refers to a builtin by its index, so a program must run with the registry
+// it was compiled with. The zero value is an empty registry.
+type BuiltinRegistry struct {
+	names    []string
+	builtins []*Builtin
+	indices  map[string]int
+}
+
+// DefaultBuiltins returns a new registry holding Builtins. The compilers, VMs
+// and environments that are not given a registry use one, so registering a
+// host function in it never changes the builtins of other programs.
+func DefaultBuiltins() *BuiltinRegistry {
+	return NewBuiltinRegistry()
+}
+
+// NewBuiltinRegistry creates a registry holding Builtins, at the same
+// indices as in DefaultBuiltins
+func NewBuiltinRegistry() *BuiltinRegistry {
+	r := &BuiltinRegistry{}
+	for _, b := range Builtins {
+		r.add(b.Name, b.Builtin)
+	}
+	return r
+}
+
+// Register adds fn as the builtin name and returns its index. A builtin of
+// the same name is replaced, keeping its index.
+func (r *BuiltinRegistry) Register(name string, fn BuiltinFunction) int {
+	return r.add(name, &Builtin{Fn: fn})
+}
+
+func (r *BuiltinRegistry) add(name string, b *Builtin) int {
+	if r.indices == nil {
+		r.indices = map[string]int{}
+	}
+	if i, ok := r.indices[name]; ok {
+		r.builtins[i] = b
+		return i
+	}
+	r.indices[name] = len(r.names)
+	r.names = append(r.names, name)
+	r.builtins = append(r.builtins, b)
+	return len(r.names) - 1
+}
+
+// Len returns the number of builtins
+func (r *BuiltinRegistry) Len() int { return len(r.names) }
+
+// Name returns the name of the builtin at index
+func (r *BuiltinRegistry) Name(index int) string { return r.names[index] }
+
+// Get returns the builtin at index
+func (r *BuiltinRegistry) Get(index int) *Builtin { return r.builtins[index] }
+
+// Lookup returns the index of the builtin name
+func (r *BuiltinRegistry) Lookup(name string) (int, bool) {
+	i, ok := r.indices[name]
+	return i, ok
+}
+
+// IndexOf returns the index of b
+func (r *BuiltinRegistry) IndexOf(b *Builtin) (int, bool) {
+	for i, builtin := range r.builtins {
+		if builtin == b {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 func newError(format string, a ...interface{}) *Error {
 	return &Error{Message: fmt.Sprintf(format, a...)}
 }
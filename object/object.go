@@ -6,6 +6,10 @@ import (
 	"hash/fnv"
 	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/token"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -13,6 +17,7 @@ type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
@@ -24,6 +29,10 @@ const (
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION"
 	CLOSURE_OBJ           = "CLOSURE"
+	ITERATOR_OBJ          = "ITERATOR"
+	BREAK_OBJ             = "BREAK"
+	CONTINUE_OBJ          = "CONTINUE"
+	CELL_OBJ              = "CELL"
 )
 
 // Object interface
@@ -45,6 +54,36 @@ func (i *Integer) Type() ObjectType { return ObjectType(INTEGER_OBJ) }
 
 func (i *Integer) HashKey() HashKey { return HashKey{Type: i.Type(), Value: uint64(i.Value)} }
 
+// Float object
+type Float struct {
+	Value float64
+}
+
+// Inspect function
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
+// Type function
+func (f *Float) Type() ObjectType { return ObjectType(FLOAT_OBJ) }
+
+// HashKey function. A float holding an integral value hashes like the equal
+// Integer, so 1 and 1.0 address the same hash entry.
+func (f *Float) HashKey() HashKey {
+	v := f.Value
+	if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+		return (&Integer{Value: int64(v)}).HashKey()
+	}
+	if math.IsNaN(v) {
+		v = math.NaN()
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(v)}
+}
+
 // Boolean object
 type Boolean struct {
 	Value bool
@@ -86,9 +125,58 @@ func (rv *ReturnValue) Inspect() string { return rv.Value.Inspect() }
 // Type function
 func (rv *ReturnValue) Type() ObjectType { return ObjectType(RETURN_VALUE_OBJ) }
 
+// Break object signals a break statement to the enclosing loop
+type Break struct{}
+
+// Inspect function
+func (b *Break) Inspect() string { return "break" }
+
+// Type function
+func (b *Break) Type() ObjectType { return ObjectType(BREAK_OBJ) }
+
+// Continue object signals a continue statement to the enclosing loop
+type Continue struct{}
+
+// Inspect function
+func (c *Continue) Inspect() string { return "continue" }
+
+// Type function
+func (c *Continue) Type() ObjectType { return ObjectType(CONTINUE_OBJ) }
+
 // Error object
 type Error struct {
 	Message string
+	Value   Object // the value passed to throw, nil for runtime errors
+
+	// Pos is where the error surfaced in the innermost function it has not
+	// yet propagated out of, and Trace holds the functions it has left
+	Pos     token.Position
+	Trace   []StackFrame
+	Omitted int // frames left out of Trace, see AddFrame
+}
+
+// RuntimeError returns the error with its stack trace
+func (e *Error) RuntimeError() *RuntimeError {
+	frames := append([]StackFrame{}, e.Trace...)
+	return &RuntimeError{Message: e.Message, Frames: frames, Omitted: e.Omitted}
+}
+
+// NewThrownError wraps a value raised by throw. A thrown Error is rethrown
+// unchanged.
+func NewThrownError(value Object) *Error {
+	if err, ok := value.(*Error); ok {
+		return err
+	}
+	return &Error{Message: "uncaught exception: " + value.Inspect(), Value: value}
+}
+
+// Thrown returns the value a catch clause binds for the error: the thrown
+// value, or the message of a runtime error
+func (e *Error) Thrown() Object {
+	if e.Value != nil {
+		return e.Value
+	}
+	return &String{Value: e.Message}
 }
 
 // Inspect function
@@ -101,18 +189,57 @@ func (e *Error) Type() ObjectType { return ObjectType(ERROR_OBJ) }
 type Environment struct {
 	store map[string]Object
 	outer *Environment
+
+	checkedArithmetic bool
+	builtins          *BuiltinRegistry
+	depth             int // function calls the code evaluated in it is nested in
 }
 
 // NewEnclosedEnvironment function
 func NewEnclosedEnvironment(outer *Environment) *Environment {
-	newEnv := NewEnvironment()
-	newEnv.outer = outer
-	return newEnv
+	return &Environment{
+		store:             map[string]Object{},
+		outer:             outer,
+		checkedArithmetic: outer.checkedArithmetic,
+		builtins:          outer.builtins,
+	}
+}
+
+// SetCheckedArithmetic makes integer overflow an error instead of wrapping
+// around for code evaluated in e and the environments enclosed by it later
+func (e *Environment) SetCheckedArithmetic(checked bool) {
+	e.checkedArithmetic = checked
+}
+
+// CheckedArithmetic reports whether integer overflow is an error
+func (e *Environment) CheckedArithmetic() bool {
+	return e.checkedArithmetic
+}
+
+// SetDepth records that code evaluated in e runs inside depth function calls
+func (e *Environment) SetDepth(depth int) {
+	e.depth = depth
+}
+
+// Depth returns the number of function calls code evaluated in e runs inside
+func (e *Environment) Depth() int {
+	return e.depth
+}
+
+// SetBuiltins makes the builtins of builtins, instead of DefaultBuiltins,
+// callable from code evaluated in e and the environments enclosed by it later
+func (e *Environment) SetBuiltins(builtins *BuiltinRegistry) {
+	e.builtins = builtins
+}
+
+// Builtins returns the builtins callable from code evaluated in e
+func (e *Environment) Builtins() *BuiltinRegistry {
+	return e.builtins
 }
 
 // NewEnvironment function
 func NewEnvironment() *Environment {
-	return &Environment{store: map[string]Object{}}
+	return &Environment{store: map[string]Object{}, builtins: DefaultBuiltins()}
 }
 
 // Get function
@@ -130,8 +257,33 @@ func (e *Environment) Set(name string, obj Object) Object {
 	return obj
 }
 
+// Names returns the sorted names bound in e, not counting the environments
+// enclosing it
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Assign function updates an existing binding in the innermost environment
+// that defines name, reporting whether one was found
+func (e *Environment) Assign(name string, obj Object) bool {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = obj
+		return true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, obj)
+	}
+	return false
+}
+
 // Function object
 type Function struct {
+	Name       string
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
@@ -244,6 +396,13 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	Name          string // name of the function literal, if it was bound by let
+	SourceMap     code.SourceMap
+	Handlers      []code.ExceptionHandler // indexed by the operand of OpTry
+
+	// names of the local and free variables by index, for debugging
+	LocalNames []string
+	FreeNames  []string
 }
 
 // Type function
@@ -267,3 +426,56 @@ func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("closure[%p]", c)
 }
+
+// Cell object holds a local variable captured by a closure, so that
+// assignments are seen by both the closure and the enclosing function
+type Cell struct {
+	Value Object
+}
+
+// Type function
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+
+// Inspect function
+func (c *Cell) Inspect() string { return fmt.Sprintf("cell[%s]", c.Value.Inspect()) }
+
+// Iterator object holds the state of a for-in loop in the vm
+type Iterator struct {
+	Elements []Object
+	Index    int
+}
+
+// Type function
+func (it *Iterator) Type() ObjectType { return ITERATOR_OBJ }
+
+// Inspect function
+func (it *Iterator) Inspect() string {
+	return fmt.Sprintf("iterator[%d/%d]", it.Index, len(it.Elements))
+}
+
+// Next returns the next element, or false once the iterator is exhausted
+func (it *Iterator) Next() (Object, bool) {
+	if it.Index >= len(it.Elements) {
+		return nil, false
+	}
+	elem := it.Elements[it.Index]
+	it.Index++
+	return elem, true
+}
+
+// NewIterator creates an iterator over the elements of an array or the
+// characters of a string
+func NewIterator(obj Object) (*Iterator, bool) {
+	switch obj := obj.(type) {
+	case *Array:
+		return &Iterator{Elements: obj.Elements}, true
+	case *String:
+		elems := []Object{}
+		for _, r := range obj.Value {
+			elems = append(elems, &String{Value: string(r)})
+		}
+		return &Iterator{Elements: elems}, true
+	default:
+		return nil, false
+	}
+}
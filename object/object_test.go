@@ -1,13 +1,19 @@
 package object
 
-import "testing"
+import (
+	"fmt"
+	"lyz-lang-2nd/token"
+	"math"
+	"strings"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello World"}
 	hello2 := &String{Value: "Hello World"}
 	diff1 := &String{Value: "My name is johnny"}
 	diff2 := &String{Value: "My name is johnny"}
-	
+
 	if hello1.HashKey() != hello2.HashKey() {
 		t.Errorf("strings with same content have different hash keys")
 	}
@@ -18,3 +24,131 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestFloatHashKey(t *testing.T) {
+	half1 := &Float{Value: 0.5}
+	half2 := &Float{Value: 0.5}
+	one := &Float{Value: 1.0}
+
+	if half1.HashKey() != half2.HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+	if half1.HashKey() == one.HashKey() {
+		t.Errorf("floats with different value have same hash keys")
+	}
+	if one.HashKey() != (&Integer{Value: 1}).HashKey() {
+		t.Errorf("integral float does not hash like the equal integer")
+	}
+	if (&Float{Value: 0}).HashKey() != (&Float{Value: math.Copysign(0, -1)}).HashKey() {
+		t.Errorf("0.0 and -0.0 have different hash keys")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{1.5, "1.5"},
+		{2, "2.0"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+	for _, tt := range tests {
+		if got := (&Float{Value: tt.value}).Inspect(); got != tt.expected {
+			t.Errorf("wrong Inspect. want=%q, got=%q", tt.expected, got)
+		}
+	}
+}
+
+func TestRuntimeErrorFormatting(t *testing.T) {
+	err := &RuntimeError{
+		Message: "boom",
+		Frames: []StackFrame{
+			{Function: "f", Pos: token.Position{Line: 2, Column: 3}},
+			{Function: MainFunctionName, Pos: token.Position{Line: 5, Column: 1}},
+		},
+	}
+	if err.Error() != "2:3: boom" {
+		t.Errorf("wrong Error(). got=%q", err.Error())
+	}
+	expected := "boom\n\tat f (2:3)\n\tat <main> (5:1)"
+	if err.StackTrace() != expected {
+		t.Errorf("wrong StackTrace(). want=%q, got=%q", expected, err.StackTrace())
+	}
+
+	var frames []StackFrame
+	omitted := 0
+	for i := 0; i < 2*TraceEnds+3; i++ {
+		frames, omitted = AddFrame(frames, omitted, StackFrame{Function: fmt.Sprintf("f%d", i)})
+	}
+	if len(frames) != 2*TraceEnds || omitted != 3 {
+		t.Fatalf("wrong truncation. got %d frames and %d omitted", len(frames), omitted)
+	}
+	if frames[TraceEnds-1].Function != fmt.Sprintf("f%d", TraceEnds-1) || frames[TraceEnds].Function != fmt.Sprintf("f%d", TraceEnds+3) {
+		t.Errorf("wrong frames kept: %v", frames)
+	}
+	deep := &RuntimeError{Message: "boom", Frames: frames, Omitted: omitted}
+	if !strings.Contains(deep.StackTrace(), fmt.Sprintf("\n\t... 3 more\n\tat f%d ", TraceEnds+3)) {
+		t.Errorf("wrong StackTrace() of a truncated trace:\n%s", deep.StackTrace())
+	}
+
+	bare := &RuntimeError{Message: "boom"}
+	if bare.Error() != "boom" {
+		t.Errorf("wrong Error() without frames. got=%q", bare.Error())
+	}
+}
+
+func TestEnvironmentNames(t *testing.T) {
+	outer := NewEnvironment()
+	outer.Set("outer", &Null{})
+	env := NewEnclosedEnvironment(outer)
+	env.Set("b", &Null{})
+	env.Set("a", &Null{})
+
+	names := env.Names()
+	if len(names) != 2 || names[0] != "a" || names[1] != "b" {
+		t.Errorf("wrong names. want=[a b], got=%v", names)
+	}
+}
+
+func TestBuiltinRegistry(t *testing.T) {
+	r, defaults := NewBuiltinRegistry(), DefaultBuiltins()
+	if r.Len() != len(Builtins) || defaults.Len() != len(Builtins) {
+		t.Fatalf("wrong number of default builtins. want=%d, got=%d", len(Builtins), r.Len())
+	}
+	for i, b := range Builtins {
+		if r.Name(i) != b.Name || r.Get(i) != b.Builtin {
+			t.Errorf("builtin %d is not %s", i, b.Name)
+		}
+	}
+
+	hello := func(args ...Object) Object { return &String{Value: "hello"} }
+	if i := r.Register("hello", hello); i != len(Builtins) {
+		t.Errorf("hello registered at %d, want %d", i, len(Builtins))
+	}
+	if _, ok := defaults.Lookup("hello"); ok {
+		t.Errorf("registering changed the default builtins")
+	}
+	defaults.Register("hello", hello)
+	if _, ok := DefaultBuiltins().Lookup("hello"); ok {
+		t.Errorf("registering in the default builtins changed those of others")
+	}
+	if i := r.Register("puts", hello); i != 1 || r.Get(1).Fn().Inspect() != "hello" {
+		t.Errorf("puts not replaced at its index")
+	}
+	if i, ok := r.IndexOf(r.Get(len(Builtins))); !ok || i != len(Builtins) {
+		t.Errorf("IndexOf(hello) = %d, %t", i, ok)
+	}
+	if _, ok := r.IndexOf(&Builtin{Fn: hello}); ok {
+		t.Errorf("unregistered builtin found")
+	}
+
+	var empty BuiltinRegistry
+	if _, ok := empty.Lookup("len"); ok || empty.Len() != 0 {
+		t.Errorf("zero registry is not empty")
+	}
+	if i := empty.Register("len", hello); i != 0 {
+		t.Errorf("len registered at %d in an empty registry", i)
+	}
+}
@@ -0,0 +1,82 @@
+package object
+
+import (
+	"fmt"
+	"lyz-lang-2nd/token"
+	"strings"
+)
+
+// Names used in stack traces for code that is not inside a named function
+const (
+	MainFunctionName      = "<main>"
+	AnonymousFunctionName = "<anonymous>"
+)
+
+// StackFrame is one entry of a stack trace: the function being executed and
+// the position it had reached
+type StackFrame struct {
+	Function string
+	Pos      token.Position
+}
+
+func (f StackFrame) String() string {
+	return fmt.Sprintf("%s (%s)", f.Function, f.Pos)
+}
+
+// TraceEnds is the number of innermost and of outermost frames a stack trace
+// keeps. The frames between them are only counted.
+const TraceEnds = 10
+
+// AddFrame appends f to frames as the outermost frame of a stack trace. Once
+// the trace holds 2*TraceEnds frames, the innermost frame that is not among
+// the first TraceEnds is dropped and counted in omitted.
+func AddFrame(frames []StackFrame, omitted int, f StackFrame) ([]StackFrame, int) {
+	if len(frames) >= 2*TraceEnds {
+		copy(frames[TraceEnds:], frames[TraceEnds+1:])
+		frames = frames[:len(frames)-1]
+		omitted++
+	}
+	return append(frames, f), omitted
+}
+
+// RuntimeError is an error that aborted a program, together with the call
+// stack at the point it was raised, innermost frame first. Both the VM and
+// the evaluator report failures in this shape. Deep stacks are cut down to
+// their ends by AddFrame, and Omitted counts the frames left out after the
+// first TraceEnds.
+type RuntimeError struct {
+	Message string
+	Frames  []StackFrame
+	Omitted int
+}
+
+// Error formats the error as "pos: message" using the innermost frame
+func (e *RuntimeError) Error() string {
+	if len(e.Frames) == 0 || !e.Frames[0].Pos.IsValid() {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Frames[0].Pos, e.Message)
+}
+
+// StackTrace formats the message followed by one "at" line per frame and a
+// "... N more" line in place of the omitted frames
+func (e *RuntimeError) StackTrace() string {
+	var out strings.Builder
+	out.WriteString(e.Message)
+	for i, f := range e.Frames {
+		if i == TraceEnds && e.Omitted > 0 {
+			fmt.Fprintf(&out, "\n\t... %d more", e.Omitted)
+		}
+		out.WriteString("\n\tat ")
+		out.WriteString(f.String())
+	}
+	return out.String()
+}
+
+// FunctionName returns the name to show for a function in a stack trace
+func FunctionName(name string) string {
+	if name == "" {
+		return AnonymousFunctionName
+	}
+	return name
+}
@@ -0,0 +1,50 @@
+package parser
+
+import (
+	"fmt"
+	"lyz-lang-2nd/token"
+	"strings"
+)
+
+type Severity int
+
+const (
+	SeverityError Severity = iota
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+// Diagnostic is a problem found while parsing, located by a source span
+type Diagnostic struct {
+	Severity Severity
+	Message  string
+	Pos      token.Position
+	End      token.Position
+	Expected []token.TokenType // token types that would have been accepted, if known
+	Got      token.TokenType   // token type actually found, if relevant
+	Hint     string            // optional suggestion for fixing the problem
+}
+
+// String formats the diagnostic as "pos: message"
+func (d *Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Pos, d.Message)
+}
+
+// Verbose formats the diagnostic including its severity and hint
+func (d *Diagnostic) Verbose() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%s: %s: %s", d.Pos, d.Severity, d.Message)
+	if d.Hint != "" {
+		fmt.Fprintf(&out, " (hint: %s)", d.Hint)
+	}
+	return out.String()
+}
+
+func (d *Diagnostic) Error() string { return d.String() }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/lexer"
+	"lyz-lang-2nd/token"
 	"testing"
 )
 
@@ -275,6 +276,46 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"-1 * 2 + 3",
 			"(((-1) * 2) + 3)",
 		},
+		{
+			"a | b ^ c & d == e",
+			"(a | (b ^ (c & (d == e))))",
+		},
+		{
+			"a << 1 + 2 < b >> c",
+			"((a << (1 + 2)) < (b >> c))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a * b % c",
+			"((a * b) % c)",
+		},
+		{
+			"2 ** 3 ** 2",
+			"(2 ** (3 ** 2))",
+		},
+		{
+			"-2 ** 2 * 3",
+			"((-(2 ** 2)) * 3)",
+		},
+		{
+			"2 ** -1",
+			"(2 ** (-1))",
+		},
+		{
+			"~a & b",
+			"((~a) & b)",
+		},
+		{
+			"a || b && c == d",
+			"(a || (b && (c == d)))",
+		},
+		{
+			"a && b || !c && d < e",
+			"((a && b) || ((!c) && (d < e)))",
+		},
 		{
 			"-a * b",
 			"((-a) * b)",
@@ -966,3 +1007,391 @@ func TestFunctionLiteralWithName(t *testing.T) {
 			function.Name)
 	}
 }
+
+func TestNodePositions(t *testing.T) {
+	tests := []struct {
+		input       string
+		expectedPos string
+		expectedEnd string
+	}{
+		{"x", "1:1", "1:2"},
+		{"  1 + 2 * 3;", "1:3", "1:12"},
+		{"add(1, 2)", "1:1", "1:10"},
+		{"let x = [1, 2];", "1:1", "1:15"},
+		{"arr[0]", "1:1", "1:7"},
+		{`{"a": 1}`, "1:1", "1:9"},
+		{"if (x) {\n  y\n} else {\n  z\n}", "1:1", "5:2"},
+		{"fn(a) {\n a }", "1:1", "2:5"},
+		{"return -a;", "1:1", "1:10"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+		stmt := program.Statements[0]
+		if stmt.Pos().String() != tt.expectedPos {
+			t.Errorf("%q: wrong Pos. want=%s, got=%s", tt.input, tt.expectedPos, stmt.Pos())
+		}
+		if stmt.End().String() != tt.expectedEnd {
+			t.Errorf("%q: wrong End. want=%s, got=%s", tt.input, tt.expectedEnd, stmt.End())
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	input := "let x = 5;\nlet = 10;"
+	l := lexer.NewFile("test.lyz", input)
+	p := New(l)
+	p.ParseProgram()
+
+	errs := p.Errs()
+	if len(errs) == 0 {
+		t.Fatalf("expected parser errors, got none")
+	}
+	expected := "test.lyz:2:5: expected next token to be IDENT, got = instead"
+	if errs[0] != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, errs[0])
+	}
+}
+
+func TestErrorRecovery(t *testing.T) {
+	tests := []struct {
+		input              string
+		expectedErrors     []string
+		expectedStatements string
+	}{
+		{
+			"let = 5; let y = 10; let 3; z",
+			[]string{
+				"1:5: expected next token to be IDENT, got = instead",
+				"1:26: expected next token to be IDENT, got INT instead",
+			},
+			"let y = 10;z",
+		},
+		{
+			"let f = fn() { let = 1; 2 }; let g = ;",
+			[]string{
+				"1:20: expected next token to be IDENT, got = instead",
+				"1:38: no prefix parse function for ; found",
+			},
+			"",
+		},
+		{
+			"let h = {1 2}; let k = 3;",
+			[]string{"1:12: expected next token to be :, got INT instead"},
+			"let k = 3;",
+		},
+		{
+			"fn() { let x = }\nlet y = 2;",
+			[]string{"1:16: no prefix parse function for } found"},
+			"let y = 2;",
+		},
+		{
+			"fn(a, b",
+			[]string{"1:8: expected next token to be ), got EOF instead"},
+			"",
+		},
+		{
+			"fn() { 1",
+			[]string{"1:9: expected } to close block, got EOF instead"},
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+
+		errs := p.Errs()
+		if len(errs) != len(tt.expectedErrors) {
+			t.Fatalf("%q: wrong number of errors. want=%d, got=%d (%q)", tt.input, len(tt.expectedErrors), len(errs), errs)
+		}
+		for i, want := range tt.expectedErrors {
+			if errs[i] != want {
+				t.Errorf("%q: wrong error %d. want=%q, got=%q", tt.input, i, want, errs[i])
+			}
+		}
+		for _, stmt := range program.Statements {
+			if stmt == nil {
+				t.Fatalf("%q: program contains nil statement", tt.input)
+			}
+		}
+		if program.String() != tt.expectedStatements {
+			t.Errorf("%q: wrong statements. want=%q, got=%q", tt.input, tt.expectedStatements, program.String())
+		}
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	l := lexer.New("add(1, 2")
+	p := New(l)
+	p.ParseProgram()
+
+	diags := p.Diagnostics()
+	if len(diags) != 1 {
+		t.Fatalf("wrong number of diagnostics. want=1, got=%d", len(diags))
+	}
+	d := diags[0]
+	if d.Severity != SeverityError {
+		t.Errorf("wrong severity. got=%s", d.Severity)
+	}
+	if len(d.Expected) != 1 || d.Expected[0] != token.RPAREN {
+		t.Errorf("wrong expected tokens. got=%v", d.Expected)
+	}
+	if d.Got != token.EOF {
+		t.Errorf("wrong got token. got=%s", d.Got)
+	}
+	if d.Pos.String() != "1:9" {
+		t.Errorf("wrong position. got=%s", d.Pos)
+	}
+	if d.Hint == "" {
+		t.Errorf("expected a fix hint")
+	}
+}
+
+func TestCommentsAreIgnored(t *testing.T) {
+	input := `
+// add two numbers
+let add = fn(a, b) { /* sum */ a + b };
+add(1, 2); // call it
+`
+	l := lexer.New(input)
+	l.KeepComments(true)
+	p := New(l)
+	program := p.ParseProgram()
+	checkErrors(t, p)
+
+	if program.String() != "let add = fn<add>(a,b)(a + b);add(1, 2)" {
+		t.Errorf("wrong program. got=%q", program.String())
+	}
+}
+
+func TestLexerErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x = 1 @ 2;", "1:11: illegal character '@'"},
+		{"let x = 1; /* never closed", "1:12: unterminated block comment"},
+		{`let s = "abc`, "1:9: unterminated string literal"},
+		{`let s = "a\qb"; let t = 1;`, `1:11: unknown escape sequence \q`},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errs := p.Errs()
+		if len(errs) != 1 {
+			t.Fatalf("%q: wrong number of errors. want=1, got=%d (%q)", tt.input, len(errs), errs)
+		}
+		if errs[0] != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, errs[0])
+		}
+	}
+}
+
+func TestFloatLiteralExpression(t *testing.T) {
+	l := lexer.New("2.5e1;")
+	p := New(l)
+	program := p.ParseProgram()
+	checkErrors(t, p)
+
+	stmt := program.Statements[0].(*ast.ExpressionStatement)
+	literal, ok := stmt.Expression.(*ast.FloatLiteral)
+	if !ok {
+		t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+	}
+	if literal.Value != 25 {
+		t.Errorf("literal.Value not %g. got=%g", 25.0, literal.Value)
+	}
+	if literal.TokenLiteral() != "2.5e1" {
+		t.Errorf("literal.TokenLiteral not %s. got=%s", "2.5e1", literal.TokenLiteral())
+	}
+}
+
+func TestInterpolatedStringParsing(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		partCount int
+	}{
+		{`"hello ${name}!"`, "hello ${name}!", 3},
+		{`"${a + b * 2}"`, "${(a + (b * 2))}", 1},
+		{`"x=${"inner ${y}"} done"`, "x=${inner ${y}} done", 3},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		is, ok := stmt.Expression.(*ast.InterpolatedString)
+		if !ok {
+			t.Fatalf("exp not *ast.InterpolatedString. got=%T", stmt.Expression)
+		}
+		if is.String() != tt.expected {
+			t.Errorf("wrong String(). want=%q, got=%q", tt.expected, is.String())
+		}
+		if len(is.Parts) != tt.partCount {
+			t.Errorf("wrong number of parts. want=%d, got=%d", tt.partCount, len(is.Parts))
+		}
+	}
+
+	p := New(lexer.New(`"a ${x y}"; let z = 1;`))
+	program := p.ParseProgram()
+	errs := p.Errs()
+	if len(errs) != 1 || errs[0] != "1:8: expected } to close interpolation, got IDENT instead" {
+		t.Errorf("wrong errors for unclosed interpolation. got=%q", errs)
+	}
+	if program.String() != "let z = 1;" {
+		t.Errorf("parser did not recover. got=%q", program.String())
+	}
+}
+
+func TestLoopStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"while (x < 10) { x; }", "while(x < 10) x"},
+		{"for (x in [1, 2]) { break; continue; }", "for(x in [1, 2]) break;continue;"},
+		{"while (true) { fn() { 1 }; while (a) { break } }", "whiletrue fn()1whilea break;"},
+		{"while (false) { };", "whilefalse "},
+		{"for (x in y) { x };", "for(x in y) x"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkErrors(t, p)
+
+		if len(program.Statements) != 1 {
+			t.Fatalf("program.Statements does not contain 1 statements. got=%d", len(program.Statements))
+		}
+		if program.String() != tt.expected {
+			t.Errorf("wrong program. want=%q, got=%q", tt.expected, program.String())
+		}
+	}
+}
+
+func TestBreakOutsideLoop(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"break;", "1:1: break outside loop"},
+		{"if (true) { continue; }", "1:13: continue outside loop"},
+		{"while (true) { fn() { break; } }", "1:23: break outside loop"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errs := p.Errs()
+		if len(errs) != 1 {
+			t.Fatalf("%q: wrong number of errors. want=1, got=%d (%q)", tt.input, len(errs), errs)
+		}
+		if errs[0] != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, errs[0])
+		}
+	}
+}
+
+func TestAssignStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"x = 5;", "x = 5;"},
+		{"x += y * 2", "x += (y * 2);"},
+		{"x -= 1; y /= 2", "x -= 1;y /= 2;"},
+		{"arr[1 + 1] = fn(x) { x }", "(arr[(1 + 1)]) = fn(x)x;"},
+		{"h[\"a\"] = h[\"b\"]", "(h[a]) = (h[b]);"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkErrors(t, p)
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestAssignStatementErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"1 = 2;", "1:1: cannot assign to 1"},
+		{"f() = 2;", "1:1: cannot assign to f()"},
+		{"a[0] += 1;", "1:6: operator += not supported on index expressions"},
+		// partly parsed targets
+		{"-(x = 1);", "1:5: expected next token to be ), got = instead"},
+		{"!(a = 1;", "1:5: expected next token to be ), got = instead"},
+		{"let x = 1; -(x = 2);", "1:16: expected next token to be ), got = instead"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errs := p.Errs()
+		if len(errs) != 1 {
+			t.Fatalf("%q: wrong number of errors. want=1, got=%d (%q)", tt.input, len(errs), errs)
+		}
+		if errs[0] != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, errs[0])
+		}
+	}
+}
+
+func TestTryStatements(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { f(); } catch (e) { g(e); }", "try f() catch(e) g(e)"},
+		{"try { f(); } finally { g(); }", "try f() finally g()"},
+		{"try { f() } catch (err) { 1 } finally { 2 }", "try f() catch(err) 1 finally 2"},
+		{"try { 1 } catch (e) { 2 };", "try 1 catch(e) 2"},
+		{"try { 1 } finally { 2 }; 3", "try 1 finally 23"},
+		{"throw 1 + 2;", "throw (1 + 2);"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		program := p.ParseProgram()
+		checkErrors(t, p)
+		if program.String() != tt.expected {
+			t.Errorf("%q: expected=%q, got=%q", tt.input, tt.expected, program.String())
+		}
+	}
+}
+
+func TestTryStatementErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"try { f(); } let x = 1;", "1:1: try without catch or finally"},
+		{"try { f(); } catch { g(); }", "1:20: expected next token to be (, got { instead"},
+		{"try { f(); } catch (1) { g(); }", "1:21: expected next token to be IDENT, got INT instead"},
+	}
+	for _, tt := range tests {
+		p := New(lexer.New(tt.input))
+		p.ParseProgram()
+		errs := p.Errs()
+		if len(errs) != 1 {
+			t.Fatalf("%q: wrong number of errors. want=1, got=%d (%q)", tt.input, len(errs), errs)
+		}
+		if errs[0] != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, errs[0])
+		}
+	}
+}
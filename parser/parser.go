@@ -11,24 +11,42 @@ import (
 const (
 	_ int = iota
 	LOWEST
+	LOGICAL_OR  // ||
+	LOGICAL_AND // &&
+	BITWISE_OR  // |
+	BITWISE_XOR // ^
+	BITWISE_AND // &
 	EQUALS      // ==
 	LESSGREATER // > or <
+	SHIFT       // << or >>
 	SUM         // +
 	PRODUCT     // *
 	PREFIX      // -X or !X
+	POWER       // X ** Y, binds tighter than a prefix operator on its left
 	CALL        // myFunction(X)
 	INDEX       // myArray[I]
 )
 
 var precedences = map[token.TokenType]int{
+	token.OR:       LOGICAL_OR,
+	token.AND:      LOGICAL_AND,
+	token.BIT_OR:   BITWISE_OR,
+	token.BIT_XOR:  BITWISE_XOR,
+	token.BIT_AND:  BITWISE_AND,
 	token.EQ:       EQUALS,
 	token.NOT_EQ:   EQUALS,
 	token.LT:       LESSGREATER,
 	token.GT:       LESSGREATER,
+	token.LT_EQ:    LESSGREATER,
+	token.GT_EQ:    LESSGREATER,
+	token.SHL:      SHIFT,
+	token.SHR:      SHIFT,
 	token.PLUS:     SUM,
 	token.MINUS:    SUM,
 	token.SLASH:    PRODUCT,
 	token.ASTERISK: PRODUCT,
+	token.PERCENT:  PRODUCT,
+	token.POWER:    POWER,
 	token.LPAREN:   CALL,
 	token.LBRACKET: INDEX,
 }
@@ -44,28 +62,41 @@ type Parser struct {
 	curToken  token.Token
 	peekToken token.Token
 
-	errs []string
+	// braceDepth counts the '{' not yet closed up to and including curToken
+	braceDepth int
+
+	// loopDepth counts the loops enclosing curToken within the current function
+	loopDepth int
+
+	diagnostics []*Diagnostic
+	// panicMode suppresses further errors until the parser resynchronizes
+	// at the end of the broken statement
+	panicMode bool
 
 	prefixParseFns map[token.TokenType]prefixParseFn
 	infixParseFns  map[token.TokenType]infixParseFn
 }
 
 func New(l *lexer.Lexer) *Parser {
-	p := &Parser{l: l, errs: []string{}}
+	p := &Parser{l: l, diagnostics: []*Diagnostic{}}
 
 	p.prefixParseFns = make(map[token.TokenType]prefixParseFn)
 	p.registerPrefix(token.IDENT, p.parseIdentifier)
 	p.registerPrefix(token.INT, p.parseIntegerLiteral)
+	p.registerPrefix(token.FLOAT, p.parseFloatLiteral)
 	p.registerPrefix(token.BANG, p.parsePrefixExpression)
 	p.registerPrefix(token.MINUS, p.parsePrefixExpression)
+	p.registerPrefix(token.TILDE, p.parsePrefixExpression)
 	p.registerPrefix(token.TRUE, p.parseBoolean)
 	p.registerPrefix(token.FALSE, p.parseBoolean)
 	p.registerPrefix(token.LPAREN, p.parseGroupedExpression)
 	p.registerPrefix(token.IF, p.parseIfExpression)
 	p.registerPrefix(token.FUNCTION, p.parseFunctionLiteral)
 	p.registerPrefix(token.STRING, p.parseStringLiteral)
+	p.registerPrefix(token.TEMPLATE_HEAD, p.parseInterpolatedString)
 	p.registerPrefix(token.LBRACKET, p.parseArrayLiteral)
 	p.registerPrefix(token.LBRACE, p.parseHashLiteral)
+	p.registerPrefix(token.ILLEGAL, p.parseIllegal)
 
 	p.infixParseFns = make(map[token.TokenType]infixParseFn)
 	p.registerInfix(token.PLUS, p.parseInfixExpression)
@@ -76,6 +107,17 @@ func New(l *lexer.Lexer) *Parser {
 	p.registerInfix(token.NOT_EQ, p.parseInfixExpression)
 	p.registerInfix(token.LT, p.parseInfixExpression)
 	p.registerInfix(token.GT, p.parseInfixExpression)
+	p.registerInfix(token.AND, p.parseInfixExpression)
+	p.registerInfix(token.OR, p.parseInfixExpression)
+	p.registerInfix(token.LT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.GT_EQ, p.parseInfixExpression)
+	p.registerInfix(token.PERCENT, p.parseInfixExpression)
+	p.registerInfix(token.POWER, p.parseInfixExpression)
+	p.registerInfix(token.BIT_AND, p.parseInfixExpression)
+	p.registerInfix(token.BIT_OR, p.parseInfixExpression)
+	p.registerInfix(token.BIT_XOR, p.parseInfixExpression)
+	p.registerInfix(token.SHL, p.parseInfixExpression)
+	p.registerInfix(token.SHR, p.parseInfixExpression)
 	p.registerInfix(token.LPAREN, p.parseCallExpression)
 	p.registerInfix(token.LBRACKET, p.parseIndexExpression)
 	p.nextToken()
@@ -108,6 +150,7 @@ func (p *Parser) parseHashLiteral() ast.Expression {
 	if !p.expectPeek(token.RBRACE) {
 		return nil
 	}
+	hl.Rbrace = p.curToken
 
 	return hl
 }
@@ -120,6 +163,7 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 	if !p.expectPeek(token.RBRACKET) {
 		return nil
 	}
+	ie.Rbrack = p.curToken
 
 	return ie
 }
@@ -127,6 +171,9 @@ func (p *Parser) parseIndexExpression(left ast.Expression) ast.Expression {
 func (p *Parser) parseArrayLiteral() ast.Expression {
 	al := &ast.ArrayLiteral{Token: p.curToken}
 	al.Elements = p.parseExpressionList(token.RBRACKET)
+	if p.curTokenIs(token.RBRACKET) {
+		al.Rbrack = p.curToken
+	}
 	return al
 }
 
@@ -154,6 +201,9 @@ func (p *Parser) parseExpressionList(end token.TokenType) []ast.Expression {
 func (p *Parser) parseCallExpression(function ast.Expression) ast.Expression {
 	exp := &ast.CallExpression{Token: p.curToken, Function: function}
 	exp.Arguments = p.parseExpressionList(token.RPAREN)
+	if p.curTokenIs(token.RPAREN) {
+		exp.Rparen = p.curToken
+	}
 	return exp
 }
 
@@ -171,7 +221,10 @@ func (p *Parser) parseFunctionLiteral() ast.Expression {
 		return nil
 	}
 
+	outerLoopDepth := p.loopDepth
+	p.loopDepth = 0
 	fl.Body = p.parseBlockStatement()
+	p.loopDepth = outerLoopDepth
 
 	return fl
 }
@@ -186,19 +239,19 @@ func (p *Parser) parseFunctionParameters() []*ast.Identifier {
 	if !p.expectPeek(token.IDENT) {
 		return nil
 	}
+	params = append(params, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
 
 	// fn(x,y)
-	for !p.curTokenIs(token.RPAREN) {
-		ident := &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
-		params = append(params, ident)
-
+	for p.peekTokenIs(token.COMMA) {
 		p.nextToken()
-		if p.curTokenIs(token.COMMA) {
-			if !p.peekTokenIs(token.IDENT) {
-				return nil
-			}
-			p.nextToken()
+		if !p.expectPeek(token.IDENT) {
+			return nil
 		}
+		params = append(params, &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal})
+	}
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
 	}
 
 	return params
@@ -236,14 +289,31 @@ func (p *Parser) parseIfExpression() ast.Expression {
 
 func (p *Parser) parseBlockStatement() *ast.BlockStatement {
 	bs := &ast.BlockStatement{Token: p.curToken, Statements: []ast.Statement{}}
+	depth := p.braceDepth
 	p.nextToken()
 	for !p.curTokenIs(token.RBRACE) && !p.curTokenIs(token.EOF) {
 		stm := p.parseStatement()
 		if stm != nil {
 			bs.Statements = append(bs.Statements, stm)
 		}
+		if p.braceDepth < depth {
+			// a broken statement ran into our closing brace
+			break
+		}
 		p.nextToken()
 	}
+	if !p.curTokenIs(token.RBRACE) {
+		p.addDiagnostic(&Diagnostic{
+			Message:  fmt.Sprintf("expected %s to close block, got %s instead", token.RBRACE, p.curToken.Type),
+			Pos:      p.curToken.Pos,
+			End:      p.curToken.End,
+			Expected: []token.TokenType{token.RBRACE},
+			Got:      p.curToken.Type,
+			Hint:     fmt.Sprintf("the block opened at %s is never closed", bs.Token.Pos),
+		})
+		return nil
+	}
+	bs.Rbrace = p.curToken
 	return bs
 }
 
@@ -270,6 +340,19 @@ func (p *Parser) curPrecedence() int {
 	return LOWEST
 }
 
+// parseIllegal reports the first lexer error found inside an ILLEGAL token
+func (p *Parser) parseIllegal() ast.Expression {
+	tok := p.curToken
+	for _, e := range p.l.Errors() {
+		if e.Pos.Offset >= tok.Pos.Offset && (e.Pos.Offset < tok.End.Offset || e.Pos == tok.Pos) {
+			p.addDiagnostic(&Diagnostic{Message: e.Msg, Pos: e.Pos, End: tok.End, Got: tok.Type})
+			return nil
+		}
+	}
+	p.errorf(tok, "illegal token %q", tok.Literal)
+	return nil
+}
+
 func (p *Parser) parseIdentifier() ast.Expression {
 	return &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
 }
@@ -278,17 +361,59 @@ func (p *Parser) parseIntegerLiteral() ast.Expression {
 	// defer untrace(trace("parseIntegerLiteral"))
 	v, err := strconv.ParseInt(p.curToken.Literal, 0, 64)
 	if err != nil {
-		msg := fmt.Sprintf("could not parse %q as integer", p.curToken.Literal)
-		p.errs = append(p.errs, msg)
+		p.errorf(p.curToken, "could not parse %q as integer", p.curToken.Literal)
 		return nil
 	}
 	return &ast.IntegerLiteral{Token: p.curToken, Value: v}
 }
 
+func (p *Parser) parseFloatLiteral() ast.Expression {
+	v, err := strconv.ParseFloat(p.curToken.Literal, 64)
+	if err != nil {
+		p.errorf(p.curToken, "could not parse %q as float", p.curToken.Literal)
+		return nil
+	}
+	return &ast.FloatLiteral{Token: p.curToken, Value: v}
+}
+
 func (p *Parser) parseStringLiteral() ast.Expression {
 	return &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal}
 }
 
+// "a ${x} b ${y}"
+func (p *Parser) parseInterpolatedString() ast.Expression {
+	is := &ast.InterpolatedString{Token: p.curToken}
+	for {
+		if p.curToken.Literal != "" {
+			is.Parts = append(is.Parts, &ast.StringLiteral{Token: p.curToken, Value: p.curToken.Literal})
+		}
+		if p.curTokenIs(token.TEMPLATE_TAIL) {
+			is.Tail = p.curToken
+			return is
+		}
+
+		p.nextToken()
+		exp := p.parseExpression(LOWEST)
+		if exp == nil {
+			return nil
+		}
+		is.Parts = append(is.Parts, exp)
+
+		if !p.peekTokenIs(token.TEMPLATE_MIDDLE) && !p.peekTokenIs(token.TEMPLATE_TAIL) {
+			p.addDiagnostic(&Diagnostic{
+				Message:  fmt.Sprintf("expected } to close interpolation, got %s instead", p.peekToken.Type),
+				Pos:      p.peekToken.Pos,
+				End:      p.peekToken.End,
+				Expected: []token.TokenType{token.TEMPLATE_MIDDLE, token.TEMPLATE_TAIL},
+				Got:      p.peekToken.Type,
+				Hint:     fmt.Sprintf("the interpolation opened at %s is never closed", is.Token.Pos),
+			})
+			return nil
+		}
+		p.nextToken()
+	}
+}
+
 func (p *Parser) parsePrefixExpression() ast.Expression {
 	// defer untrace(trace("parsePrefixExpression"))
 	pe := &ast.PrefixExpression{Token: p.curToken, Operator: p.curToken.Literal}
@@ -305,23 +430,93 @@ func (p *Parser) parseInfixExpression(left ast.Expression) ast.Expression {
 		Left:     left,
 	}
 	curPrecedence := p.curPrecedence()
+	if ie.Operator == token.POWER {
+		// ** is right-associative: 2 ** 3 ** 2 == 2 ** (3 ** 2)
+		curPrecedence--
+	}
 	p.nextToken()
 	ie.Right = p.parseExpression(curPrecedence)
 	return ie
 }
 
+// Errs returns the messages of all error diagnostics
 func (p *Parser) Errs() []string {
-	return p.errs
+	errs := []string{}
+	for _, d := range p.diagnostics {
+		if d.Severity == SeverityError {
+			errs = append(errs, d.String())
+		}
+	}
+	return errs
+}
+
+// Diagnostics returns every diagnostic reported while parsing
+func (p *Parser) Diagnostics() []*Diagnostic {
+	return p.diagnostics
+}
+
+// addDiagnostic records d unless the parser is still recovering from an
+// earlier error in the same statement
+func (p *Parser) addDiagnostic(d *Diagnostic) {
+	if d.Severity == SeverityError {
+		if p.panicMode {
+			return
+		}
+		p.panicMode = true
+	}
+	p.diagnostics = append(p.diagnostics, d)
+}
+
+func (p *Parser) errorCount() int {
+	n := 0
+	for _, d := range p.diagnostics {
+		if d.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// errorf records an error located at tok
+func (p *Parser) errorf(tok token.Token, format string, a ...interface{}) {
+	p.addDiagnostic(&Diagnostic{
+		Message: fmt.Sprintf(format, a...),
+		Pos:     tok.Pos,
+		End:     tok.End,
+		Got:     tok.Type,
+	})
 }
 
 func (p *Parser) peekError(t token.TokenType) {
-	err := fmt.Sprintf(fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type))
-	p.errs = append(p.errs, err)
+	d := &Diagnostic{
+		Message:  fmt.Sprintf("expected next token to be %s, got %s instead", t, p.peekToken.Type),
+		Pos:      p.peekToken.Pos,
+		End:      p.peekToken.End,
+		Expected: []token.TokenType{t},
+		Got:      p.peekToken.Type,
+	}
+	switch t {
+	case token.RPAREN, token.RBRACKET, token.RBRACE:
+		d.Hint = fmt.Sprintf("insert the missing %q", t)
+	}
+	p.addDiagnostic(d)
 }
 
 func (p *Parser) nextToken() {
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	for p.peekToken.Type == token.COMMENT {
+		p.peekToken = p.l.NextToken()
+	}
+
+	switch p.curToken.Type {
+	case token.LBRACE:
+		p.braceDepth++
+	case token.RBRACE:
+		if p.braceDepth > 0 {
+			p.braceDepth--
+		}
+	}
 }
 
 func (p *Parser) ParseProgram() *ast.Program {
@@ -336,14 +531,78 @@ func (p *Parser) ParseProgram() *ast.Program {
 	return prog
 }
 
+// parseStatement parses one statement, leaving curToken on its last token.
+// A statement containing a syntax error is dropped and the parser skips ahead
+// to where the next statement is likely to begin.
 func (p *Parser) parseStatement() ast.Statement {
+	depth := p.braceDepth
+	if p.curTokenIs(token.LBRACE) {
+		depth--
+	}
+	errCount := p.errorCount()
+
+	var stm ast.Statement
 	switch p.curToken.Type {
 	case token.LET:
-		return p.parseLetStatement()
+		if s := p.parseLetStatement(); s != nil {
+			stm = s
+		}
 	case token.RETURN:
-		return p.parseReturnStatement()
+		if s := p.parseReturnStatement(); s != nil {
+			stm = s
+		}
+	case token.WHILE:
+		if s := p.parseWhileStatement(); s != nil {
+			stm = s
+		}
+	case token.FOR:
+		if s := p.parseForStatement(); s != nil {
+			stm = s
+		}
+	case token.BREAK:
+		if s := p.parseBreakStatement(); s != nil {
+			stm = s
+		}
+	case token.CONTINUE:
+		if s := p.parseContinueStatement(); s != nil {
+			stm = s
+		}
+	case token.TRY:
+		if s := p.parseTryStatement(); s != nil {
+			stm = s
+		}
+	case token.THROW:
+		if s := p.parseThrowStatement(); s != nil {
+			stm = s
+		}
 	default:
-		return p.parseExpressionStatement()
+		stm = p.parseExpressionStatement()
+	}
+
+	if p.errorCount() > errCount {
+		p.synchronize(depth)
+		return nil
+	}
+	return stm
+}
+
+// synchronize skips tokens until curToken ends the statement that started at
+// the given brace depth: a ';', the token before a closing '}' or a
+// statement keyword, or EOF
+func (p *Parser) synchronize(depth int) {
+	defer func() { p.panicMode = false }()
+
+	for !p.curTokenIs(token.EOF) && p.braceDepth >= depth {
+		if p.braceDepth == depth {
+			if p.curTokenIs(token.SEMICOLON) {
+				return
+			}
+			switch p.peekToken.Type {
+			case token.RBRACE, token.LET, token.RETURN, token.WHILE, token.FOR, token.TRY, token.THROW, token.EOF:
+				return
+			}
+		}
+		p.nextToken()
 	}
 }
 
@@ -360,11 +619,14 @@ func (p *Parser) parseLetStatement() *ast.LetStatement {
 
 	p.nextToken()
 	stm.Value = p.parseExpression(LOWEST)
+	if stm.Value == nil {
+		return nil
+	}
 	if fl, ok := stm.Value.(*ast.FunctionLiteral); ok {
 		fl.Name = stm.Name.Value
 	}
 
-	for !p.curTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
 
@@ -376,18 +638,248 @@ func (p *Parser) parseReturnStatement() *ast.ReturnStatement {
 	p.nextToken()
 
 	stm.ReturnValue = p.parseExpression(LOWEST)
+	if stm.ReturnValue == nil {
+		return nil
+	}
 
-	for !p.curTokenIs(token.SEMICOLON) {
+	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
 	}
 
 	return stm
 }
 
-func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
+// try { ... } catch (e) { ... } finally { ... }
+func (p *Parser) parseTryStatement() *ast.TryStatement {
+	stm := &ast.TryStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+	stm.Block = p.parseBlockStatement()
+	if stm.Block == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.CATCH) {
+		p.nextToken()
+		if !p.expectPeek(token.LPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.IDENT) {
+			return nil
+		}
+		stm.CatchParam = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+		if !p.expectPeek(token.RPAREN) {
+			return nil
+		}
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stm.Catch = p.parseBlockStatement()
+		if stm.Catch == nil {
+			return nil
+		}
+	}
+
+	if p.peekTokenIs(token.FINALLY) {
+		p.nextToken()
+		if !p.expectPeek(token.LBRACE) {
+			return nil
+		}
+		stm.Finally = p.parseBlockStatement()
+		if stm.Finally == nil {
+			return nil
+		}
+	}
+
+	if stm.Catch == nil && stm.Finally == nil {
+		p.addDiagnostic(&Diagnostic{
+			Message: "try without catch or finally",
+			Pos:     stm.Token.Pos,
+			End:     stm.Block.End(),
+			Got:     p.peekToken.Type,
+			Hint:    "add a catch (e) { ... } or finally { ... } clause",
+		})
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+func (p *Parser) parseThrowStatement() *ast.ThrowStatement {
+	stm := &ast.ThrowStatement{Token: p.curToken}
+	p.nextToken()
+
+	stm.Value = p.parseExpression(LOWEST)
+	if stm.Value == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+// while (x < 10) { ... }
+func (p *Parser) parseWhileStatement() *ast.WhileStatement {
+	stm := &ast.WhileStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	p.nextToken()
+	stm.Condition = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stm.Body = p.parseLoopBody()
+	if stm.Condition == nil || stm.Body == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+// for (x in [1, 2, 3]) { ... }
+func (p *Parser) parseForStatement() *ast.ForStatement {
+	stm := &ast.ForStatement{Token: p.curToken}
+
+	if !p.expectPeek(token.LPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.IDENT) {
+		return nil
+	}
+	stm.Variable = &ast.Identifier{Token: p.curToken, Value: p.curToken.Literal}
+
+	if !p.expectPeek(token.IN) {
+		return nil
+	}
+	p.nextToken()
+	stm.Iterable = p.parseExpression(LOWEST)
+
+	if !p.expectPeek(token.RPAREN) {
+		return nil
+	}
+	if !p.expectPeek(token.LBRACE) {
+		return nil
+	}
+
+	stm.Body = p.parseLoopBody()
+	if stm.Iterable == nil || stm.Body == nil {
+		return nil
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+func (p *Parser) parseLoopBody() *ast.BlockStatement {
+	p.loopDepth++
+	defer func() { p.loopDepth-- }()
+	return p.parseBlockStatement()
+}
+
+func (p *Parser) parseBreakStatement() *ast.BreakStatement {
+	stm := &ast.BreakStatement{Token: p.curToken}
+	if p.loopDepth == 0 {
+		p.errorf(p.curToken, "break outside loop")
+		return nil
+	}
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+func (p *Parser) parseContinueStatement() *ast.ContinueStatement {
+	stm := &ast.ContinueStatement{Token: p.curToken}
+	if p.loopDepth == 0 {
+		p.errorf(p.curToken, "continue outside loop")
+		return nil
+	}
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+	return stm
+}
+
+// parseExpressionStatement parses an expression, or an assignment when the
+// expression is followed by an assignment operator
+func (p *Parser) parseExpressionStatement() ast.Statement {
 	// defer untrace(trace("parseExpressionStatement"))
 	stm := &ast.ExpressionStatement{Token: p.curToken}
 	stm.Expression = p.parseExpression(LOWEST)
+	if stm.Expression == nil {
+		return nil
+	}
+
+	if assignmentOperators[p.peekToken.Type] {
+		p.nextToken()
+		return p.parseAssignStatement(stm.Expression)
+	}
+
+	if p.peekTokenIs(token.SEMICOLON) {
+		p.nextToken()
+	}
+
+	return stm
+}
+
+var assignmentOperators = map[token.TokenType]bool{
+	token.ASSIGN:          true,
+	token.PLUS_ASSIGN:     true,
+	token.MINUS_ASSIGN:    true,
+	token.ASTERISK_ASSIGN: true,
+	token.SLASH_ASSIGN:    true,
+}
+
+// x = 5; x += 1; arr[0] = x;
+func (p *Parser) parseAssignStatement(target ast.Expression) ast.Statement {
+	stm := &ast.AssignStatement{Token: p.curToken, Target: target, Operator: p.curToken.Literal}
+
+	switch target.(type) {
+	case *ast.Identifier:
+	case *ast.IndexExpression:
+		if stm.Operator != "=" {
+			p.errorf(p.curToken, "operator %s not supported on index expressions", stm.Operator)
+			return nil
+		}
+	default:
+		if p.panicMode {
+			// target was only partly parsed and its error is reported
+			return nil
+		}
+		p.addDiagnostic(&Diagnostic{
+			Message: fmt.Sprintf("cannot assign to %s", target.String()),
+			Pos:     target.Pos(),
+			End:     target.End(),
+			Got:     p.curToken.Type,
+			Hint:    "only variables and index expressions can be assigned",
+		})
+		return nil
+	}
+
+	p.nextToken()
+	stm.Value = p.parseExpression(LOWEST)
+	if stm.Value == nil {
+		return nil
+	}
 
 	if p.peekTokenIs(token.SEMICOLON) {
 		p.nextToken()
@@ -397,8 +889,13 @@ func (p *Parser) parseExpressionStatement() *ast.ExpressionStatement {
 }
 
 func (p *Parser) noPrefixParseFnError(t token.TokenType) {
-	msg := fmt.Sprintf("no prefix parse function for %s found", t)
-	p.errs = append(p.errs, msg)
+	p.addDiagnostic(&Diagnostic{
+		Message: fmt.Sprintf("no prefix parse function for %s found", t),
+		Pos:     p.curToken.Pos,
+		End:     p.curToken.End,
+		Got:     t,
+		Hint:    "expected an expression",
+	})
 }
 
 // 2+3*4
@@ -411,7 +908,7 @@ func (p *Parser) parseExpression(precedence int) ast.Expression {
 	}
 	leftExp := prefix()
 
-	for !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
+	for leftExp != nil && !p.peekTokenIs(token.SEMICOLON) && precedence < p.peekPrecedence() {
 		infix := p.infixParseFns[p.peekToken.Type]
 		if infix == nil {
 			return leftExp
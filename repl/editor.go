@@ -0,0 +1,466 @@
+package repl
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// errInterrupted is returned by readLine when Ctrl-C abandons the line
+var errInterrupted = errors.New("interrupted")
+
+// maxHistory is the number of lines kept in the history
+const maxHistory = 1000
+
+// editor reads lines from a terminal in raw mode, understanding the usual
+// Emacs-style keys: cursor movement, deletion, history navigation with the
+// arrow keys, reverse history search with Ctrl-R and tab completion.
+type editor struct {
+	in  *bufio.Reader
+	out io.Writer
+
+	// complete returns the completions of the word before the cursor
+	complete func(word string) []string
+
+	history     []string
+	historyFile string // file the history is appended to, if set
+
+	// the line being edited
+	prompt string
+	line   []rune
+	pos    int
+}
+
+func newEditor(in io.Reader, out io.Writer, complete func(string) []string) *editor {
+	return &editor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// special keys, below the valid runes
+const (
+	keyUnknown rune = -1 - iota
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyWordLeft
+	keyWordRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyEscape
+)
+
+// control keys
+const (
+	ctrlA     = 1
+	ctrlB     = 2
+	ctrlC     = 3
+	ctrlD     = 4
+	ctrlE     = 5
+	ctrlF     = 6
+	ctrlG     = 7
+	ctrlH     = 8
+	tab       = 9
+	ctrlJ     = 10
+	ctrlK     = 11
+	ctrlL     = 12
+	enter     = 13
+	ctrlN     = 14
+	ctrlP     = 16
+	ctrlR     = 18
+	ctrlU     = 21
+	ctrlW     = 23
+	escape    = 27
+	backspace = 127
+)
+
+// readKey reads a key press, decoding the escape sequences of special keys
+func (e *editor) readKey() (rune, error) {
+	r, _, err := e.in.ReadRune()
+	if err != nil || r != escape {
+		return r, err
+	}
+	if e.in.Buffered() == 0 {
+		return keyEscape, nil
+	}
+	r, _, err = e.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case 'b':
+		return keyWordLeft, nil
+	case 'f':
+		return keyWordRight, nil
+	case '[', 'O':
+	default:
+		return keyUnknown, nil
+	}
+
+	// a control sequence: parameters followed by a final byte
+	var params []byte
+	for {
+		b, err := e.in.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b >= 0x40 && b <= 0x7e {
+			return controlSequenceKey(string(params), b), nil
+		}
+		params = append(params, b)
+	}
+}
+
+func controlSequenceKey(params string, final byte) rune {
+	modified := strings.Contains(params, ";")
+	switch final {
+	case 'A':
+		return keyUp
+	case 'B':
+		return keyDown
+	case 'C':
+		if modified {
+			return keyWordRight
+		}
+		return keyRight
+	case 'D':
+		if modified {
+			return keyWordLeft
+		}
+		return keyLeft
+	case 'H':
+		return keyHome
+	case 'F':
+		return keyEnd
+	case '~':
+		switch params {
+		case "1", "7":
+			return keyHome
+		case "4", "8":
+			return keyEnd
+		case "3":
+			return keyDelete
+		}
+	}
+	return keyUnknown
+}
+
+// refresh redraws the prompt and the line and places the cursor
+func (e *editor) refresh() {
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "\r%s%s\x1b[K", e.prompt, string(e.line))
+	if n := len(e.line) - e.pos; n > 0 {
+		fmt.Fprintf(&out, "\x1b[%dD", n)
+	}
+	e.out.Write(out.Bytes())
+}
+
+func (e *editor) setLine(line string) {
+	e.line = []rune(line)
+	e.pos = len(e.line)
+}
+
+func (e *editor) insert(text []rune) {
+	line := make([]rune, 0, len(e.line)+len(text))
+	line = append(line, e.line[:e.pos]...)
+	line = append(line, text...)
+	e.line = append(line, e.line[e.pos:]...)
+	e.pos += len(text)
+}
+
+// deleteRange removes the runes of the line from start up to end
+func (e *editor) deleteRange(start, end int) {
+	e.line = append(e.line[:start], e.line[end:]...)
+	e.pos = start
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordStart returns the start of the word before the cursor
+func (e *editor) wordStart() int {
+	i := e.pos
+	for i > 0 && !isWordRune(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && isWordRune(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd returns the end of the word after the cursor
+func (e *editor) wordEnd() int {
+	i := e.pos
+	for i < len(e.line) && !isWordRune(e.line[i]) {
+		i++
+	}
+	for i < len(e.line) && isWordRune(e.line[i]) {
+		i++
+	}
+	return i
+}
+
+// readLine shows prompt and returns the line typed after it. It returns
+// io.EOF for Ctrl-D on an empty line and errInterrupted for Ctrl-C.
+func (e *editor) readLine(prompt string) (string, error) {
+	e.prompt = prompt
+	e.setLine("")
+	e.refresh()
+
+	// index of the history entry shown, len(e.history) for the new line
+	// whose text is kept in typed
+	index := len(e.history)
+	typed := ""
+	showHistory := func(i int) {
+		if i < 0 || i > len(e.history) {
+			return
+		}
+		if index == len(e.history) {
+			typed = string(e.line)
+		}
+		index = i
+		if i == len(e.history) {
+			e.setLine(typed)
+		} else {
+			e.setLine(e.history[i])
+		}
+	}
+
+	var key rune
+	pending := false
+	for {
+		if !pending {
+			var err error
+			if key, err = e.readKey(); err != nil {
+				if err == io.EOF && len(e.line) > 0 {
+					// end the last line of input without a newline
+					e.out.Write([]byte("\r\n"))
+					return string(e.line), nil
+				}
+				return "", err
+			}
+		}
+		pending = false
+
+		switch key {
+		case enter, ctrlJ:
+			e.pos = len(e.line)
+			e.refresh()
+			e.out.Write([]byte("\r\n"))
+			return string(e.line), nil
+		case ctrlC:
+			e.out.Write([]byte("^C\r\n"))
+			return "", errInterrupted
+		case ctrlD:
+			if len(e.line) == 0 {
+				e.out.Write([]byte("\r\n"))
+				return "", io.EOF
+			}
+			if e.pos < len(e.line) {
+				e.deleteRange(e.pos, e.pos+1)
+			}
+		case keyDelete:
+			if e.pos < len(e.line) {
+				e.deleteRange(e.pos, e.pos+1)
+			}
+		case backspace, ctrlH:
+			if e.pos > 0 {
+				e.deleteRange(e.pos-1, e.pos)
+			}
+		case ctrlA, keyHome:
+			e.pos = 0
+		case ctrlE, keyEnd:
+			e.pos = len(e.line)
+		case ctrlB, keyLeft:
+			if e.pos > 0 {
+				e.pos--
+			}
+		case ctrlF, keyRight:
+			if e.pos < len(e.line) {
+				e.pos++
+			}
+		case keyWordLeft:
+			e.pos = e.wordStart()
+		case keyWordRight:
+			e.pos = e.wordEnd()
+		case ctrlK:
+			e.line = e.line[:e.pos]
+		case ctrlU:
+			e.deleteRange(0, e.pos)
+		case ctrlW:
+			e.deleteRange(e.wordStart(), e.pos)
+		case ctrlL:
+			e.out.Write([]byte("\x1b[H\x1b[2J"))
+		case ctrlP, keyUp:
+			showHistory(index - 1)
+		case ctrlN, keyDown:
+			showHistory(index + 1)
+		case ctrlR:
+			var err error
+			if key, pending, err = e.search(); err != nil {
+				return "", err
+			}
+			continue
+		case tab:
+			e.completeWord()
+		default:
+			if key >= ' ' && key != backspace {
+				e.insert([]rune{key})
+			}
+		}
+		e.refresh()
+	}
+}
+
+// search runs a reverse incremental search of the history. The match found
+// replaces the line when the search ends with a key other than Ctrl-G or
+// Escape, and that key is returned to be handled by readLine.
+func (e *editor) search() (key rune, pending bool, err error) {
+	original, originalPos := e.line, e.pos
+	var query []rune
+	match := len(e.history) // index of the matching entry
+	found := true
+
+	// find searches backwards from the entry before from
+	find := func(from int) {
+		if from > len(e.history) {
+			from = len(e.history)
+		}
+		for i := from - 1; i >= 0; i-- {
+			if strings.Contains(e.history[i], string(query)) {
+				match, found = i, true
+				return
+			}
+		}
+		found = false
+	}
+	draw := func() {
+		status := "reverse-i-search"
+		if !found {
+			status = "failed " + status
+		}
+		text := ""
+		if match < len(e.history) {
+			text = e.history[match]
+		}
+		fmt.Fprintf(e.out, "\r(%s)`%s': %s\x1b[K", status, string(query), text)
+	}
+
+	draw()
+	for {
+		key, err := e.readKey()
+		if err != nil {
+			return 0, false, err
+		}
+		switch key {
+		case ctrlR:
+			find(match)
+		case backspace, ctrlH:
+			if len(query) > 0 {
+				query = query[:len(query)-1]
+				find(len(e.history))
+			}
+		case ctrlG, keyEscape:
+			e.line, e.pos = original, originalPos
+			e.refresh()
+			return 0, false, nil
+		default:
+			if key >= ' ' && key != backspace {
+				query = append(query, key)
+				find(match + 1)
+				break
+			}
+			if match < len(e.history) {
+				e.setLine(e.history[match])
+			}
+			e.refresh()
+			return key, true, nil
+		}
+		draw()
+	}
+}
+
+// completeWord completes the word before the cursor. A single completion is
+// inserted, otherwise the longest common prefix of the completions is
+// inserted or, if there is none, the completions are listed.
+func (e *editor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+	start := e.pos
+	for start > 0 && isWordRune(e.line[start-1]) {
+		start--
+	}
+	if start == 1 && e.line[0] == ':' {
+		start = 0 // a REPL command
+	}
+	word := string(e.line[start:e.pos])
+	candidates := e.complete(word)
+	if len(candidates) == 0 {
+		e.out.Write([]byte("\a"))
+		return
+	}
+
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(prefix) > len(word) {
+		e.insert([]rune(prefix[len(word):]))
+		return
+	}
+	if len(candidates) > 1 {
+		fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+	}
+}
+
+// addHistory records line as the most recent history entry, appending it to
+// the history file
+func (e *editor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistory {
+		e.history = e.history[len(e.history)-maxHistory:]
+	}
+	if e.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(e.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return // the history is only a convenience
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// loadHistory reads the history file, keeping the most recent entries and
+// rewriting the file if it has grown beyond them
+func (e *editor) loadHistory(path string) {
+	e.historyFile = path
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) > maxHistory {
+		lines = lines[len(lines)-maxHistory:]
+		ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+	}
+	for _, line := range lines {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+}
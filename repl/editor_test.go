@@ -0,0 +1,146 @@
+package repl
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testEditor(input string, history ...string) (*editor, *bytes.Buffer) {
+	var out bytes.Buffer
+	words := []string{"last", "len", "let", "puts"}
+	e := newEditor(strings.NewReader(input), &out, func(word string) []string {
+		var candidates []string
+		for _, w := range words {
+			if strings.HasPrefix(w, word) {
+				candidates = append(candidates, w)
+			}
+		}
+		return candidates
+	})
+	e.history = history
+	return e, &out
+}
+
+func TestEditorKeys(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"abc\r", "abc"},
+		{"ac\x1b[Db\r", "abc"},
+		{"bc\x01a\x05d\r", "abcd"},
+		{"abc\x02\x02\x06x\r", "abxc"},
+		{"abcd\x7f\x7f\r", "ab"},
+		{"abcd\x01\x1b[3~\x04\r", "cd"},
+		{"abcd\x1b[H\x1b[C\x0b\r", "a"},
+		{"abcd\x02\x02\x15\r", "cd"},
+		{"let foo = bar\x17baz\r", "let foo = baz"},
+		{"one two\x1bbx\x1b[1;5Cy\r", "one xtwoy"},
+		{"héllo\x1b[D\x1b[D\x1b[D\x7fe\r", "hello"},
+		{"abc", "abc"},
+	}
+	for _, tt := range tests {
+		e, _ := testEditor(tt.input)
+		line, err := e.readLine(PROMPT)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+		if line != tt.expected {
+			t.Errorf("%q: wrong line. want=%q, got=%q", tt.input, tt.expected, line)
+		}
+	}
+}
+
+func TestEditorEndOfInput(t *testing.T) {
+	e, _ := testEditor("\x04")
+	if _, err := e.readLine(PROMPT); err != io.EOF {
+		t.Errorf("Ctrl-D on an empty line: want=io.EOF, got=%v", err)
+	}
+	e, _ = testEditor("abc\x03")
+	if _, err := e.readLine(PROMPT); err != errInterrupted {
+		t.Errorf("Ctrl-C: want=errInterrupted, got=%v", err)
+	}
+}
+
+func TestEditorHistory(t *testing.T) {
+	history := []string{"one", "two", "ones"}
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"\x1b[A\r", "ones"},
+		{"\x1b[A\x1b[A\x1b[A\x1b[A\r", "one"},
+		{"x\x1b[A\x1b[B\r", "x"},
+		{"\x10\x10\x0e\r", "ones"},
+		{"\x12on\r", "ones"},
+		{"\x12on\x12\r", "one"},
+		{"\x12tw\x05!\r", "two!"},
+		{"ab\x12on\x07\r", "ab"},
+		{"\x12xyz\r", ""},
+	}
+	for _, tt := range tests {
+		e, _ := testEditor(tt.input, history...)
+		line, err := e.readLine(PROMPT)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+		if line != tt.expected {
+			t.Errorf("%q: wrong line. want=%q, got=%q", tt.input, tt.expected, line)
+		}
+	}
+}
+
+func TestEditorCompletion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		listed   string
+	}{
+		{"pu\t(1)\r", "puts(1)", ""},
+		{"l\ta\t\r", "last", ""},
+		{"x + le\t\r", "x + le", "len  let"},
+		{"zz\t\r", "zz", ""},
+	}
+	for _, tt := range tests {
+		e, out := testEditor(tt.input)
+		line, err := e.readLine(PROMPT)
+		if err != nil {
+			t.Fatalf("%q: %s", tt.input, err)
+		}
+		if line != tt.expected {
+			t.Errorf("%q: wrong line. want=%q, got=%q", tt.input, tt.expected, line)
+		}
+		if tt.listed != "" && !strings.Contains(out.String(), "\r\n"+tt.listed+"\r\n") {
+			t.Errorf("%q: completions not listed in %q", tt.input, out.String())
+		}
+	}
+}
+
+func TestHistoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, HISTORY_FILE)
+
+	e, _ := testEditor("")
+	e.loadHistory(path)
+	for _, line := range []string{"one", "one", " ", "two"} {
+		e.addHistory(line)
+	}
+
+	e, _ = testEditor("\x1b[A\x1b[A\r")
+	e.loadHistory(path)
+	if strings.Join(e.history, ",") != "one,two" {
+		t.Errorf("wrong history. want=[one two], got=%v", e.history)
+	}
+	if line, _ := e.readLine(PROMPT); line != "one" {
+		t.Errorf("wrong line from history. want=%q, got=%q", "one", line)
+	}
+}
@@ -0,0 +1,70 @@
+package repl
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// lineReader reads a line of input after showing a prompt
+type lineReader interface {
+	readLine(prompt string) (string, error)
+}
+
+// newLineReader returns a line editor with the history kept in the home
+// directory if in and out are a terminal, and otherwise a reader of plain
+// lines
+func newLineReader(in io.Reader, out io.Writer, complete func(string) []string) lineReader {
+	inFile, ok := in.(*os.File)
+	outFile, ok2 := out.(*os.File)
+	if !ok || !ok2 || !isTerminal(int(inFile.Fd())) || !isTerminal(int(outFile.Fd())) {
+		return &scanReader{scan: bufio.NewScanner(in), out: out}
+	}
+
+	e := newEditor(inFile, outFile, complete)
+	if home, err := os.UserHomeDir(); err == nil {
+		e.loadHistory(filepath.Join(home, HISTORY_FILE))
+	}
+	return &terminalReader{fd: int(inFile.Fd()), editor: e}
+}
+
+// HISTORY_FILE is the name of the history file in the home directory
+const HISTORY_FILE = ".lyz_history"
+
+// scanReader reads lines that are not typed on a terminal
+type scanReader struct {
+	scan *bufio.Scanner
+	out  io.Writer
+}
+
+func (s *scanReader) readLine(prompt string) (string, error) {
+	io.WriteString(s.out, prompt)
+	if !s.scan.Scan() {
+		if err := s.scan.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return s.scan.Text(), nil
+}
+
+// terminalReader edits lines with an editor, switching the terminal to raw
+// mode while a line is read
+type terminalReader struct {
+	fd     int
+	editor *editor
+}
+
+func (t *terminalReader) readLine(prompt string) (string, error) {
+	state, err := makeRaw(t.fd)
+	if err != nil {
+		return "", err
+	}
+	line, err := t.editor.readLine(prompt)
+	restore(t.fd, state)
+	if err == nil {
+		t.editor.addHistory(line)
+	}
+	return line, err
+}
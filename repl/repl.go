@@ -4,16 +4,27 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"lyz-lang-2nd/asm"
+	"lyz-lang-2nd/ast"
 	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/evaluator"
 	"lyz-lang-2nd/lexer"
 	"lyz-lang-2nd/object"
 	"lyz-lang-2nd/parser"
+	"lyz-lang-2nd/token"
 	"lyz-lang-2nd/vm"
+	"sort"
+	"strings"
+	"time"
 )
 
 // PROMPT is a console prompt symbol
 const PROMPT = ">> "
 
+// CONTINUATION_PROMPT asks for the rest of an incomplete input
+const CONTINUATION_PROMPT = ".. "
+
 const MONKEY_FACE = `            __,__
    .--.  .-"     "-.  .--.
   / .. \/  .-. .-.  \/ .. \
@@ -27,56 +38,356 @@ const MONKEY_FACE = `            __,__
            '-----'
 `
 
-// Start function
+const HELP = `Input is run when it is complete, an empty line runs it as it is.
+Commands:
+  :tokens <input>     show the tokens of the input
+  :ast <input>        show the syntax tree of the input
+  :bytecode [input]   run the input and show its bytecode, or show the
+                      bytecode of the last input
+  :time <input>       run the input and show how long it took
+  :globals            show the global variables
+  :engine [vm|eval]   show or switch the engine, keeping the globals;
+                      functions only run on the engine that defined them
+  :save <file>        save the globals, and the functions they refer to
+  :load <file>        replace the globals by the ones saved in the file
+  :help               show this help
+`
+
+// Start runs the REPL on the vm engine
 func Start(in io.Reader, out io.Writer) {
-	scan := bufio.NewScanner(in)
-	w := bufio.NewWriter(out)
+	StartEngine(in, out, "vm")
+}
 
-	constants := []object.Object{}
-	globals := make([]object.Object, vm.GlobalSize)
-	symbolTable := compiler.NewSymbolTable()
-	for i, v := range object.Builtins {
-		symbolTable.DefineBuiltin(i, v.Name)
+// StartEngine runs the REPL, executing the input with the engine "vm" or
+// "eval"
+func StartEngine(in io.Reader, out io.Writer, engine string) {
+	r := newRepl(in, out, engine)
+	for {
+		input, ok := r.read()
+		if !ok {
+			return
+		}
+		if strings.HasPrefix(input, ":") {
+			r.command(input)
+		} else if strings.TrimSpace(input) != "" {
+			r.execute(input)
+		}
+		r.out.Flush()
 	}
+}
+
+type repl struct {
+	input  lineReader
+	out    *bufio.Writer
+	engine string
+
+	// state of the vm engine
+	session    *vm.Session
+	last       *compiler.Bytecode // bytecode of the last input
+	lastSource string
+
+	// state of the eval engine
+	env *object.Environment
+}
+
+func newRepl(in io.Reader, out io.Writer, engine string) *repl {
+	r := &repl{
+		out:     bufio.NewWriter(out),
+		engine:  engine,
+		session: vm.NewSession(),
+		env:     object.NewEnvironment(),
+	}
+	r.input = newLineReader(in, out, r.complete)
+	return r
+}
+
+// read reads lines until the input is complete or an empty line ends it.
+// Ctrl-C discards the input read so far.
+func (r *repl) read() (string, bool) {
+	r.out.Flush()
+	line, err := r.input.readLine(PROMPT)
+	if err == errInterrupted {
+		return "", true
+	}
+	if err != nil {
+		return "", false
+	}
+	input := strings.TrimSpace(line)
+	for input != "" && Incomplete(input) {
+		line, err := r.input.readLine(CONTINUATION_PROMPT)
+		if err == errInterrupted {
+			return "", true
+		}
+		if err != nil || strings.TrimSpace(line) == "" {
+			break
+		}
+		input += "\n" + line
+	}
+	return input, true
+}
 
+// complete returns the keywords, builtins, globals and commands starting
+// with word
+func (r *repl) complete(word string) []string {
+	var names []string
+	if strings.HasPrefix(word, ":") {
+		names = commandNames
+	} else {
+		names = append(names, token.Keywords()...)
+		builtins := r.session.Builtins()
+		for i := 0; i < builtins.Len(); i++ {
+			names = append(names, builtins.Name(i))
+		}
+		if r.engine == "eval" {
+			names = append(names, r.env.Names()...)
+		} else {
+			names = append(names, r.session.Names()...)
+		}
+	}
+
+	var candidates []string
+	seen := map[string]bool{}
+	for _, name := range names {
+		if name != "" && strings.HasPrefix(name, word) && !seen[name] {
+			seen[name] = true
+			candidates = append(candidates, name)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
+
+// Incomplete reports whether input ends inside brackets, a raw string or a
+// block comment, so that more lines are needed to complete it
+func Incomplete(input string) bool {
+	l := lexer.New(input)
+	depth := 0
 	for {
-		w.WriteString(PROMPT)
-		w.Flush()
-		scanned := scan.Scan()
-		if !scanned {
+		tok := l.NextToken()
+		switch tok.Type {
+		case token.EOF:
+			return depth > 0
+		case token.LPAREN, token.LBRACKET, token.LBRACE, token.TEMPLATE_HEAD:
+			depth++
+		case token.RPAREN, token.RBRACKET, token.RBRACE, token.TEMPLATE_TAIL:
+			depth--
+		case token.ILLEGAL:
+			if strings.HasPrefix(tok.Literal, "`") || strings.HasPrefix(tok.Literal, "/*") {
+				return true
+			}
+		}
+	}
+}
+
+var commandNames = []string{":tokens", ":ast", ":bytecode", ":time", ":globals", ":engine", ":save", ":load", ":help"}
+
+// command runs a meta-command, a ":" followed by the command name and its
+// argument
+func (r *repl) command(input string) {
+	name, arg := input[1:], ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, arg = name[:i], strings.TrimSpace(name[i:])
+	}
+
+	switch name {
+	case "tokens":
+		l := lexer.New(arg)
+		for tok := l.NextToken(); tok.Type != token.EOF; tok = l.NextToken() {
+			fmt.Fprintf(r.out, "%s\t%s\t%q\n", tok.Pos, tok.Type, tok.Literal)
+		}
+	case "ast":
+		if program, ok := r.parse(arg); ok {
+			for _, stmt := range program.Statements {
+				fmt.Fprintf(r.out, "%s\t%s\n", stmt.Pos(), stmt)
+			}
+		}
+	case "bytecode":
+		if r.engine != "vm" {
+			r.out.WriteString("bytecode is only shown on the vm engine\n")
 			return
 		}
-		line := scan.Text()
-		l := lexer.New(line)
-		p := parser.New(l)
-		program := p.ParseProgram()
-		if len(p.Errs()) != 0 {
-			printParserErrors(w, p.Errs())
-			w.Flush()
-			continue
+		if arg != "" {
+			r.execute(arg)
 		}
-
-		comp := compiler.NewWithState(symbolTable, constants)
-		err := comp.Compile(program)
+		if r.last == nil {
+			r.out.WriteString("no bytecode yet\n")
+			return
+		}
+		text, err := asm.DisassembleWith(r.last, asm.Options{Symbols: r.session.Symbols(), Source: r.lastSource})
 		if err != nil {
-			fmt.Fprintf(out, "Woops! Compilation failed:\n %s\n", err)
-			continue
+			fmt.Fprintf(r.out, "Woops! Disassembly failed:\n %s\n", err)
+			return
+		}
+		r.out.WriteString(text)
+	case "time":
+		start := time.Now()
+		r.execute(arg)
+		fmt.Fprintf(r.out, "time: %s\n", time.Since(start))
+	case "globals":
+		r.printGlobals()
+	case "engine":
+		switch arg {
+		case "":
+			fmt.Fprintf(r.out, "engine: %s\n", r.engine)
+		case "vm", "eval":
+			if err := r.switchEngine(arg); err != nil {
+				fmt.Fprintf(r.out, "Woops! :engine failed:\n %s\n", err)
+			}
+		default:
+			fmt.Fprintf(r.out, "unknown engine %q, want vm or eval\n", arg)
 		}
-		// constants = code.Constants
+	case "save", "load":
+		if arg == "" {
+			fmt.Fprintf(r.out, "usage: :%s <file>\n", name)
+			return
+		}
+		action := r.save
+		if name == "load" {
+			action = r.load
+		}
+		if err := action(arg); err != nil {
+			fmt.Fprintf(r.out, "Woops! :%s failed:\n %s\n", name, err)
+		}
+	case "help":
+		r.out.WriteString(HELP)
+	default:
+		fmt.Fprintf(r.out, "unknown command :%s, try :help\n", name)
+	}
+}
 
-		machine := vm.NewWithGlobalsStore(comp.Bytecode(), globals)
-		err = machine.Run()
-		if err != nil {
-			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
-			continue
+func (r *repl) parse(input string) (*ast.Program, bool) {
+	p := parser.New(lexer.New(input))
+	program := p.ParseProgram()
+	if len(p.Errs()) != 0 {
+		printParserErrors(r.out, p.Errs())
+		return nil, false
+	}
+	return program, true
+}
+
+// execute runs input on the current engine and prints its value
+func (r *repl) execute(input string) {
+	program, ok := r.parse(input)
+	if !ok {
+		return
+	}
+
+	if r.engine == "eval" {
+		result := evaluator.Eval(program, r.env)
+		if err, ok := result.(*object.Error); ok {
+			fmt.Fprintf(r.out, "Woops! Evaluation failed:\n %s\n", err.RuntimeError().StackTrace())
+		} else if result != nil {
+			r.out.WriteString(result.Inspect())
+			r.out.WriteString("\n")
 		}
-		stackTop := machine.LastPoppedStackElem()
-		if stackTop != nil {
-			w.WriteString(stackTop.Inspect())
-			w.WriteString("\n")
+		return
+	}
+
+	bytecode, err := r.session.Compile(program)
+	if err != nil {
+		fmt.Fprintf(r.out, "Woops! Compilation failed:\n %s\n", err)
+		return
+	}
+	r.last, r.lastSource = bytecode, input
+
+	stackTop, err := r.session.Run(bytecode)
+	if err != nil {
+		if rerr, ok := err.(*object.RuntimeError); ok {
+			fmt.Fprintf(r.out, "Woops! Executing bytecode failed:\n %s\n", rerr.StackTrace())
+		} else {
+			fmt.Fprintf(r.out, "Woops! Executing bytecode failed:\n %s\n", err)
 		}
-		w.Flush()
+		return
+	}
+	if stackTop != nil {
+		r.out.WriteString(stackTop.Inspect())
+		r.out.WriteString("\n")
+	}
+}
+
+func (r *repl) printGlobals() {
+	if r.engine == "eval" {
+		for _, name := range r.env.Names() {
+			value, _ := r.env.Get(name)
+			fmt.Fprintf(r.out, "%s = %s\n", name, value.Inspect())
+		}
+		return
+	}
+	for _, name := range r.session.Names() {
+		value, _ := r.session.Get(name)
+		fmt.Fprintf(r.out, "%s = %s\n", name, value.Inspect())
+	}
+}
+
+// switchEngine copies the globals of the current engine to the other one
+func (r *repl) switchEngine(engine string) error {
+	if engine == r.engine {
+		return nil
+	}
+	if engine == "eval" {
+		r.copyGlobalsToEnv()
+	} else if err := r.copyEnvToGlobals(); err != nil {
+		return err
+	}
+	r.engine = engine
+	return nil
+}
+
+func (r *repl) copyGlobalsToEnv() {
+	for _, name := range r.session.Names() {
+		value, _ := r.session.Get(name)
+		r.env.Set(name, value)
+	}
+}
+
+func (r *repl) copyEnvToGlobals() error {
+	for _, name := range r.env.Names() {
+		value, _ := r.env.Get(name)
+		if err := r.session.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// save writes the symbol table, constants and globals of the session to
+// path. The globals of the eval engine are saved like those of the vm, which
+// fails for the functions it defined.
+func (r *repl) save(path string) error {
+	if r.engine == "eval" {
+		if err := r.copyEnvToGlobals(); err != nil {
+			return err
+		}
+	}
+	data, err := compiler.MarshalState(r.session.State())
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+// load replaces the state of the session by the one saved in path
+func (r *repl) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	state, err := compiler.UnmarshalState(data, r.session.Builtins())
+	if err != nil {
+		return err
+	}
+	session, err := vm.NewSessionFromState(state)
+	if err != nil {
+		return err
+	}
+
+	r.session = session
+	r.last, r.lastSource = nil, ""
+	r.env = object.NewEnvironment()
+	if r.engine == "eval" {
+		r.copyGlobalsToEnv()
 	}
+	return nil
 }
 
 func printParserErrors(out io.Writer, errors []string) {
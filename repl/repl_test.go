@@ -0,0 +1,169 @@
+package repl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIncomplete(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"1 + 2", false},
+		{"let f = fn(x) {", true},
+		{"let f = fn(x) {\n x\n}", false},
+		{"[1, 2", true},
+		{"puts(1", true},
+		{"{\"a\": [1, {", true},
+		{"`raw", true},
+		{"`raw\nstring`", false},
+		{"1 /* comment", true},
+		{`"${ fn() {`, true},
+		{`"unterminated`, false},
+		{"1 }", false},
+	}
+	for _, tt := range tests {
+		if got := Incomplete(tt.input); got != tt.expected {
+			t.Errorf("Incomplete(%q) wrong. want=%t, got=%t", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func runSession(engine, input string) string {
+	var out bytes.Buffer
+	StartEngine(strings.NewReader(input), &out, engine)
+	return out.String()
+}
+
+func TestMultiLineInput(t *testing.T) {
+	input := "let add = fn(a, b) {\n  a + b\n};\nadd(1, 2)\n"
+	for _, engine := range []string{"vm", "eval"} {
+		out := runSession(engine, input)
+		if !strings.Contains(out, PROMPT+CONTINUATION_PROMPT+CONTINUATION_PROMPT) {
+			t.Errorf("%s: no continuation prompts in %q", engine, out)
+		}
+		if !strings.HasSuffix(out, "3\n"+PROMPT) {
+			t.Errorf("%s: wrong result in %q", engine, out)
+		}
+	}
+}
+
+func TestEmptyLineEndsInput(t *testing.T) {
+	out := runSession("vm", "[1,\n\n2\n")
+	if !strings.Contains(out, "parser errors") || !strings.HasSuffix(out, "2\n"+PROMPT) {
+		t.Errorf("empty line did not end the input: %q", out)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	tests := []struct {
+		engine   string
+		input    string
+		expected []string
+	}{
+		{"vm", ":tokens let x", []string{"1:1\tLET\t\"let\"\n1:5\tIDENT\t\"x\"\n"}},
+		{"vm", ":ast 1 + 2 * 3", []string{"1:1\t(1 + (2 * 3))\n"}},
+		{"vm", ":bytecode 5 + 6", []string{"11\n", "OpConstant 0             // 5", "// 1| 5 + 6"}},
+		{"vm", "1\n:bytecode", []string{"OpConstant 0             // 1"}},
+		{"vm", ":bytecode", []string{"no bytecode yet"}},
+		{"eval", ":bytecode 1", []string{"only shown on the vm engine"}},
+		{"vm", ":time 1 + 1", []string{"2\n", "time: "}},
+		{"vm", "let a = 1;\nlet b = [a];\n:globals", []string{"a = 1\nb = [1]\n"}},
+		{"eval", "let a = 1;\nlet b = [a];\n:globals", []string{"a = 1\nb = [1]\n"}},
+		{"vm", ":engine", []string{"engine: vm"}},
+		{"vm", ":engine js", []string{`unknown engine "js"`}},
+		{"vm", "let a = 40;\n:engine eval\nlet b = a + 1;\n:engine vm\na + b + 1", []string{"82\n"}},
+		{"vm", ":foo", []string{"unknown command :foo"}},
+		{"vm", ":help", []string{HELP}},
+	}
+	for _, tt := range tests {
+		out := runSession(tt.engine, tt.input+"\n")
+		for _, want := range tt.expected {
+			if !strings.Contains(out, want) {
+				t.Errorf("%s %q: output does not contain %q.\n%s", tt.engine, tt.input, want, out)
+			}
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	for _, engine := range []string{"vm", "eval"} {
+		r := newRepl(strings.NewReader(""), &bytes.Buffer{}, engine)
+		r.execute("let length = 1; let lemon = 2;")
+		tests := []struct {
+			word     string
+			expected string
+		}{
+			{"le", "lemon len length let"},
+			{"tr", "true try"},
+			{"p", "push puts"},
+			{":g", ":globals"},
+			{"zz", ""},
+		}
+		for _, tt := range tests {
+			if got := strings.Join(r.complete(tt.word), " "); got != tt.expected {
+				t.Errorf("%s: wrong completions of %q. want=%q, got=%q", engine, tt.word, tt.expected, got)
+			}
+		}
+	}
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "session.lyzs")
+
+	saved := `let add = fn(a) { a + 100 };
+let counter = fn() {
+  let n = 0;
+  {"inc": fn() { n = n + 1; n }, "get": fn() { n }}
+};
+let c = counter();
+c["inc"]();
+let cycle = [1]; cycle[0] = cycle; 0
+let size = len;
+let err = 0;
+try { 1 / 0 } catch (e) { err = e; }
+:save ` + path + "\n"
+	out := runSession("vm", saved)
+	if strings.Contains(out, "Woops") {
+		t.Fatalf("saving failed: %s", out)
+	}
+
+	tests := []struct {
+		engine   string
+		input    string
+		expected string
+	}{
+		{"vm", `c["inc"](); c["get"]()`, "2"},
+		{"vm", "add(size([1, 2]))", "102"},
+		{"vm", "len(cycle[0][0][0])", "1"},
+		{"vm", "err", "division by zero"},
+		{"eval", "size([1, 2])", "2"},
+		{"eval", "len(cycle[0][0][0])", "1"},
+		{"eval", "err", "division by zero"},
+	}
+	for _, tt := range tests {
+		out := runSession("vm", ":load "+path+"\n:engine "+tt.engine+"\n"+tt.input+"\n")
+		if !strings.HasSuffix(out, PROMPT+tt.expected+"\n"+PROMPT) {
+			t.Errorf("%s %q: wrong output. want=%q.\n%s", tt.engine, tt.input, tt.expected, out)
+		}
+	}
+
+	out = runSession("eval", "let f = fn() { 1 };\n:save "+path+"\n")
+	if !strings.Contains(out, "global f: cannot marshal FUNCTION value") {
+		t.Errorf("saving an eval function did not fail: %s", out)
+	}
+	out = runSession("vm", ":load "+filepath.Join(dir, "missing")+"\n:save\n")
+	if !strings.Contains(out, "Woops! :load failed") || !strings.Contains(out, "usage: :save <file>") {
+		t.Errorf("wrong errors: %s", out)
+	}
+}
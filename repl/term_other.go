@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package repl
+
+import "errors"
+
+// termState is the terminal mode to restore after reading a line
+type termState struct{}
+
+// isTerminal reports whether fd refers to a terminal. Line editing is not
+// supported on this platform, so input is always read line by line.
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*termState, error) {
+	return nil, errors.New("raw terminal mode is not supported")
+}
+
+func restore(fd int, state *termState) error {
+	return nil
+}
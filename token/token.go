@@ -1,21 +1,64 @@
 package token
 
+import (
+	"fmt"
+	"sort"
+)
+
 type TokenType string
 
+// Position is a location in the source text. Line and Column are 1-based,
+// Column counts bytes, and Offset is the 0-based byte offset.
+type Position struct {
+	Filename string
+	Offset   int
+	Line     int
+	Column   int
+}
+
+// IsValid reports whether the position was set by the lexer
+func (p Position) IsValid() bool { return p.Line > 0 }
+
+func (p Position) String() string {
+	s := p.Filename
+	if p.IsValid() {
+		if s != "" {
+			s += ":"
+		}
+		s += fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	if s == "" {
+		s = "-"
+	}
+	return s
+}
+
+// Token is a lexical token. Pos is the position of its first character and
+// End the position immediately after its last character.
 type Token struct {
 	Type    TokenType
 	Literal string
+	Pos     Position
+	End     Position
 }
 
 const (
 	ILLEGAL = "ILLEGAL"
 	EOF     = "EOF"
+	COMMENT = "COMMENT" // only produced when the lexer keeps comments
 
 	// Identifiers + literals
 	IDENT  = "IDENT" // foo, bar, x, y...
 	INT    = "INT"   // 5, 10...
+	FLOAT  = "FLOAT" // 1.5, 2e10...
 	STRING = "STRING"
 
+	// An interpolated string "a${x}b${y}c" is lexed as TEMPLATE_HEAD "a",
+	// the tokens of x, TEMPLATE_MIDDLE "b", the tokens of y, TEMPLATE_TAIL "c"
+	TEMPLATE_HEAD   = "TEMPLATE_HEAD"
+	TEMPLATE_MIDDLE = "TEMPLATE_MIDDLE"
+	TEMPLATE_TAIL   = "TEMPLATE_TAIL"
+
 	// Operators
 	ASSIGN   = "="  // 赋值
 	PLUS     = "+"  // 加法
@@ -27,6 +70,23 @@ const (
 	LT       = "<"  // 小于
 	GT       = ">"  // 大于
 	BANG     = "!"  // 取反
+	AND      = "&&" // 逻辑与
+	OR       = "||" // 逻辑或
+	LT_EQ    = "<=" // 小于等于
+	GT_EQ    = ">=" // 大于等于
+	PERCENT  = "%"  // 取模
+	POWER    = "**" // 乘方
+	BIT_AND  = "&"  // 按位与
+	BIT_OR   = "|"  // 按位或
+	BIT_XOR  = "^"  // 按位异或
+	SHL      = "<<" // 左移
+	SHR      = ">>" // 右移
+	TILDE    = "~"  // 按位取反
+
+	PLUS_ASSIGN     = "+="
+	MINUS_ASSIGN    = "-="
+	ASTERISK_ASSIGN = "*="
+	SLASH_ASSIGN    = "/="
 
 	// Special characters
 	COMMA     = ","
@@ -47,16 +107,44 @@ const (
 	IF       = "IF"
 	ELSE     = "ELSE"
 	RETURN   = "RETURN"
+	WHILE    = "WHILE"
+	FOR      = "FOR"
+	IN       = "IN"
+	BREAK    = "BREAK"
+	CONTINUE = "CONTINUE"
+	TRY      = "TRY"
+	CATCH    = "CATCH"
+	FINALLY  = "FINALLY"
+	THROW    = "THROW"
 )
 
 var keywords = map[string]TokenType{
-	"let":    LET,
-	"fn":     FUNCTION,
-	"true":   TRUE,
-	"false":  FALSE,
-	"if":     IF,
-	"else":   ELSE,
-	"return": RETURN,
+	"let":      LET,
+	"fn":       FUNCTION,
+	"true":     TRUE,
+	"false":    FALSE,
+	"if":       IF,
+	"else":     ELSE,
+	"return":   RETURN,
+	"while":    WHILE,
+	"for":      FOR,
+	"in":       IN,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"try":      TRY,
+	"catch":    CATCH,
+	"finally":  FINALLY,
+	"throw":    THROW,
+}
+
+// Keywords returns the sorted keywords of the language
+func Keywords() []string {
+	names := make([]string, 0, len(keywords))
+	for k := range keywords {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func LookupIdent(ident string) TokenType {
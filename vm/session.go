@@ -0,0 +1,252 @@
+package vm
+
+import (
+	"fmt"
+	"lyz-lang-2nd/ast"
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+)
+
+// Session compiles and runs successive programs that share their globals,
+// like the inputs of a REPL. It owns the symbol table and the constant pool
+// the programs are compiled with and the globals they run with, and keeps
+// them consistent: a program that fails to compile leaves the session as it
+// was, and a global defined by a program that fails before assigning it is
+// null.
+type Session struct {
+	symbols           *compiler.SymbolTable
+	constants         []object.Object
+	globals           []object.Object
+	builtins          *object.BuiltinRegistry
+	checkedArithmetic bool
+}
+
+// NewSession creates an empty session knowing the default builtins
+func NewSession() *Session {
+	return NewSessionWithBuiltins(nil)
+}
+
+// NewSessionWithBuiltins creates an empty session knowing the builtins of
+// builtins, or of object.DefaultBuiltins if it is nil
+func NewSessionWithBuiltins(builtins *object.BuiltinRegistry) *Session {
+	if builtins == nil {
+		builtins = object.DefaultBuiltins()
+	}
+	symbols := compiler.NewSymbolTable()
+	symbols.DefineBuiltins(builtins)
+	return &Session{
+		symbols:   symbols,
+		constants: []object.Object{},
+		globals:   make([]object.Object, GlobalSize),
+		builtins:  builtins,
+	}
+}
+
+// NewSessionFromState creates a session continuing from state, as saved by
+// State. The constants are verified since state may come from a file, and
+// the booleans and nulls of a loaded state are replaced by True, False and
+// Null.
+func NewSessionFromState(state *compiler.State) (*Session, error) {
+	builtins := state.Builtins
+	if builtins == nil {
+		builtins = object.DefaultBuiltins()
+	}
+	if err := VerifyWith(&compiler.Bytecode{Constants: state.Constants}, Options{Builtins: builtins}); err != nil {
+		return nil, err
+	}
+	s := &Session{
+		symbols:   state.Symbols,
+		constants: state.Constants,
+		globals:   make([]object.Object, GlobalSize),
+		builtins:  builtins,
+	}
+	seen := map[object.Object]bool{}
+	for i, c := range s.constants {
+		s.constants[i] = canonical(c, seen)
+	}
+	for i, g := range state.Globals {
+		s.globals[i] = canonical(g, seen)
+	}
+	return s, nil
+}
+
+// canonical returns obj with the booleans and nulls in it, which the VM
+// compares by identity, replaced by True, False and Null. seen holds the
+// values already visited, which may contain themselves.
+func canonical(obj object.Object, seen map[object.Object]bool) object.Object {
+	switch obj := obj.(type) {
+	case nil:
+		return nil
+	case *object.Boolean:
+		return nativeBoolToBooleanObject(obj.Value)
+	case *object.Null:
+		return Null
+	}
+	if seen[obj] {
+		return obj
+	}
+	seen[obj] = true
+	switch obj := obj.(type) {
+	case *object.Array:
+		for i, el := range obj.Elements {
+			obj.Elements[i] = canonical(el, seen)
+		}
+	case *object.Hash:
+		for k, pair := range obj.Pairs {
+			obj.Pairs[k] = object.HashPair{Key: canonical(pair.Key, seen), Value: canonical(pair.Value, seen)}
+		}
+	case *object.Closure:
+		for i, free := range obj.Free {
+			obj.Free[i] = canonical(free, seen)
+		}
+	case *object.Cell:
+		obj.Value = canonical(obj.Value, seen)
+	case *object.Error:
+		obj.Value = canonical(obj.Value, seen)
+	}
+	return obj
+}
+
+// SetCheckedArithmetic makes integer overflow a runtime error in the
+// programs run from now on
+func (s *Session) SetCheckedArithmetic(checked bool) {
+	s.checkedArithmetic = checked
+}
+
+// Compile compiles program against the symbols and constants of the
+// session, which are only extended if it compiles
+func (s *Session) Compile(program *ast.Program) (*compiler.Bytecode, error) {
+	symbols := s.symbols.Copy()
+	comp := compiler.NewWithState(symbols, s.constants)
+	if err := comp.Compile(program); err != nil {
+		return nil, err
+	}
+	bytecode := comp.Bytecode()
+	s.symbols, s.constants = symbols, bytecode.Constants
+	return bytecode, nil
+}
+
+// Run runs bytecode returned by Compile with the globals of the session and
+// returns the value of its last statement, or nil if that is not an
+// expression statement. A failure is returned as an *object.RuntimeError.
+func (s *Session) Run(bytecode *compiler.Bytecode) (object.Object, error) {
+	machine := NewWithOptions(bytecode, Options{Builtins: s.builtins, Globals: s.globals})
+	machine.SetCheckedArithmetic(s.checkedArithmetic)
+	if err := machine.Run(); err != nil {
+		for i := 0; i < s.numGlobals(); i++ {
+			if s.globals[i] == nil {
+				s.globals[i] = Null
+			}
+		}
+		return nil, err
+	}
+	if !bytecode.HasResult() {
+		return nil, nil
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Exec compiles and runs program, see Compile and Run
+func (s *Session) Exec(program *ast.Program) (object.Object, error) {
+	bytecode, err := s.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+	return s.Run(bytecode)
+}
+
+// Call calls fn, a closure or builtin, with args and returns its result. A
+// failure is returned as an *object.RuntimeError whose stack trace ends with
+// fn.
+func (s *Session) Call(fn object.Object, args ...object.Object) (object.Object, error) {
+	call, err := code.Encode(code.OpCall, len(args))
+	if err != nil {
+		return nil, err
+	}
+	bytecode := &compiler.Bytecode{
+		Instructions: append(call, code.Make(code.OpPop)...),
+		Constants:    s.constants,
+	}
+	machine := NewWithOptions(bytecode, Options{Builtins: s.builtins, Globals: s.globals})
+	machine.SetCheckedArithmetic(s.checkedArithmetic)
+	for _, obj := range append([]object.Object{fn}, args...) {
+		if err := machine.push(obj); err != nil {
+			return nil, machine.runtimeError(err)
+		}
+	}
+	if err := machine.Run(); err != nil {
+		if rerr, ok := err.(*object.RuntimeError); ok {
+			// leave out the main function making the call
+			rerr.Frames = rerr.Frames[:len(rerr.Frames)-1]
+		}
+		return nil, err
+	}
+	return machine.LastPoppedStackElem(), nil
+}
+
+// Symbols returns the symbol table of the session, which must not be
+// changed but through the session
+func (s *Session) Symbols() *compiler.SymbolTable {
+	return s.symbols
+}
+
+// Builtins returns the builtins the programs of the session can call
+func (s *Session) Builtins() *object.BuiltinRegistry {
+	return s.builtins
+}
+
+// numGlobals returns the number of globals defined by the symbol table that
+// fit in the globals store
+func (s *Session) numGlobals() int {
+	n := s.symbols.NumDefinitions()
+	if n > len(s.globals) {
+		n = len(s.globals)
+	}
+	return n
+}
+
+// Names returns the names of the globals that are set, by index
+func (s *Session) Names() []string {
+	var names []string
+	for i, name := range s.symbols.DefinedNames()[:s.numGlobals()] {
+		if name != "" && s.globals[i] != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Get returns the value of the global name
+func (s *Session) Get(name string) (object.Object, bool) {
+	sym, ok := s.symbols.Resolve(name)
+	if !ok || sym.Scope != compiler.GlobalScope || sym.Index >= len(s.globals) || s.globals[sym.Index] == nil {
+		return nil, false
+	}
+	return s.globals[sym.Index], true
+}
+
+// Set assigns value to the global name, defining it if needed. It fails
+// when the globals store is full.
+func (s *Session) Set(name string, value object.Object) error {
+	sym, ok := s.symbols.Resolve(name)
+	if !ok || sym.Scope != compiler.GlobalScope {
+		if s.symbols.NumDefinitions() >= len(s.globals) {
+			return fmt.Errorf("global %s: all %d globals are defined", name, len(s.globals))
+		}
+		sym = s.symbols.Define(name)
+	}
+	s.globals[sym.Index] = value
+	return nil
+}
+
+// State returns the state of the session, to be saved with
+// compiler.MarshalState
+func (s *Session) State() *compiler.State {
+	return &compiler.State{
+		Symbols:   s.symbols,
+		Constants: s.constants,
+		Globals:   s.globals[:s.numGlobals()],
+		Builtins:  s.builtins,
+	}
+}
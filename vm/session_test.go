@@ -0,0 +1,231 @@
+package vm
+
+import (
+	"fmt"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+	"testing"
+)
+
+func TestSessionSharesState(t *testing.T) {
+	s := NewSession()
+	// enough constants to reallocate the pool between the programs
+	for i := 0; i < 20; i++ {
+		name := "add" + string(rune('a'+i))
+		input := fmt.Sprintf("let %s = fn(x) { x + %d }; %s(%d)", name, 1000+i, name, i)
+		result, err := s.Exec(parse(input))
+		if err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+		if err := testIntegerObject(int64(1000+2*i), result); err != nil {
+			t.Fatalf("%q: %s", input, err)
+		}
+	}
+	result, err := s.Exec(parse("adda(1) + addt(1)"))
+	if err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if err := testIntegerObject(2021, result); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+func TestSessionCompileFailureLeavesState(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Exec(parse("let a = 1;")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	symbols, constants := s.Symbols(), len(s.State().Constants)
+
+	if _, err := s.Exec(parse(`let b = "unused"; let c = d;`)); err == nil {
+		t.Fatalf("expected a compilation error")
+	}
+	if s.Symbols() != symbols || len(s.State().Constants) != constants {
+		t.Errorf("failed compilation changed the session")
+	}
+	if _, ok := s.Symbols().Resolve("b"); ok {
+		t.Errorf("failed compilation defined b")
+	}
+	if _, err := s.Exec(parse("let b = a + 1;")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if sym, _ := s.Symbols().Resolve("b"); sym.Index != 1 {
+		t.Errorf("b has index %d, want 1", sym.Index)
+	}
+}
+
+func TestSessionRunFailureSetsNull(t *testing.T) {
+	s := NewSession()
+	_, err := s.Exec(parse("let a = 1; let b = 1 / 0; let c = 3;"))
+	if _, ok := err.(*object.RuntimeError); !ok {
+		t.Fatalf("expected a runtime error, got=%v", err)
+	}
+	for name, want := range map[string]object.Object{"a": &object.Integer{Value: 1}, "b": Null, "c": Null} {
+		value, ok := s.Get(name)
+		if !ok || value.Inspect() != want.Inspect() {
+			t.Errorf("%s = %v, want %s", name, value, want.Inspect())
+		}
+	}
+	if _, err := s.Exec(parse("let b = 2; a + b")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+}
+
+func TestSessionGetAndSet(t *testing.T) {
+	s := NewSession()
+	if _, ok := s.Get("x"); ok {
+		t.Errorf("undefined global x found")
+	}
+	if _, ok := s.Get("len"); ok {
+		t.Errorf("builtin len found as a global")
+	}
+	s.Set("x", &object.Integer{Value: 20})
+	result, err := s.Exec(parse("let y = x * 2; y + 2"))
+	if err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if err := testIntegerObject(42, result); err != nil {
+		t.Errorf("%s", err)
+	}
+	s.Set("x", &object.Integer{Value: 1})
+	if value, _ := s.Get("y"); testIntegerObject(40, value) != nil {
+		t.Errorf("y = %v, want 40", value)
+	}
+	if names := fmt.Sprint(s.Names()); names != "[x y]" {
+		t.Errorf("names = %s, want [x y]", names)
+	}
+}
+
+func TestSessionFromState(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Exec(parse("let counter = fn() { let n = 0; fn() { n = n + 1; n } }(); counter();")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	data, err := compiler.MarshalState(s.State())
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	state, err := compiler.UnmarshalState(data, nil)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	restored, err := NewSessionFromState(state)
+	if err != nil {
+		t.Fatalf("restoring failed: %s", err)
+	}
+	result, err := restored.Exec(parse("counter()"))
+	if err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if err := testIntegerObject(2, result); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	state.Constants = append(state.Constants, &object.CompiledFunction{Instructions: []byte{255}})
+	if _, err := NewSessionFromState(state); err == nil {
+		t.Errorf("expected invalid constants to be rejected")
+	}
+}
+
+func TestSessionCall(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Exec(parse("let scale = 3; let mul = fn(x) { let f = fn(y) { y * scale }; f(x) };")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	mul, _ := s.Get("mul")
+	result, err := s.Call(mul, &object.Integer{Value: 14})
+	if err != nil {
+		t.Fatalf("call failed: %s", err)
+	}
+	if err := testIntegerObject(42, result); err != nil {
+		t.Errorf("%s", err)
+	}
+
+	_, err = s.Call(mul, &object.String{Value: "x"})
+	rerr, ok := err.(*object.RuntimeError)
+	if !ok {
+		t.Fatalf("expected a runtime error, got=%v", err)
+	}
+	if len(rerr.Frames) != 2 || rerr.Frames[1].Function != "mul" {
+		t.Errorf("wrong stack trace:\n%s", rerr.StackTrace())
+	}
+}
+
+func TestSessionBuiltins(t *testing.T) {
+	builtins := object.NewBuiltinRegistry()
+	builtins.Register("seven", func(args ...object.Object) object.Object { return &object.Integer{Value: 7} })
+	s := NewSessionWithBuiltins(builtins)
+	if _, err := s.Exec(parse("let f = seven;")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	data, err := compiler.MarshalState(s.State())
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	state, err := compiler.UnmarshalState(data, builtins)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	restored, err := NewSessionFromState(state)
+	if err != nil {
+		t.Fatalf("restoring failed: %s", err)
+	}
+	result, err := restored.Exec(parse("f() * seven()"))
+	if err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if err := testIntegerObject(49, result); err != nil {
+		t.Errorf("%s", err)
+	}
+}
+
+func TestSessionGlobalsLimit(t *testing.T) {
+	s := NewSession()
+	for i := 0; i < GlobalSize; i++ {
+		if err := s.Set(fmt.Sprintf("g%d", i), Null); err != nil {
+			t.Fatalf("set failed: %s", err)
+		}
+	}
+	if err := s.Set("extra", Null); err == nil {
+		t.Errorf("expected setting a global beyond the store to fail")
+	}
+	if _, err := s.Exec(parse("let extra = 1; extra")); err == nil {
+		t.Errorf("expected defining a global beyond the store to fail")
+	}
+	if _, ok := s.Get("extra"); ok {
+		t.Errorf("global beyond the store found")
+	}
+	if err := s.Set("g0", &object.Integer{Value: 1}); err != nil {
+		t.Errorf("set of a defined global failed: %s", err)
+	}
+	if n := len(s.State().Globals); n != GlobalSize {
+		t.Errorf("state has %d globals, want %d", n, GlobalSize)
+	}
+}
+
+func TestSessionFromStateBooleans(t *testing.T) {
+	s := NewSession()
+	if _, err := s.Exec(parse("let flag = false; let nothing = if (flag) { 1 }; let list = [true, flag, nothing];")); err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	data, err := compiler.MarshalState(s.State())
+	if err != nil {
+		t.Fatalf("marshal failed: %s", err)
+	}
+	state, err := compiler.UnmarshalState(data, nil)
+	if err != nil {
+		t.Fatalf("unmarshal failed: %s", err)
+	}
+	restored, err := NewSessionFromState(state)
+	if err != nil {
+		t.Fatalf("restoring failed: %s", err)
+	}
+	result, err := restored.Exec(parse(`[if (flag) { "yes" } else { "no" }, !flag, flag == false,
+		if (nothing) { "yes" } else { "no" }, !nothing, if (list[0]) { "yes" } else { "no" }, list[2] == nothing]`))
+	if err != nil {
+		t.Fatalf("exec failed: %s", err)
+	}
+	if expected := "[no, true, true, no, true, yes, true]"; result.Inspect() != expected {
+		t.Errorf("result = %s, want %s", result.Inspect(), expected)
+	}
+}
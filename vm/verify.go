@@ -0,0 +1,327 @@
+package vm
+
+import (
+	"fmt"
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+)
+
+// Verify checks bytecode before it is run, so that malformed bytecode, such
+// as a corrupted .lyzc file, is reported instead of crashing the VM. It checks
+// the main function and every CompiledFunction in the constant pool for
+// valid opcodes, operands within bounds, jump targets on instruction
+// boundaries, and a stack depth and number of active exception handlers
+// that are the same on every path to an instruction and never drop below
+// zero.
+func Verify(bytecode *compiler.Bytecode) error {
+	return VerifyWith(bytecode, Options{})
+}
+
+// VerifyWith checks bytecode like Verify, for a VM configured by opts
+func VerifyWith(bytecode *compiler.Bytecode, opts Options) error {
+	v := &verifier{
+		constants:  bytecode.Constants,
+		freeCounts: map[*object.CompiledFunction]int{},
+		builtins:   opts.Builtins,
+		globals:    len(opts.Globals),
+	}
+	if v.builtins == nil {
+		v.builtins = object.DefaultBuiltins()
+	}
+	if opts.Globals == nil {
+		v.globals = GlobalSize
+	}
+
+	fns := []*verifiedFunction{{
+		name: "main",
+		fn: &object.CompiledFunction{
+			Instructions: bytecode.Instructions,
+			Handlers:     bytecode.Handlers,
+		},
+		main: true,
+	}}
+	for i, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			name := fmt.Sprintf("constant %d", i)
+			if fn.Name != "" {
+				name += fmt.Sprintf(" (%s)", fn.Name)
+			}
+			fns = append(fns, &verifiedFunction{name: name, fn: fn})
+		}
+	}
+
+	for _, f := range fns {
+		if err := v.decode(f); err != nil {
+			return err
+		}
+	}
+	for _, f := range fns {
+		if err := v.checkOperands(f); err != nil {
+			return err
+		}
+		if err := v.checkStack(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type verifier struct {
+	constants []object.Object
+	builtins  *object.BuiltinRegistry
+	globals   int // size of the globals store
+
+	// freeCounts is the smallest number of free variables any OpClosure
+	// gives a function. A function that is never turned into a closure
+	// cannot run, so its free variables are not checked.
+	freeCounts map[*object.CompiledFunction]int
+}
+
+type verifiedFunction struct {
+	name         string
+	fn           *object.CompiledFunction
+	main         bool
+	instructions []code.Instruction
+	boundaries   map[int]int // instruction offset to index in instructions
+}
+
+func (f *verifiedFunction) errorf(offset int, format string, a ...interface{}) error {
+	return fmt.Errorf("invalid bytecode in %s at %04d: %s", f.name, offset, fmt.Sprintf(format, a...))
+}
+
+// decode splits the instructions of f and records the free variable counts
+// of the closures it creates
+func (v *verifier) decode(f *verifiedFunction) error {
+	decoded, err := code.Decode(f.fn.Instructions)
+	if err != nil {
+		derr := err.(*code.DecodeError)
+		return f.errorf(derr.Offset, "%s", derr.Message)
+	}
+	f.instructions = decoded
+	f.boundaries = map[int]int{}
+	for i, ins := range decoded {
+		f.boundaries[ins.Offset] = i
+		if ins.Op == code.OpClosure && ins.Operands[0] < len(v.constants) {
+			if fn, ok := v.constants[ins.Operands[0]].(*object.CompiledFunction); ok {
+				if n, seen := v.freeCounts[fn]; !seen || ins.Operands[1] < n {
+					v.freeCounts[fn] = ins.Operands[1]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// isTarget reports whether control may be transferred to offset: the start
+// of an instruction or, for the main function, the end of the instructions
+func (f *verifiedFunction) isTarget(offset int) bool {
+	if _, ok := f.boundaries[offset]; ok {
+		return true
+	}
+	return f.main && offset == len(f.fn.Instructions)
+}
+
+func (v *verifier) checkOperands(f *verifiedFunction) error {
+	fn := f.fn
+	if fn.NumParameters > fn.NumLocals {
+		return f.errorf(0, "%d parameters but only %d locals", fn.NumParameters, fn.NumLocals)
+	}
+	for i, h := range fn.Handlers {
+		if !f.isTarget(h.Start) || !f.isTarget(h.End) || h.Start > h.End {
+			return f.errorf(h.Start, "handler %d covers invalid range [%d, %d)", i, h.Start, h.End)
+		}
+		if _, ok := f.boundaries[h.Catch]; !ok {
+			return f.errorf(h.Start, "handler %d catch target %d is not an instruction boundary", i, h.Catch)
+		}
+	}
+
+	freeCount, closed := v.freeCounts[fn]
+	for _, ins := range f.instructions {
+		var operand int
+		if len(ins.Operands) > 0 {
+			operand = ins.Operands[0]
+		}
+
+		switch ins.Op {
+		case code.OpConstant:
+			if operand >= len(v.constants) {
+				return f.errorf(ins.Offset, "constant index %d out of range, pool has %d constants", operand, len(v.constants))
+			}
+		case code.OpClosure:
+			if operand >= len(v.constants) {
+				return f.errorf(ins.Offset, "constant index %d out of range, pool has %d constants", operand, len(v.constants))
+			}
+			if _, ok := v.constants[operand].(*object.CompiledFunction); !ok {
+				return f.errorf(ins.Offset, "constant %d is %s, not a function", operand, v.constants[operand].Type())
+			}
+		case code.OpGetGlobal, code.OpSetGlobal:
+			if operand >= v.globals {
+				return f.errorf(ins.Offset, "global index %d out of range, at most %d globals", operand, v.globals)
+			}
+		case code.OpGetLocal, code.OpSetLocal, code.OpAssignLocal, code.OpCaptureLocal:
+			if operand >= fn.NumLocals {
+				return f.errorf(ins.Offset, "local index %d out of range, function has %d locals", operand, fn.NumLocals)
+			}
+		case code.OpGetFree, code.OpAssignFree, code.OpCaptureFree:
+			if f.main {
+				return f.errorf(ins.Offset, "%s outside a function", ins.Def.Name)
+			}
+			if closed && operand >= freeCount {
+				return f.errorf(ins.Offset, "free variable index %d out of range, closure has %d free variables", operand, freeCount)
+			}
+		case code.OpGetBuiltin:
+			if operand >= v.builtins.Len() {
+				return f.errorf(ins.Offset, "builtin index %d out of range, there are %d builtins", operand, v.builtins.Len())
+			}
+		case code.OpTry:
+			if operand >= len(fn.Handlers) {
+				return f.errorf(ins.Offset, "handler index %d out of range, function has %d handlers", operand, len(fn.Handlers))
+			}
+		case code.OpHash:
+			if operand%2 != 0 {
+				return f.errorf(ins.Offset, "odd number of hash elements %d", operand)
+			}
+		case code.OpReturn, code.OpReturnValue, code.OpCurrentClosure:
+			if f.main {
+				return f.errorf(ins.Offset, "%s outside a function", ins.Def.Name)
+			}
+		}
+
+		if code.IsJump(ins.Op) && !f.isTarget(operand) {
+			return f.errorf(ins.Offset, "jump target %d is not an instruction boundary", operand)
+		}
+	}
+	return nil
+}
+
+// stackEffect returns the number of values ins needs on the stack and the
+// number of values it leaves there in their place
+func stackEffect(ins code.Instruction) (pops, pushes int) {
+	switch ins.Op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal,
+		code.OpGetLocal, code.OpCaptureLocal, code.OpGetBuiltin, code.OpGetFree,
+		code.OpCaptureFree, code.OpCurrentClosure:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+		code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+		code.OpGreaterOrEqual, code.OpLessOrEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang, code.OpBitNot, code.OpIter, code.OpCaughtError:
+		return 1, 1
+	case code.OpPop, code.OpSetGlobal, code.OpSetLocal, code.OpAssignLocal,
+		code.OpAssignFree, code.OpJumpNotTruthy, code.OpReturnValue, code.OpThrow:
+		return 1, 0
+	case code.OpSetIndex:
+		return 3, 0
+	case code.OpArray, code.OpHash, code.OpInterpolate:
+		return ins.Operands[0], 1
+	case code.OpCall:
+		return ins.Operands[0] + 1, 1
+	case code.OpClosure:
+		return ins.Operands[1], 1
+	case code.OpJumpNotTruthyOrPop, code.OpJumpTruthyOrPop:
+		return 1, 1 // the value is only popped when not jumping
+	case code.OpIterNext:
+		return 1, 1 // the element is only pushed when not jumping
+	}
+	return 0, 0
+}
+
+// checkStack follows every path through f, computing the stack depth before
+// each instruction relative to the start of the frame, and the number of
+// handlers the function activated with OpTry and has not ended
+func (v *verifier) checkStack(f *verifiedFunction) error {
+	depths := make([]int, len(f.instructions))
+	for i := range depths {
+		depths[i] = -1
+	}
+	tries := make([]int, len(f.instructions))
+	var work []int
+
+	// flow records that control reaches offset with depth values on the
+	// stack and tryDepth active handlers
+	flow := func(from code.Instruction, offset int, depth, tryDepth int) error {
+		if offset == len(f.fn.Instructions) {
+			if !f.main {
+				return f.errorf(from.Offset, "control falls off the end of the function")
+			}
+			return nil
+		}
+		i := f.boundaries[offset]
+		switch {
+		case depths[i] == -1:
+			depths[i], tries[i] = depth, tryDepth
+			work = append(work, i)
+		case depths[i] != depth:
+			return f.errorf(offset, "stack depth %d from %04d does not match depth %d from another path", depth, from.Offset, depths[i])
+		case tries[i] != tryDepth:
+			return f.errorf(offset, "%d active handlers from %04d do not match %d from another path", tryDepth, from.Offset, tries[i])
+		}
+		return nil
+	}
+
+	if len(f.instructions) == 0 {
+		if !f.main {
+			return f.errorf(0, "control falls off the end of the function")
+		}
+		return nil
+	}
+	depths[0] = 0
+	work = append(work, 0)
+	for len(work) > 0 {
+		i := work[len(work)-1]
+		work = work[:len(work)-1]
+		ins := f.instructions[i]
+		depth, tryDepth := depths[i], tries[i]
+
+		pops, pushes := stackEffect(ins)
+		if depth < pops {
+			return f.errorf(ins.Offset, "%s needs %d values on the stack, found %d", ins.Def.Name, pops, depth)
+		}
+		if ins.Op == code.OpEndTry && tryDepth == 0 {
+			return f.errorf(ins.Offset, "OpEndTry without an active handler")
+		}
+
+		next := len(f.fn.Instructions)
+		if i+1 < len(f.instructions) {
+			next = f.instructions[i+1].Offset
+		}
+
+		var err error
+		switch ins.Op {
+		case code.OpReturn, code.OpReturnValue, code.OpThrow:
+			// no successor inside the function
+		case code.OpJump:
+			err = flow(ins, ins.Operands[0], depth, tryDepth)
+		case code.OpJumpNotTruthy:
+			if err = flow(ins, ins.Operands[0], depth-1, tryDepth); err == nil {
+				err = flow(ins, next, depth-1, tryDepth)
+			}
+		case code.OpJumpNotTruthyOrPop, code.OpJumpTruthyOrPop:
+			if err = flow(ins, ins.Operands[0], depth, tryDepth); err == nil {
+				err = flow(ins, next, depth-1, tryDepth)
+			}
+		case code.OpIterNext:
+			if err = flow(ins, ins.Operands[0], depth-1, tryDepth); err == nil {
+				err = flow(ins, next, depth, tryDepth)
+			}
+		case code.OpTry:
+			// the VM unwinds to the depth at OpTry, deactivating the
+			// handler, and pushes the exception
+			handler := f.fn.Handlers[ins.Operands[0]]
+			if err = flow(ins, handler.Catch, depth+1, tryDepth); err == nil {
+				err = flow(ins, next, depth, tryDepth+1)
+			}
+		case code.OpEndTry:
+			err = flow(ins, next, depth, tryDepth-1)
+		default:
+			err = flow(ins, next, depth-pops+pushes, tryDepth)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
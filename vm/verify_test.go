@@ -0,0 +1,160 @@
+package vm
+
+import (
+	"lyz-lang-2nd/code"
+	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/object"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	fn := func(numLocals int, ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concat(ins...), NumLocals: numLocals}
+	}
+
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: code.Instructions{255}},
+			"invalid bytecode in main at 0000: opcode 255 undefined",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 1)[:2]},
+			"invalid bytecode in main at 0000: truncated OpConstant instruction",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpNull), []byte{byte(code.OpWide)})},
+			"invalid bytecode in main at 0001: OpWide at end of instructions",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat([]byte{byte(code.OpWide)}, code.Make(code.OpJump, 0), []byte{0, 0})},
+			"invalid bytecode in main at 0000: opcode OpJump cannot be widened",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpConstant, 1), Constants: []object.Object{&object.Integer{}}},
+			"invalid bytecode in main at 0000: constant index 1 out of range, pool has 1 constants",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpNull), code.Make(code.OpJump, 2))},
+			"invalid bytecode in main at 0001: jump target 2 is not an instruction boundary",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpPop)},
+			"invalid bytecode in main at 0000: OpPop needs 1 values on the stack, found 0",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(
+				code.Make(code.OpTrue),
+				code.Make(code.OpJumpNotTruthy, 5),
+				code.Make(code.OpNull),
+				code.Make(code.OpPop),
+			)},
+			"invalid bytecode in main at 0005: stack depth 1 from 0004 does not match depth 0 from another path",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(code.Make(code.OpNull), code.Make(code.OpReturnValue))},
+			"invalid bytecode in main at 0001: OpReturnValue outside a function",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpGetGlobal, GlobalSize)},
+			"invalid bytecode in main at 0000: global index 65536 out of range, at most 65536 globals",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpGetBuiltin, 200)},
+			"invalid bytecode in main at 0000: builtin index 200 out of range, there are 6 builtins",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpClosure, 0, 0), Constants: []object.Object{&object.Integer{}}},
+			"invalid bytecode in main at 0000: constant 0 is INTEGER, not a function",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpNull),
+				Constants:    []object.Object{fn(0, code.Make(code.OpGetLocal, 0), code.Make(code.OpReturnValue))},
+			},
+			"invalid bytecode in constant 0 at 0000: local index 0 out of range, function has 0 locals",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: code.Make(code.OpNull),
+				Constants:    []object.Object{fn(0, code.Make(code.OpNull))},
+			},
+			"invalid bytecode in constant 0 at 0000: control falls off the end of the function",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpNull), code.Make(code.OpClosure, 0, 1)),
+				Constants:    []object.Object{fn(0, code.Make(code.OpGetFree, 1), code.Make(code.OpReturnValue))},
+			},
+			"invalid bytecode in constant 0 at 0000: free variable index 1 out of range, closure has 1 free variables",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpClosure, 0, 1), Constants: []object.Object{fn(0, code.Make(code.OpReturn))}},
+			"invalid bytecode in main at 0000: OpClosure needs 1 values on the stack, found 0",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpTry, 0), code.Make(code.OpEndTry)),
+				Handlers:     []code.ExceptionHandler{{Start: 0, End: 4, Catch: 1}},
+			},
+			"invalid bytecode in main at 0000: handler 0 catch target 1 is not an instruction boundary",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpTry, 0)},
+			"invalid bytecode in main at 0000: handler index 0 out of range, function has 0 handlers",
+		},
+		{
+			&compiler.Bytecode{Instructions: code.Make(code.OpEndTry)},
+			"invalid bytecode in main at 0000: OpEndTry without an active handler",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpTry, 0), code.Make(code.OpEndTry), code.Make(code.OpEndTry), code.Make(code.OpPop)),
+				Handlers:     []code.ExceptionHandler{{Start: 0, End: 4, Catch: 5}},
+			},
+			"invalid bytecode in main at 0004: OpEndTry without an active handler",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 7), code.Make(code.OpTry, 0), code.Make(code.OpNull), code.Make(code.OpPop)),
+				Handlers:     []code.ExceptionHandler{{Start: 4, End: 7, Catch: 8}},
+			},
+			"invalid bytecode in main at 0007: 1 active handlers from 0004 do not match 0 from another path",
+		},
+	}
+
+	for i, tt := range tests {
+		err := Verify(tt.bytecode)
+		if err == nil {
+			t.Errorf("test %d: expected verifier error %q", i, tt.expected)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("test %d: wrong error.\nwant=%q\n got=%q", i, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestVerifyNamesFunctions(t *testing.T) {
+	bytecode := &compiler.Bytecode{
+		Instructions: code.Make(code.OpNull),
+		Constants: []object.Object{
+			&object.Integer{Value: 1},
+			&object.CompiledFunction{Name: "f", Instructions: code.Make(code.OpPop)},
+		},
+	}
+	expected := "invalid bytecode in constant 1 (f) at 0000: OpPop needs 1 values on the stack, found 0"
+	err := Verify(bytecode)
+	if err == nil || err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%v", expected, err)
+	}
+}
@@ -1,15 +1,18 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
 	"lyz-lang-2nd/code"
 	"lyz-lang-2nd/compiler"
 	"lyz-lang-2nd/object"
+	"math"
+	"strings"
 )
 
 const (
 	StackSize  = 2048
-	GlobalSize = 65536
+	GlobalSize = compiler.MaxGlobals
 	MaxFrames  = 1024
 )
 
@@ -27,35 +30,149 @@ type VM struct {
 	globals    []object.Object
 	frames     []*Frame
 	frameIndex int
+	tries      []tryBlock    // active exception handlers, innermost last
+	caught     *object.Error // error last passed to a handler, for OpCaughtError
+	builtins   *object.BuiltinRegistry
+
+	checkedArithmetic bool
+}
+
+// tryBlock is an exception handler activated by OpTry
+type tryBlock struct {
+	frameIndex int // frameIndex of the VM when the handler was activated
+	sp         int // stack pointer to restore before running the catch code
+	catch      int // position of the catch code in the frame's instructions
+}
+
+// thrownError carries an exception through the Go error returns of the VM
+type thrownError struct {
+	err *object.Error
+}
+
+func (e *thrownError) Error() string { return e.err.Message }
+
+// Options configure a VM created by NewWithOptions
+type Options struct {
+	// Builtins are the builtins the bytecode was compiled with,
+	// object.DefaultBuiltins if nil
+	Builtins *object.BuiltinRegistry
+
+	// Globals stores the global variables, a new store of GlobalSize if nil
+	Globals []object.Object
 }
 
 // New creates an instance of vm
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFunc := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	return NewWithOptions(bytecode, Options{})
+}
+
+func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
+	return NewWithOptions(bytecode, Options{Globals: s})
+}
+
+// NewWithOptions creates an instance of vm configured by opts
+func NewWithOptions(bytecode *compiler.Bytecode, opts Options) *VM {
+	mainFunc := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		Name:         object.MainFunctionName,
+		SourceMap:    bytecode.SourceMap,
+		Handlers:     bytecode.Handlers,
+	}
 	mainClosure := &object.Closure{Fn: mainFunc}
 	mainFrame := NewFrame(mainClosure, 0)
 
 	frames := make([]*Frame, MaxFrames)
 	frames[0] = mainFrame
 
+	if opts.Builtins == nil {
+		opts.Builtins = object.DefaultBuiltins()
+	}
+	if opts.Globals == nil {
+		opts.Globals = make([]object.Object, GlobalSize)
+	}
+
 	return &VM{
 		constants:  bytecode.Constants,
 		stack:      make([]object.Object, StackSize),
 		sp:         0,
-		globals:    make([]object.Object, GlobalSize),
+		globals:    opts.Globals,
 		frames:     frames,
 		frameIndex: 1,
+		builtins:   opts.Builtins,
 	}
 }
 
-func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
-	vm.globals = s
-	return vm
+// SetCheckedArithmetic makes integer overflow a runtime error instead of
+// wrapping around
+func (vm *VM) SetCheckedArithmetic(checked bool) {
+	vm.checkedArithmetic = checked
 }
 
-// Run method means power on the vm
+// Run method means power on the vm. A failure that is not caught by the
+// program is returned as an *object.RuntimeError.
 func (vm *VM) Run() error {
+	for {
+		err := vm.run()
+		if err == nil {
+			return nil
+		}
+		if !vm.unwind(err) {
+			return vm.runtimeError(err)
+		}
+	}
+}
+
+// unwind transfers control to the innermost active exception handler with
+// the value of err on the stack, reporting false if there is none
+func (vm *VM) unwind(err error) bool {
+	if len(vm.tries) == 0 {
+		return false
+	}
+	t := vm.tries[len(vm.tries)-1]
+	vm.tries = vm.tries[:len(vm.tries)-1]
+
+	// the stack trace is taken before leaving the frames that threw
+	vm.caught = vm.caughtError(err)
+	vm.frameIndex = t.frameIndex
+	vm.sp = t.sp
+	vm.currentFrame().ip = t.catch - 1
+
+	vm.push(vm.caught.Thrown())
+	return true
+}
+
+// caughtError converts err to the error value a finally block rethrows,
+// keeping the stack trace of where it was thrown
+func (vm *VM) caughtError(err error) *object.Error {
+	rerr := vm.runtimeError(err)
+	caught := &object.Error{Message: rerr.Message, Trace: rerr.Frames, Omitted: rerr.Omitted}
+	var thrown *thrownError
+	if errors.As(err, &thrown) {
+		caught.Value = thrown.err.Value
+	}
+	return caught
+}
+
+// runtimeError attaches a stack trace built from the active frames to err,
+// unless it is rethrown by a finally block and already has one
+func (vm *VM) runtimeError(err error) *object.RuntimeError {
+	var thrown *thrownError
+	if errors.As(err, &thrown) && thrown.err.Trace != nil {
+		return thrown.err.RuntimeError()
+	}
+	rerr := &object.RuntimeError{Message: err.Error()}
+	for i := vm.frameIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+		pos, _ := frame.cl.Fn.SourceMap.Lookup(frame.ip)
+		rerr.Frames, rerr.Omitted = object.AddFrame(rerr.Frames, rerr.Omitted, object.StackFrame{
+			Function: object.FunctionName(frame.cl.Fn.Name),
+			Pos:      pos,
+		})
+	}
+	return rerr
+}
+
+func (vm *VM) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
@@ -74,7 +191,8 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod, code.OpPow,
+			code.OpBitAnd, code.OpBitOr, code.OpBitXor, code.OpShiftLeft, code.OpShiftRight:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -91,7 +209,8 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+			code.OpGreaterOrEqual, code.OpLessOrEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -104,7 +223,12 @@ func (vm *VM) Run() error {
 		case code.OpMinus:
 			err := vm.executeMinusOperator()
 			if err != nil {
-				return nil
+				return err
+			}
+		case code.OpBitNot:
+			err := vm.executeBitNotOperator()
+			if err != nil {
+				return err
 			}
 		case code.OpJump:
 			pos := int(code.ReadUint16(ins[ip+1:]))
@@ -117,6 +241,16 @@ func (vm *VM) Run() error {
 			if !isTruthy(cond) {
 				vm.currentFrame().ip = pos - 1
 			}
+		case code.OpJumpNotTruthyOrPop, code.OpJumpTruthyOrPop:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			cond := vm.stack[vm.sp-1]
+			if isTruthy(cond) == (op == code.OpJumpTruthyOrPop) {
+				vm.currentFrame().ip = pos - 1
+			} else {
+				vm.pop()
+			}
 		case code.OpNull:
 			err := vm.push(Null)
 			if err != nil {
@@ -125,7 +259,7 @@ func (vm *VM) Run() error {
 		case code.OpGetGlobal:
 			index := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
-			err := vm.push(vm.globals[index])
+			err := vm.push(deref(vm.globals[index]))
 			if err != nil {
 				return err
 			}
@@ -136,29 +270,48 @@ func (vm *VM) Run() error {
 		case code.OpArray:
 			num := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
-			arr := make([]object.Object, num)
-			for i := num - 1; i >= 0; i-- {
-				arr[i] = vm.pop()
+			err := vm.buildArray(num)
+			if err != nil {
+				return err
 			}
-			err := vm.push(&object.Array{Elements: arr})
+		case code.OpInterpolate:
+			num := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+			err := vm.interpolate(num)
+			if err != nil {
+				return err
+			}
+		case code.OpIter:
+			iterable := vm.pop()
+			iterator, ok := object.NewIterator(iterable)
+			if !ok {
+				return fmt.Errorf("cannot iterate over %s", iterable.Type())
+			}
+			err := vm.push(iterator)
+			if err != nil {
+				return err
+			}
+		case code.OpIterNext:
+			pos := int(code.ReadUint16(ins[ip+1:]))
+			vm.currentFrame().ip += 2
+
+			iterator, ok := vm.pop().(*object.Iterator)
+			if !ok {
+				return fmt.Errorf("OpIterNext without an iterator")
+			}
+			elem, ok := iterator.Next()
+			if !ok {
+				vm.currentFrame().ip = pos - 1
+				break
+			}
+			err := vm.push(elem)
 			if err != nil {
 				return err
 			}
 		case code.OpHash:
 			num := int(code.ReadUint16(ins[ip+1:]))
 			vm.currentFrame().ip += 2
-			hash := make(map[object.HashKey]object.HashPair)
-			for i := 0; i < num; i += 2 {
-				v := vm.pop()
-				k := vm.pop()
-				kp := object.HashPair{Key: k, Value: v}
-				hashKey, ok := k.(object.Hashable)
-				if !ok {
-					return fmt.Errorf("unusable as hash key: %s", k.Type())
-				}
-				hash[hashKey.HashKey()] = kp
-			}
-			err := vm.push(&object.Hash{Pairs: hash})
+			err := vm.buildHash(num)
 			if err != nil {
 				return err
 			}
@@ -169,6 +322,31 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpSetIndex:
+			value := vm.pop()
+			index := vm.pop()
+			left := vm.pop()
+			err := vm.executeSetIndex(left, index, value)
+			if err != nil {
+				return err
+			}
+		case code.OpTry:
+			index := code.ReadUint16(ins[ip+1:])
+			vm.currentFrame().ip += 2
+
+			vm.enterTry(int(index))
+		case code.OpEndTry:
+			if len(vm.tries) == 0 || vm.tries[len(vm.tries)-1].frameIndex != vm.frameIndex {
+				return fmt.Errorf("OpEndTry without an active handler")
+			}
+			vm.tries = vm.tries[:len(vm.tries)-1]
+		case code.OpThrow:
+			return &thrownError{err: object.NewThrownError(vm.pop())}
+		case code.OpCaughtError:
+			if vm.caught == nil {
+				return fmt.Errorf("OpCaughtError without a caught error")
+			}
+			vm.stack[vm.sp-1], vm.caught = vm.caught, nil
 		case code.OpCall:
 			numArgs := int(code.ReadUint8(ins[ip+1:]))
 			vm.currentFrame().ip++
@@ -202,7 +380,20 @@ func (vm *VM) Run() error {
 			localIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip++
 
-			err := vm.push(vm.stack[vm.currentFrame().basePointer+int(localIndex)])
+			err := vm.push(deref(vm.stack[vm.currentFrame().basePointer+int(localIndex)]))
+			if err != nil {
+				return err
+			}
+		case code.OpAssignLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			vm.assignLocal(int(localIndex))
+		case code.OpCaptureLocal:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			err := vm.captureLocal(int(localIndex))
 			if err != nil {
 				return err
 			}
@@ -210,8 +401,7 @@ func (vm *VM) Run() error {
 			index := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip++
 
-			builtin := object.Builtins[index]
-			err := vm.push(builtin.Builtin)
+			err := vm.push(vm.builtins.Get(int(index)))
 			if err != nil {
 				return err
 			}
@@ -228,6 +418,20 @@ func (vm *VM) Run() error {
 			index := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip++
 
+			currentClosure := vm.currentFrame().cl
+			err := vm.push(deref(currentClosure.Free[index]))
+			if err != nil {
+				return err
+			}
+		case code.OpAssignFree:
+			index := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
+			vm.assignFree(int(index))
+		case code.OpCaptureFree:
+			index := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip++
+
 			currentClosure := vm.currentFrame().cl
 			err := vm.push(currentClosure.Free[index])
 			if err != nil {
@@ -239,11 +443,141 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+		case code.OpWide:
+			err := vm.executeWide(ins, ip)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// executeWide executes the instruction following an OpWide prefix, whose
+// operands are twice as wide as usual
+func (vm *VM) executeWide(ins code.Instructions, ip int) error {
+	op := code.Opcode(ins[ip+1])
+	def, err := code.LookupWide(byte(op))
+	if err != nil {
+		return err
+	}
+	operands, read := code.ReadOperands(def, ins[ip+2:])
+	vm.currentFrame().ip += 1 + read
+
+	switch op {
+	case code.OpConstant:
+		return vm.push(vm.constants[operands[0]])
+	case code.OpGetGlobal, code.OpSetGlobal:
+		index := operands[0]
+		if index >= len(vm.globals) {
+			return fmt.Errorf("global index out of range: %d", index)
+		}
+		if op == code.OpSetGlobal {
+			vm.globals[index] = vm.pop()
+			return nil
 		}
+		return vm.push(deref(vm.globals[index]))
+	case code.OpArray:
+		return vm.buildArray(operands[0])
+	case code.OpHash:
+		return vm.buildHash(operands[0])
+	case code.OpInterpolate:
+		return vm.interpolate(operands[0])
+	case code.OpTry:
+		vm.enterTry(operands[0])
+	case code.OpCall:
+		return vm.executeCall(operands[0])
+	case code.OpSetLocal:
+		vm.stack[vm.currentFrame().basePointer+operands[0]] = vm.pop()
+	case code.OpGetLocal:
+		return vm.push(deref(vm.stack[vm.currentFrame().basePointer+operands[0]]))
+	case code.OpAssignLocal:
+		vm.assignLocal(operands[0])
+	case code.OpCaptureLocal:
+		return vm.captureLocal(operands[0])
+	case code.OpGetBuiltin:
+		return vm.push(vm.builtins.Get(operands[0]))
+	case code.OpClosure:
+		return vm.pushClosure(operands[0], operands[1])
+	case code.OpGetFree:
+		return vm.push(deref(vm.currentFrame().cl.Free[operands[0]]))
+	case code.OpAssignFree:
+		vm.assignFree(operands[0])
+	case code.OpCaptureFree:
+		return vm.push(vm.currentFrame().cl.Free[operands[0]])
+	default:
+		return fmt.Errorf("unsupported wide instruction: %s", def.Name)
 	}
 	return nil
 }
 
+func (vm *VM) buildArray(num int) error {
+	arr := make([]object.Object, num)
+	for i := num - 1; i >= 0; i-- {
+		arr[i] = vm.pop()
+	}
+	return vm.push(&object.Array{Elements: arr})
+}
+
+func (vm *VM) buildHash(num int) error {
+	hash := make(map[object.HashKey]object.HashPair)
+	for i := 0; i < num; i += 2 {
+		v := vm.pop()
+		k := vm.pop()
+		kp := object.HashPair{Key: k, Value: v}
+		hashKey, ok := k.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", k.Type())
+		}
+		hash[hashKey.HashKey()] = kp
+	}
+	return vm.push(&object.Hash{Pairs: hash})
+}
+
+func (vm *VM) interpolate(num int) error {
+	var out strings.Builder
+	for _, part := range vm.stack[vm.sp-num : vm.sp] {
+		out.WriteString(part.Inspect())
+	}
+	vm.sp = vm.sp - num
+	return vm.push(&object.String{Value: out.String()})
+}
+
+// enterTry activates the exception handler at index of the current function
+func (vm *VM) enterTry(index int) {
+	handler := vm.currentFrame().cl.Fn.Handlers[index]
+	vm.tries = append(vm.tries, tryBlock{frameIndex: vm.frameIndex, sp: vm.sp, catch: handler.Catch})
+}
+
+func (vm *VM) assignLocal(index int) {
+	slot := &vm.stack[vm.currentFrame().basePointer+index]
+	if cell, ok := (*slot).(*object.Cell); ok {
+		cell.Value = vm.pop()
+	} else {
+		*slot = vm.pop()
+	}
+}
+
+// captureLocal boxes a local variable in place so closures share it
+func (vm *VM) captureLocal(index int) error {
+	slot := &vm.stack[vm.currentFrame().basePointer+index]
+	cell, ok := (*slot).(*object.Cell)
+	if !ok {
+		cell = &object.Cell{Value: *slot}
+		*slot = cell
+	}
+	return vm.push(cell)
+}
+
+func (vm *VM) assignFree(index int) {
+	currentClosure := vm.currentFrame().cl
+	if cell, ok := currentClosure.Free[index].(*object.Cell); ok {
+		cell.Value = vm.pop()
+	} else {
+		currentClosure.Free[index] = vm.pop()
+	}
+}
+
 func (vm *VM) executeCall(numArgs int) error {
 	callee := vm.stack[vm.sp-1-numArgs]
 	switch callee := callee.(type) {
@@ -259,6 +593,9 @@ func (vm *VM) executeCall(numArgs int) error {
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 	result := builtin.Fn(args...)
+	if err, ok := result.(*object.Error); ok {
+		return &thrownError{err: err}
+	}
 
 	vm.sp = vm.sp - 1 - numArgs
 	if result != nil {
@@ -275,8 +612,16 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 		return fmt.Errorf("wrong number of arguments: want=%d, got=%d", fn.NumParameters, numArgs)
 	}
 
+	if vm.frameIndex >= MaxFrames || vm.sp-numArgs+fn.NumLocals >= StackSize {
+		return fmt.Errorf("stack overflow")
+	}
+
 	frame := NewFrame(cl, vm.sp-numArgs)
 	vm.pushFrame(frame)
+	// locals not set yet are null, not values left by an earlier call
+	for i := vm.sp; i < frame.basePointer+fn.NumLocals; i++ {
+		vm.stack[i] = nil
+	}
 	vm.sp = frame.basePointer + fn.NumLocals
 
 	return nil
@@ -318,13 +663,53 @@ func (vm *VM) executeHashIndex(left, index object.Object) error {
 	return vm.push(pair.Value)
 }
 
+func (vm *VM) executeSetIndex(left, index, value object.Object) error {
+	switch left := left.(type) {
+	case *object.Array:
+		i, ok := index.(*object.Integer)
+		if !ok {
+			return fmt.Errorf("array index must be INTEGER, got %s", index.Type())
+		}
+		if i.Value < 0 || i.Value >= int64(len(left.Elements)) {
+			return fmt.Errorf("index out of range: %d", i.Value)
+		}
+		left.Elements[i.Value] = value
+		return nil
+	case *object.Hash:
+		key, ok := index.(object.Hashable)
+		if !ok {
+			return fmt.Errorf("unusable as hash key: %s", index.Type())
+		}
+		left.Pairs[key.HashKey()] = object.HashPair{Key: index, Value: value}
+		return nil
+	default:
+		return fmt.Errorf("index assignment not supported: %s", left.Type())
+	}
+}
+
 func (vm *VM) executeMinusOperator() error {
 	value := vm.pop()
-	if value.Type() != object.INTEGER_OBJ {
-		return fmt.Errorf("minus operator only support integer, got=%s", value.Type())
+	switch value := value.(type) {
+	case *object.Integer:
+		result, ok := object.CheckedNeg(value.Value)
+		if !ok && vm.checkedArithmetic {
+			return fmt.Errorf("integer overflow")
+		}
+		return vm.push(&object.Integer{Value: result})
+	case *object.Float:
+		return vm.push(&object.Float{Value: -value.Value})
+	default:
+		return fmt.Errorf("minus operator only support numbers, got=%s", value.Type())
 	}
-	integer := value.(*object.Integer)
-	return vm.push(&object.Integer{Value: -integer.Value})
+}
+
+func (vm *VM) executeBitNotOperator() error {
+	value := vm.pop()
+	integer, ok := value.(*object.Integer)
+	if !ok {
+		return fmt.Errorf("bitwise not operator only support integers, got=%s", value.Type())
+	}
+	return vm.push(&object.Integer{Value: ^integer.Value})
 }
 
 func (vm *VM) executeBangOperator() error {
@@ -349,6 +734,9 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, toFloat(left), toFloat(right))
+	}
 
 	switch op {
 	case code.OpEqual:
@@ -370,6 +758,31 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+}
+
+func (vm *VM) executeFloatComparison(op code.Opcode, leftValue, rightValue float64) error {
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue == rightValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue != rightValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessOrEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
 		return fmt.Errorf("unknown operator: %d", op)
 	}
@@ -382,6 +795,8 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	rightType := right.Type()
 	if leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ {
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	} else if isNumber(left) && isNumber(right) {
+		return vm.executeBinaryFloatOperation(op, toFloat(left), toFloat(right))
 	} else if leftType == object.STRING_OBJ && rightType == object.STRING_OBJ {
 		return vm.executeBinaryStringOperation(op, left, right)
 	}
@@ -390,9 +805,58 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 
 func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, leftObj object.Object, rightObj object.Object) error {
 	var result int64
+	ok := true
 	leftValue := leftObj.(*object.Integer).Value
 	rightValue := rightObj.(*object.Integer).Value
 	switch op {
+	case code.OpAdd:
+		result, ok = object.CheckedAdd(leftValue, rightValue)
+	case code.OpSub:
+		result, ok = object.CheckedSub(leftValue, rightValue)
+	case code.OpMul:
+		result, ok = object.CheckedMul(leftValue, rightValue)
+	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
+		result, ok = object.CheckedDiv(leftValue, rightValue)
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("modulo by zero")
+		}
+		result = leftValue % rightValue
+	case code.OpPow:
+		if rightValue < 0 {
+			return fmt.Errorf("negative exponent in integer power: %d", rightValue)
+		}
+		result, ok = object.CheckedPow(leftValue, rightValue)
+	case code.OpBitAnd:
+		result = leftValue & rightValue
+	case code.OpBitOr:
+		result = leftValue | rightValue
+	case code.OpBitXor:
+		result = leftValue ^ rightValue
+	case code.OpShiftLeft, code.OpShiftRight:
+		if rightValue < 0 {
+			return fmt.Errorf("negative shift count: %d", rightValue)
+		}
+		if op == code.OpShiftLeft {
+			result, ok = object.CheckedShl(leftValue, rightValue)
+		} else {
+			result = leftValue >> uint64(rightValue)
+		}
+	default:
+		return fmt.Errorf("unknown integer operator: %d", op)
+	}
+	if !ok && vm.checkedArithmetic {
+		return fmt.Errorf("integer overflow")
+	}
+	return vm.push(&object.Integer{Value: result})
+}
+
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, leftValue, rightValue float64) error {
+	var result float64
+	switch op {
 	case code.OpAdd:
 		result = leftValue + rightValue
 	case code.OpSub:
@@ -400,11 +864,21 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, leftObj object.Objec
 	case code.OpMul:
 		result = leftValue * rightValue
 	case code.OpDiv:
+		if rightValue == 0 {
+			return fmt.Errorf("division by zero")
+		}
 		result = leftValue / rightValue
+	case code.OpMod:
+		if rightValue == 0 {
+			return fmt.Errorf("modulo by zero")
+		}
+		result = math.Mod(leftValue, rightValue)
+	case code.OpPow:
+		result = math.Pow(leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return fmt.Errorf("unknown float operator: %d", op)
 	}
-	return vm.push(&object.Integer{Value: result})
+	return vm.push(&object.Float{Value: result})
 }
 
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, leftObj, rightObj object.Object) error {
@@ -455,6 +929,10 @@ func (vm *VM) pushFrame(f *Frame) {
 
 func (vm *VM) popFrame() *Frame {
 	vm.frameIndex--
+	// drop the handlers of a function returning from inside a try block
+	for len(vm.tries) > 0 && vm.tries[len(vm.tries)-1].frameIndex > vm.frameIndex {
+		vm.tries = vm.tries[:len(vm.tries)-1]
+	}
 	return vm.frames[vm.frameIndex]
 }
 
@@ -481,6 +959,34 @@ func nativeBoolToBooleanObject(b bool) object.Object {
 	return False
 }
 
+// deref returns the value of a variable, unwrapping it if it was captured
+// by a closure. A variable that was never set is null.
+func deref(obj object.Object) object.Object {
+	if cell, ok := obj.(*object.Cell); ok {
+		obj = cell.Value
+	}
+	if obj == nil {
+		return Null
+	}
+	return obj
+}
+
+func isNumber(obj object.Object) bool {
+	t := obj.Type()
+	return t == object.INTEGER_OBJ || t == object.FLOAT_OBJ
+}
+
+// toFloat converts an Integer or Float to float64
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
 func isTruthy(cond object.Object) bool {
 	switch cond {
 	case True:
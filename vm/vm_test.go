@@ -3,10 +3,14 @@ package vm
 import (
 	"fmt"
 	"lyz-lang-2nd/ast"
+	"lyz-lang-2nd/code"
 	"lyz-lang-2nd/compiler"
+	"lyz-lang-2nd/internal/lyztest"
 	"lyz-lang-2nd/lexer"
 	"lyz-lang-2nd/object"
 	"lyz-lang-2nd/parser"
+	"math"
+	"strings"
 	"testing"
 )
 
@@ -36,8 +40,23 @@ func runVmTests(t *testing.T, tests []vmTestCase) {
 			fmt.Printf("\n")
 		}
 
+		err = Verify(comp.Bytecode())
+		if err != nil {
+			t.Fatalf("%q: verifier error: %s", tt.input, err)
+		}
+
 		vm := New(comp.Bytecode())
 		err = vm.Run()
+		if expected, ok := tt.expected.(*object.Error); ok {
+			// errors are raised as uncaught exceptions
+			if err == nil {
+				t.Fatalf("%q: expected VM error %q but resulted in none", tt.input, expected.Message)
+			}
+			if !strings.HasSuffix(err.Error(), ": "+expected.Message) {
+				t.Errorf("%q: wrong VM error. want=%q, got=%q", tt.input, expected.Message, err.Error())
+			}
+			continue
+		}
 		if err != nil {
 			t.Fatalf("vm error: %s", err)
 		}
@@ -54,6 +73,11 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(exp, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		err := testBooleanObject(exp, actual)
 		if err != nil {
@@ -138,6 +162,19 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)", actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g", result.Value, expected)
+	}
+
+	return nil
+}
+
 func testBooleanObject(expected bool, actual object.Object) error {
 	result, ok := actual.(*object.Boolean)
 	if !ok {
@@ -182,6 +219,43 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"2 ** 10", 1024},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", -4},
+		{"5 ** 0", 1},
+		{"6 & 3", 2},
+		{"6 | 3", 7},
+		{"6 ^ 3", 5},
+		{"1 << 4", 16},
+		{"-16 >> 2", -4},
+		{"~5", -6},
+		{"1 + 2 << 1", 6},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"1.5", 1.5},
+		{"2e3", 2000.0},
+		{"1.5 + 2.25", 3.75},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"7 / 2.0", 3.5},
+		{"-2.5", -2.5},
+		{"1.0 / 4 - 1", -0.75},
+		{"7.5 % 2", 1.5},
+		{"4 ** 0.5", 2.0},
+		{"2.0 ** 3", 8.0},
+		{"1.5 > 1", true},
+		{"1 < 1.5", true},
+		{"1 == 1.0", true},
+		{"1.5 != 1.5", false},
+		{"{1: 10}[1.0]", 10},
+		{"{2.5: 10}[2.5]", 10},
 	}
 
 	runVmTests(t, tests)
@@ -208,6 +282,12 @@ func TestBooleanExpressions(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 <= 1", true},
+		{"2 <= 1", false},
+		{"1 >= 1", true},
+		{"1 >= 2", false},
+		{"1.5 <= 2", true},
+		{"2 >= 2.5", false},
 		{"!true", false},
 		{"!false", true},
 		{"!5", false},
@@ -219,6 +299,120 @@ func TestBooleanExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestOperandEvaluationOrder(t *testing.T) {
+	tests := []vmTestCase{
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(1) < f(2); log`, []int{1, 2}},
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(2) <= f(1); log`, []int{2, 1}},
+		{`let log = []; let f = fn(x) { log = push(log, x); x }; f(1) >= f(2); log`, []int{1, 2}},
+	}
+	runVmTests(t, tests)
+}
+
+func TestOperatorErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"2 ** -1", "1:1: negative exponent in integer power: -1"},
+		{"1 << -1", "1:1: negative shift count: -1"},
+		{"~1.5", "1:1: bitwise not operator only support integers, got=FLOAT"},
+		{"1 / 0", "1:1: division by zero"},
+		{"5 % 0", "1:1: modulo by zero"},
+		{"1.0 / 0", "1:1: division by zero"},
+		{"1 / 0.0", "1:1: division by zero"},
+		{"1.5 % 0", "1:1: modulo by zero"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("%q: expected VM error but resulted in none", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong VM error. want=%q, got=%q", tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestDivisionByZeroIsCatchable(t *testing.T) {
+	tests := []vmTestCase{
+		{"let r = 0; try { 1 / 0; } catch (e) { r = e; } r", "division by zero"},
+		{"let r = 0; try { 5 % 0; } catch (e) { r = e; } r", "modulo by zero"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestCheckedArithmetic(t *testing.T) {
+	tests := []struct {
+		input     string
+		unchecked int64
+	}{
+		{"9223372036854775807 + 1", math.MinInt64},
+		{"-9223372036854775807 - 2", math.MaxInt64},
+		{"4611686018427387904 * 2", math.MinInt64},
+		{"let x = -9223372036854775807 - 1; -x", math.MinInt64},
+		{"let x = -9223372036854775807 - 1; x / -1", math.MinInt64},
+		{"2 ** 63", math.MinInt64},
+		{"1 << 63", math.MinInt64},
+	}
+
+	for _, tt := range tests {
+		for _, checked := range []bool{false, true} {
+			program := parse(tt.input)
+			comp := compiler.New()
+			err := comp.Compile(program)
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			vm := New(comp.Bytecode())
+			vm.SetCheckedArithmetic(checked)
+			err = vm.Run()
+			if !checked {
+				if err != nil {
+					t.Fatalf("%q: vm error: %s", tt.input, err)
+				}
+				if err := testIntegerObject(tt.unchecked, vm.LastPoppedStackElem()); err != nil {
+					t.Errorf("%q: %s", tt.input, err)
+				}
+				continue
+			}
+			if err == nil {
+				t.Fatalf("%q: expected overflow error but resulted in none", tt.input)
+			}
+			if !strings.HasSuffix(err.Error(), ": integer overflow") {
+				t.Errorf("%q: wrong VM error. got=%q", tt.input, err.Error())
+			}
+		}
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && 2", 2},
+		{"0 && 2", 2},
+		{"false && 2", false},
+		{"1 || 2", 1},
+		{`false || "x"`, "x"},
+		{"1 < 2 && 2 < 3", true},
+		{"if (1 > 2 || 3 > 2) { 10 } else { 20 }", 10},
+		{"let n = 0; let f = fn() { n += 1; true }; false && f(); true || f(); n", 0},
+		{"let n = 0; let f = fn() { n += 1; true }; true && f(); false || f(); n", 2},
+	}
+	runVmTests(t, tests)
+}
+
 func TestConditionals(t *testing.T) {
 	tests := []vmTestCase{
 		{"if (true) { 10 }", 10},
@@ -231,6 +425,10 @@ func TestConditionals(t *testing.T) {
 		{"if (1 > 2) { 10 }", Null},
 		{"if (false) { 10 }", Null},
 		{"if ((if (false) { 10 })) { 10 } else { 20 }", 20},
+		{"if (true) { let x = 1; }", Null},
+		{"if (false) { 10 } else { }", Null},
+		{"let x = 0; if (true) { x = 5; } x", 5},
+		{"let f = fn(n) { if (n > 0) { let m = n; } else { 1 } }; f(1)", Null},
 	}
 	runVmTests(t, tests)
 }
@@ -253,6 +451,352 @@ func TestStringExpressions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestInterpolatedStrings(t *testing.T) {
+	tests := []vmTestCase{
+		{`"plain ${"string"}"`, "plain string"},
+		{`let name = "lyz"; let age = 2; "hello ${name}, you are ${age + 1}"`, "hello lyz, you are 3"},
+		{`"${1.5} ${true} ${[1, 2]} ${if (false) { 1 }}"`, "1.5 true [1, 2] null"},
+		{`let f = fn(x) { "<${x}>" }; "${f("a")}${f(1)}"`, "<a><1>"},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{`let f = fn() { while (true) { break; } 5 }; f()`, 5},
+		{`let f = fn(arr, t) { for (x in arr) { if (x == t) { return x * 10; } } -1 }; f([1, 2, 3], 2)`, 20},
+		{`let f = fn(arr, t) { for (x in arr) { if (x == t) { return x * 10; } } -1 }; f([1, 2, 3], 5)`, -1},
+		{`let f = fn(arr) { for (x in arr) { if (x < 3) { continue; } return x; } 0 }; f([1, 2, 3, 4])`, 3},
+		{`let f = fn(s) { for (c in s) { return c; } }; f("abc")`, "a"},
+		{`let f = fn() { for (x in []) { return 1; } }; f()`, Null},
+		{`let f = fn(a, b) { for (x in a) { for (y in b) { if (y == 2) { break; } if (x == 2) { return [x, y]; } } } }; f([1, 2], [1, 2])`, []int{2, 1}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []vmTestCase{
+		{`let x = 1; x = x + 1; x`, 2},
+		{`let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x`, 6},
+		{`let s = "a"; s += "b"; s`, "ab"},
+		{`let f = fn() { let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; } sum }; f()`, 15},
+		{`let a = [1, 2, 3]; a[1] = 20; a`, []int{1, 20, 3}},
+		{`let h = {"a": 1}; h["a"] = 2; h["b"] = 3; h["a"] + h["b"]`, 5},
+		{`let f = fn(a) { a[0] = 9; }; let a = [1]; f(a); a[0]`, 9},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestClosuresShareVariables(t *testing.T) {
+	tests := []vmTestCase{
+		{`
+		let counter = fn() {
+			let n = 0;
+			fn() { n += 1; n }
+		};
+		let c = counter();
+		c(); c(); c()
+		`, 3},
+		{`
+		let f = fn() {
+			let x = 1;
+			let get = fn() { x };
+			x = 2;
+			get()
+		};
+		f()
+		`, 2},
+		{`
+		let f = fn() {
+			let x = 1;
+			let g = fn() { fn() { x = x * 10; } };
+			g()();
+			x
+		};
+		f()
+		`, 10},
+		{`
+		let f = fn() {
+			let fns = [];
+			for (i in [1, 2, 3]) {
+				let v = i;
+				fns = push(fns, fn() { v });
+			}
+			fns[0]() + fns[2]()
+		};
+		f()
+		`, 4},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestIndexAssignmentErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`let a = [1]; a[1] = 2;`, "1:14: index out of range: 1"},
+		{`let a = [1]; a["x"] = 2;`, "1:14: array index must be INTEGER, got STRING"},
+		{`let h = {}; h[fn() {}] = 1;`, "1:13: unusable as hash key: CLOSURE"},
+		{`let x = 1; x[0] = 1;`, "1:12: index assignment not supported: INTEGER"},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("%q: expected VM error but resulted in none", tt.input)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong VM error. want=%q, got=%q", tt.input, tt.expected, err.Error())
+		}
+	}
+}
+
+func TestExceptions(t *testing.T) {
+	tests := []vmTestCase{
+		{`let r = 0; try { throw 1; r = 2; } catch (e) { r = e; } r`, 1},
+		{`let r = ""; try { len(1); } catch (e) { r = e; } r`, "argument to `len` not supported, got INTEGER"},
+		{`let r = 0; try { r = 1; } catch (e) { r = 2; } r`, 1},
+		{`let n = 0; try { n += 1; } finally { n *= 10; } n`, 10},
+		{`let n = 0; try { throw 1; } catch (e) { n += e; } finally { n *= 10; } n`, 10},
+		{`let n = 0; let f = fn() { try { throw 5; } finally { n = 1; } }; let r = 0; try { f(); } catch (e) { r = e + n; } r`, 6},
+		{`let n = 0; let f = fn() { try { return 1; } finally { n = 10; } }; f() + n`, 11},
+		{`let n = 0; while (true) { try { break; } finally { n += 1; } } n`, 1},
+		{`let n = 0; for (x in [1, 2, 3]) { try { if (x == 2) { continue; } n += x; } finally { n += 10; } } n`, 34},
+		{`let r = 0; try { try { throw 1; } catch (e) { throw e + 1; } } catch (e) { r = e; } r`, 2},
+		{`let n = 0; let r = 0; try { try { throw 1; } catch (e) { throw 2; } finally { n = 5; } } catch (e) { r = e + n; } r`, 7},
+		{`let f = fn() { try { throw 1; } catch (e) { return e + 1; } }; 10 + f()`, 12},
+		{`let f = fn(n) { if (n == 0) { throw "bottom"; } f(n - 1) }; let r = ""; try { f(50); } catch (e) { r = e; } r`, "bottom"},
+		{`let f = fn() { try { return 1; } catch (e) { return 2; } }; f(); let r = 0; try { throw 3; } catch (e) { r = e; } r`, 3},
+		{`let r = 0; try { throw {"code": 4}; } catch (e) { r = e["code"]; } r`, 4},
+		{`let r = ""; try { 1 + "a"; } catch (e) { r = e; } r`, "unsupported types for binary operation: INTEGER STRING"},
+		{`let g = fn() { throw 7; }; let f = fn() { try { 1 + [2, g()][0]; } catch (e) { return e; } }; [10, f()]`, []int{10, 7}},
+		{`let a = [1, 2]; try { a = [3, a[0] + len(1)]; } catch (e) { a = [9, len(a)]; } a`, []int{9, 2}},
+		{`throw "boom";`, &object.Error{Message: "uncaught exception: boom"}},
+		{`try { throw 1; } finally { 2; }`, &object.Error{Message: "uncaught exception: 1"}},
+		{`try { len(1); } catch (e) { throw e; }`, &object.Error{Message: "uncaught exception: argument to `len` not supported, got INTEGER"}},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestStackTraces(t *testing.T) {
+	tests := []struct {
+		input           string
+		expectedMessage string
+		expectedFrames  []string
+	}{
+		{
+			"let add = fn(a, b) { a + b };\nlet outer = fn() {\n  let inner = fn() { add(1) };\n  inner()\n};\nouter();",
+			"wrong number of arguments: want=2, got=1",
+			[]string{"inner (3:22)", "outer (4:3)", "<main> (6:1)"},
+		},
+		{
+			"let f = fn() { len(1) };\nf()",
+			"argument to `len` not supported, got INTEGER",
+			[]string{"f (1:16)", "<main> (2:1)"},
+		},
+		{
+			"fn() { throw 1; }()",
+			"uncaught exception: 1",
+			[]string{"<anonymous> (1:8)", "<main> (1:1)"},
+		},
+		{
+			"let f = fn(x) { x + \"a\" };\nlet g = fn() { [1, f(2)] };\n1 + g();",
+			"unsupported types for binary operation: INTEGER STRING",
+			[]string{"f (1:17)", "g (2:20)", "<main> (3:5)"},
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err = New(comp.Bytecode()).Run()
+		rerr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Fatalf("%q: error is not *object.RuntimeError. got=%T (%v)", tt.input, err, err)
+		}
+		testRuntimeError(t, rerr, tt.expectedMessage, tt.expectedFrames)
+	}
+}
+
+func testRuntimeError(t *testing.T, err *object.RuntimeError, message string, frames []string) {
+	t.Helper()
+	if err.Message != message {
+		t.Errorf("wrong message. want=%q, got=%q", message, err.Message)
+	}
+	if len(err.Frames) != len(frames) {
+		t.Fatalf("wrong number of frames. want=%d, got=%d (%v)", len(frames), len(err.Frames), err.Frames)
+	}
+	for i, f := range frames {
+		if err.Frames[i].String() != f {
+			t.Errorf("frames[%d] wrong. want=%q, got=%q", i, f, err.Frames[i].String())
+		}
+	}
+}
+
+func TestWideOperands(t *testing.T) {
+	var captured, sum, constants []string
+	for i := 0; i < 300; i++ {
+		captured = append(captured, fmt.Sprintf("let free%s = %d;", lyztest.Name(i), i))
+		sum = append(sum, "free"+lyztest.Name(i))
+	}
+	for i := 0; i < 70000; i++ {
+		constants = append(constants, fmt.Sprintf("%d;", i))
+	}
+
+	tests := []vmTestCase{
+		{lyztest.WideCall(300), 299},
+		{
+			fmt.Sprintf("fn() { %s fn() { %s } }()()", strings.Join(captured, " "), strings.Join(sum, " + ")),
+			44850,
+		},
+		{strings.Join(constants, " "), 69999},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestRunUnmarshaledBytecode(t *testing.T) {
+	tests := []vmTestCase{
+		{"let fib = fn(n) { if (n < 2) { return n; } fib(n - 1) + fib(n - 2) }; fib(10)", 55},
+		{`let r = ""; try { throw "x"; } catch (e) { r = e + "y"; } r`, "xy"},
+		{"let f = fn() { let n = 1; fn() { n = n * 2.5; n } }(); f(); f()", 6.25},
+	}
+
+	for _, tt := range tests {
+		for _, debug := range []bool{true, false} {
+			comp := compiler.New()
+			err := comp.Compile(parse(tt.input))
+			if err != nil {
+				t.Fatalf("compiler error: %s", err)
+			}
+			data, err := compiler.Marshal(comp.Bytecode(), debug)
+			if err != nil {
+				t.Fatalf("marshal error: %s", err)
+			}
+			bytecode, err := compiler.Unmarshal(data)
+			if err != nil {
+				t.Fatalf("unmarshal error: %s", err)
+			}
+
+			vm := New(bytecode)
+			err = vm.Run()
+			if err != nil {
+				t.Fatalf("vm error: %s", err)
+			}
+			testExpectedObject(t, tt.expected, vm.LastPoppedStackElem())
+		}
+	}
+}
+
+func TestUnsetVariablesAreNull(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = x + 1;", &object.Error{Message: "unsupported types for binary operation: NULL INTEGER"}},
+		{"if (false) { let y = 1 }; y + 1", &object.Error{Message: "unsupported types for binary operation: NULL INTEGER"}},
+		{"if (false) { let y = 1 }; y", Null},
+		// a local is not left over from an earlier call
+		{"let f = fn(b) { if (b) { let y = 5 }; y }; f(true); f(false)", Null},
+	}
+	runVmTests(t, tests)
+}
+
+// TestVerifiedBytecodeDoesNotPanic runs bytecode that passes Verify but does
+// not come from the compiler, as found by fuzzing .lyzc files
+func TestVerifiedBytecodeDoesNotPanic(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		var out code.Instructions
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	fn := &object.CompiledFunction{Instructions: concat(code.Make(code.OpNull), code.Make(code.OpReturnValue))}
+	tests := []struct {
+		bytecode *compiler.Bytecode
+		expected string
+	}{
+		{
+			&compiler.Bytecode{Instructions: concat(
+				code.Make(code.OpArray, 0),
+				code.Make(code.OpIterNext, 7),
+				code.Make(code.OpPop),
+			)},
+			"OpIterNext without an iterator",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(
+					code.Make(code.OpConstant, 0),
+					code.Make(code.OpIterNext, 7),
+					code.Make(code.OpPop),
+				),
+				Constants: []object.Object{&object.Integer{Value: 1}},
+			},
+			"OpIterNext without an iterator",
+		},
+		{
+			&compiler.Bytecode{
+				Instructions: concat(
+					code.Make(code.OpClosure, 0, 0),
+					code.Make(code.OpIterNext, 8),
+					code.Make(code.OpPop),
+				),
+				Constants: []object.Object{fn},
+			},
+			"OpIterNext without an iterator",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpGetGlobal, 1),
+				code.Make(code.OpAdd),
+				code.Make(code.OpPop),
+			)},
+			"unsupported types for binary operation: NULL NULL",
+		},
+		{
+			&compiler.Bytecode{Instructions: concat(
+				code.Make(code.OpGetGlobal, 0),
+				code.Make(code.OpConstant, 0),
+				code.Make(code.OpGreaterThan),
+				code.Make(code.OpPop),
+			), Constants: []object.Object{&object.Integer{Value: 1}}},
+			"unknown operator: 10 (NULL INTEGER)",
+		},
+	}
+	for i, tt := range tests {
+		if err := Verify(tt.bytecode); err != nil {
+			t.Fatalf("test %d: verifier error: %s", i, err)
+		}
+		err := New(tt.bytecode).Run()
+		if err == nil || err.Error() != tt.expected {
+			t.Errorf("test %d: wrong error. want=%q, got=%v", i, tt.expected, err)
+		}
+	}
+
+	// the verifier rejects it, but running it must not panic either
+	err := New(&compiler.Bytecode{Instructions: code.Make(code.OpEndTry)}).Run()
+	if err == nil || err.Error() != "OpEndTry without an active handler" {
+		t.Errorf("wrong error for a lone OpEndTry: %v", err)
+	}
+}
+
 func TestArrayLiterals(t *testing.T) {
 	tests := []vmTestCase{
 		{"[]", []int{}},
@@ -518,15 +1062,15 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
 			input:    `fn() { 1; }(1);`,
-			expected: `wrong number of arguments: want=0, got=1`,
+			expected: `1:1: wrong number of arguments: want=0, got=1`,
 		},
 		{
 			input:    `fn(a) { a; }();`,
-			expected: `wrong number of arguments: want=1, got=0`,
+			expected: `1:1: wrong number of arguments: want=1, got=0`,
 		},
 		{
 			input:    `fn(a, b) { a + b; }(1);`,
-			expected: `wrong number of arguments: want=2, got=1`,
+			expected: `1:1: wrong number of arguments: want=2, got=1`,
 		},
 	}
 	for _, tt := range tests {
@@ -743,3 +1287,40 @@ func TestRecursiveFibonacci(t *testing.T) {
 	}
 	runVmTests(t, tests)
 }
+
+func TestBuiltinRegistry(t *testing.T) {
+	var calls []string
+	builtins := object.NewBuiltinRegistry()
+	builtins.Register("record", func(args ...object.Object) object.Object {
+		calls = append(calls, args[0].Inspect())
+		return &object.Integer{Value: int64(len(calls))}
+	})
+
+	comp := compiler.NewWithOptions(compiler.Options{Builtins: builtins})
+	if err := comp.Compile(parse(`let f = fn(x) { record(x) }; f("a"); record(len("bc"))`)); err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	opts := Options{Builtins: builtins}
+	if err := VerifyWith(comp.Bytecode(), opts); err != nil {
+		t.Fatalf("verifier error: %s", err)
+	}
+	err := Verify(comp.Bytecode())
+	if err == nil || !strings.Contains(err.Error(), "builtin index 6 out of range, there are 6 builtins") {
+		t.Errorf("expected the default builtins to reject the bytecode, got=%v", err)
+	}
+
+	vm := NewWithOptions(comp.Bytecode(), opts)
+	if err := vm.Run(); err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+	if err := testIntegerObject(2, vm.LastPoppedStackElem()); err != nil {
+		t.Errorf("%s", err)
+	}
+	if fmt.Sprint(calls) != "[a 2]" {
+		t.Errorf("wrong calls. got=%v", calls)
+	}
+
+	if err := compiler.New().Compile(parse("record(1)")); err == nil {
+		t.Errorf("builtin of another compiler resolved")
+	}
+}